@@ -3,8 +3,12 @@ package client
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"grpctest/pb"
+	"hash/crc32"
 	"io"
 	"log"
 	"os"
@@ -13,6 +17,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 // LaptopClient is a client to call laptop service RPCs
@@ -49,7 +54,7 @@ func (laptopClient *LaptopClient) CreateLaptop(laptop *pb.Laptop) {
 			log.Print("laptop already exists")
 		} else {
 			//否则记录这个严重的错误。
-			log.Fatal("can not create laptop:%v", err)
+			log.Fatalf("can not create laptop:%v", err)
 		}
 	}
 
@@ -58,6 +63,166 @@ func (laptopClient *LaptopClient) CreateLaptop(laptop *pb.Laptop) {
 
 }
 
+//通过id从服务器获取一台电脑
+func (laptopClient *LaptopClient) GetLaptop(laptopID string) (*pb.Laptop, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.GetLaptopRequest{Id: laptopID}
+	res, err := laptopClient.service.GetLaptop(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("can not get laptop: %w", err)
+	}
+
+	return res.GetLaptop(), nil
+}
+
+//用laptop替换服务器上id相同的电脑，返回更新后的电脑
+func (laptopClient *LaptopClient) UpdateLaptop(laptop *pb.Laptop) (*pb.Laptop, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.UpdateLaptopRequest{Laptop: laptop}
+	res, err := laptopClient.service.UpdateLaptop(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("can not update laptop: %w", err)
+	}
+
+	log.Printf("updated laptop with id:%s", res.GetLaptop().GetId())
+	return res.GetLaptop(), nil
+}
+
+//只把laptop中paths列出的字段（例如"price_usd"、"cpu.max_ghz"）更新到服务器上的电脑
+func (laptopClient *LaptopClient) UpdateLaptopFields(laptop *pb.Laptop, paths ...string) (*pb.Laptop, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.UpdateLaptopRequest{
+		Laptop:     laptop,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+	}
+	res, err := laptopClient.service.UpdateLaptop(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("can not update laptop fields: %w", err)
+	}
+
+	log.Printf("updated fields %v of laptop with id:%s", paths, res.GetLaptop().GetId())
+	return res.GetLaptop(), nil
+}
+
+//读取-修改-写入电脑，如果在此期间电脑被其他人修改（服务器返回Aborted），则重新读取后再试
+//modify在每次尝试时都会拿到服务器上最新的电脑，最多尝试maxAttempts次
+func (laptopClient *LaptopClient) UpdateLaptopWithRetry(
+	laptopID string,
+	maxAttempts int,
+	modify func(laptop *pb.Laptop) error,
+) (*pb.Laptop, error) {
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		var laptop *pb.Laptop
+		laptop, err = laptopClient.updateLaptopOnce(laptopID, modify)
+		if status.Code(err) != codes.Aborted {
+			return laptop, err
+		}
+
+		log.Printf("laptop %s was modified concurrently, attempt %d/%d", laptopID, attempt, maxAttempts)
+		if attempt < maxAttempts { //最后一次失败后直接返回，不需要再等
+			time.Sleep(time.Duration(attempt) * 10 * time.Millisecond) //稍等一会，避免和其他写入者一直冲突
+		}
+	}
+	return nil, fmt.Errorf("can not update laptop after %d attempts: %w", maxAttempts, err)
+}
+
+func (laptopClient *LaptopClient) updateLaptopOnce(laptopID string, modify func(laptop *pb.Laptop) error) (*pb.Laptop, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	getRes, err := laptopClient.service.GetLaptop(ctx, &pb.GetLaptopRequest{Id: laptopID})
+	if err != nil {
+		return nil, err
+	}
+
+	//laptop中带着读取时的版本号，服务器会用它检查是否有并发修改
+	laptop := getRes.GetLaptop()
+	if err := modify(laptop); err != nil {
+		return nil, err
+	}
+
+	updateRes, err := laptopClient.service.UpdateLaptop(ctx, &pb.UpdateLaptopRequest{Laptop: laptop})
+	if err != nil {
+		return nil, err
+	}
+	return updateRes.GetLaptop(), nil
+}
+
+//通过id删除服务器上的电脑
+func (laptopClient *LaptopClient) DeleteLaptop(laptopID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.DeleteLaptopRequest{Id: laptopID}
+	_, err := laptopClient.service.DeleteLaptop(ctx, req)
+	if err != nil {
+		return fmt.Errorf("can not delete laptop: %w", err)
+	}
+
+	log.Printf("deleted laptop with id:%s", laptopID)
+	return nil
+}
+
+//分页列出服务器上的电脑，返回这一页的电脑和下一页的token（为空表示没有下一页）
+func (laptopClient *LaptopClient) ListLaptops(pageSize uint32, pageToken string) ([]*pb.Laptop, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.ListLaptopsRequest{PageSize: pageSize, PageToken: pageToken}
+	res, err := laptopClient.service.ListLaptops(ctx, req)
+	if err != nil {
+		return nil, "", fmt.Errorf("can not list laptops: %w", err)
+	}
+
+	return res.GetLaptops(), res.GetNextPageToken(), nil
+}
+
+//订阅服务器上电脑的变化，直到ctx结束或者handle返回错误
+//连接因为客户端太慢或者服务器不可用而断开时，会从最后收到的事件序号继续订阅
+func (laptopClient *LaptopClient) WatchLaptops(
+	ctx context.Context,
+	filter *pb.Filter,
+	resumeAfter *uint64,
+	handle func(event *pb.LaptopEvent) error,
+) error {
+	for {
+		req := &pb.WatchLaptopsRequest{Filter: filter, ResumeAfter: resumeAfter}
+		stream, err := laptopClient.service.WatchLaptops(ctx, req)
+		if err != nil {
+			return fmt.Errorf("can not watch laptops: %w", err)
+		}
+
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				code := status.Code(err)
+				if ctx.Err() == nil && (code == codes.ResourceExhausted || code == codes.Unavailable) {
+					log.Printf("watch is interrupted, resume watching: %v", err)
+					break
+				}
+				return fmt.Errorf("can not receive event: %w", err)
+			}
+
+			event := res.GetEvent()
+			sequence := event.GetSequence()
+			resumeAfter = &sequence
+			if err := handle(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 func (laptopClient *LaptopClient) SearchLaptop(filter *pb.Filter) {
 	log.Print("search filter:", filter) //写一个日志显示过滤器的值
 
@@ -156,8 +321,221 @@ func (laptopClient *LaptopClient) UploadImage(laptopID string, imagePath string)
 		if err != nil {
 			log.Fatal("can not receive response:", err)
 		}
-		log.Print("image upload with id :%s,size: %d", res.GetId(), res.GetSize())
+		log.Printf("image upload with id :%s,size: %d", res.GetId(), res.GetSize())
+	}
+}
+
+const uploadChunkSize = 32 << 10 //可以断点续传的上传中每个数据块的大小
+
+var uploadCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+//以可以断点续传的方式上传图像，连接断开或者数据块损坏时从服务器已经确认的位置继续，最多尝试maxAttempts次
+func (laptopClient *LaptopClient) UploadImageResumable(
+	laptopID string,
+	imageType string,
+	image io.ReadSeeker,
+	maxAttempts int,
+) (*pb.UploadImageResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.StartImageUploadRequest{Info: &pb.ImageInfo{LaptopId: laptopID, ImageType: imageType}}
+	res, err := laptopClient.service.StartImageUpload(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("can not start image upload: %w", err)
+	}
+	return laptopClient.ResumeImageUpload(res.GetUploadId(), image, maxAttempts)
+}
+
+//继续一次已经开始的上传，先查询服务器已经确认的字节数，再从那里发送剩下的数据，最后校验整个图像的SHA-256
+func (laptopClient *LaptopClient) ResumeImageUpload(
+	uploadID string,
+	image io.ReadSeeker,
+	maxAttempts int,
+) (*pb.UploadImageResponse, error) {
+	if _, err := image.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("can not seek image: %w", err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, image); err != nil {
+		return nil, fmt.Errorf("can not read image: %w", err)
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = laptopClient.uploadRemainingChunks(uploadID, image)
+		if err == nil {
+			break
+		}
+		switch status.Code(errors.Unwrap(err)) {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.FailedPrecondition, codes.DataLoss:
+			log.Printf("upload %s is interrupted, retry %d/%d: %v", uploadID, attempt, maxAttempts, err)
+			time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+			continue
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can not upload image after %d attempts: %w", maxAttempts, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.FinishImageUploadRequest{UploadId: uploadID, Sha256: hex.EncodeToString(hash.Sum(nil))}
+	res, err := laptopClient.service.FinishImageUpload(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("can not finish image upload: %w", err)
+	}
+	log.Printf("image uploaded with id: %s, size: %d", res.GetId(), res.GetSize())
+	return res, nil
+}
+
+//从服务器已经确认的位置开始发送剩下的数据块
+func (laptopClient *LaptopClient) uploadRemainingChunks(uploadID string, image io.ReadSeeker) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	getRes, err := laptopClient.service.GetImageUpload(ctx, &pb.GetImageUploadRequest{UploadId: uploadID})
+	if err != nil {
+		return fmt.Errorf("can not get committed offset: %w", err)
+	}
+	offset := getRes.GetCommittedOffset()
+	if _, err := image.Seek(int64(offset), io.SeekStart); err != nil {
+		return fmt.Errorf("can not seek image: %w", err)
+	}
+
+	stream, err := laptopClient.service.UploadImageChunks(ctx)
+	if err != nil {
+		return fmt.Errorf("can not upload chunks: %w", err)
+	}
+
+	buffer := make([]byte, uploadChunkSize)
+	for {
+		n, err := io.ReadFull(image, buffer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("can not read image: %w", err)
+		}
+
+		req := &pb.UploadImageChunkRequest{
+			UploadId:  uploadID,
+			Offset:    offset,
+			ChunkData: buffer[:n],
+			Crc32C:    crc32.Checksum(buffer[:n], uploadCRCTable),
+		}
+		if err := stream.Send(req); err != nil {
+			//服务器出错时Send返回EOF，真正的错误由CloseAndRecv返回
+			break
+		}
+		offset += uint64(n)
+	}
+
+	if _, err := stream.CloseAndRecv(); err != nil {
+		return fmt.Errorf("can not upload chunks: %w", err)
+	}
+	return nil
+}
+
+//下载图像，把从offset开始的数据写到writer，返回图像信息
+//下载中断时可以用已经写入的字节数作为offset继续下载，rendition不为空时下载该尺寸的缩略图
+func (laptopClient *LaptopClient) DownloadImage(imageID string, rendition string, offset uint64, writer io.Writer) (*pb.ImageInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req := &pb.DownloadImageRequest{ImageId: imageID, Offset: offset, Rendition: rendition}
+	stream, err := laptopClient.service.DownloadImage(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("can not download image: %w", err)
+	}
+
+	//第一个响应是图像信息
+	res, err := stream.Recv()
+	if err != nil {
+		return nil, fmt.Errorf("can not receive image info: %w", err)
+	}
+	info := res.GetInfo()
+	if info == nil {
+		return nil, fmt.Errorf("the first response doesn't contain image info")
+	}
+
+	size := offset
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can not receive chunk data: %w", err)
+		}
+
+		n, err := writer.Write(res.GetChunkData())
+		size += uint64(n)
+		if err != nil {
+			return nil, fmt.Errorf("can not write chunk data: %w", err)
+		}
+	}
+
+	if size != info.GetSize() {
+		return nil, fmt.Errorf("image is incomplete: received %d of %d bytes", size, info.GetSize())
+	}
+	log.Printf("image downloaded with id: %s, size: %d", imageID, size)
+	return info, nil
+}
+
+//列出一台电脑的所有图像，rendition不为空时只列出有该尺寸缩略图的图像
+func (laptopClient *LaptopClient) ListImages(laptopID string, rendition string) ([]*pb.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.ListImagesRequest{LaptopId: laptopID, Rendition: rendition}
+	res, err := laptopClient.service.ListImages(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("can not list images: %w", err)
+	}
+	return res.GetImages(), nil
+}
+
+//查询当前用户上传的图像占用的空间和上传限制
+func (laptopClient *LaptopClient) GetImageUsage() (*pb.GetImageUsageResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := laptopClient.service.GetImageUsage(ctx, &pb.GetImageUsageRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("can not get image usage: %w", err)
+	}
+	return res, nil
+}
+
+//回收服务器上没有用的图像、文件和上传，dryRun为true时只列出会被删除的数据
+func (laptopClient *LaptopClient) CollectImageGarbage(dryRun bool) (*pb.CollectImageGarbageResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	res, err := laptopClient.service.CollectImageGarbage(ctx, &pb.CollectImageGarbageRequest{DryRun: dryRun})
+	if err != nil {
+		return nil, fmt.Errorf("can not collect image garbage: %w", err)
 	}
+	log.Printf("image garbage: %d items, %d bytes, %d failed", len(res.GetRemoved()), res.GetFreedBytes(), res.GetFailed())
+	return res, nil
+}
+
+//删除服务器上的图像
+func (laptopClient *LaptopClient) DeleteImage(imageID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := &pb.DeleteImageRequest{ImageId: imageID}
+	_, err := laptopClient.service.DeleteImage(ctx, req)
+	if err != nil {
+		return fmt.Errorf("can not delete image: %w", err)
+	}
+
+	log.Printf("deleted image with id:%s", imageID)
+	return nil
 }
 
 func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float64) error {
@@ -187,6 +565,10 @@ func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float6
 				return
 			}
 
+			if res.GetCode() != uint32(codes.OK) { //只有这个请求被拒绝，流没有结束
+				log.Printf("rating of laptop %s is rejected: %s", res.GetLaptopId(), res.GetMessage())
+				continue
+			}
 			log.Print("received response:", res)
 		}
 	}()
@@ -203,7 +585,7 @@ func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float6
 			return fmt.Errorf("can not send stream request:%v-%v", err, stream.RecvMsg(nil))
 		}
 
-		log.Print("sent request: %v", req)
+		log.Printf("sent request: %v", req)
 	}
 
 	//发送结束后告诉服务器我们不再发送任何数据。
@@ -216,3 +598,32 @@ func (laptopClient *LaptopClient) RateLaptop(laptopIDs []string, scores []float6
 	return err
 
 }
+
+//撤回当前用户对电脑的评分
+func (laptopClient *LaptopClient) WithdrawRating(laptopID string) (*pb.WithdrawRatingResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := laptopClient.service.WithdrawRating(ctx, &pb.WithdrawRatingRequest{LaptopId: laptopID})
+	if err != nil {
+		return nil, fmt.Errorf("can not withdraw rating: %w", err)
+	}
+	log.Printf("withdrew rating of laptop %s: %d ratings, average %.2f", laptopID, res.GetRatedCount(), res.GetAverageScore())
+	return res, nil
+}
+
+//查询一台或者多台电脑评分的分布
+func (laptopClient *LaptopClient) GetRating(laptopIDs ...string) (*pb.GetRatingResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := laptopClient.service.GetRating(ctx, &pb.GetRatingRequest{LaptopIds: laptopIDs})
+	if err != nil {
+		return nil, fmt.Errorf("can not get rating: %w", err)
+	}
+	for _, rating := range res.GetRatings() {
+		log.Printf("rating of laptop %s: %d ratings, mean %.2f, median %.1f, stddev %.2f, histogram %v",
+			rating.GetLaptopId(), rating.GetCount(), rating.GetMean(), rating.GetMedian(), rating.GetStddev(), rating.GetHistogram())
+	}
+	return res, nil
+}
@@ -75,6 +75,10 @@ func testRateLaptop(laptopClient *client.LaptopClient) {
 		}
 	}
 
+	//查看评分的分布
+	if _, err := laptopClient.GetRating(laptopIDs...); err != nil {
+		log.Fatal(err)
+	}
 }
 
 const (
@@ -83,13 +87,24 @@ const (
 	refreshDuration = 30 * time.Second
 )
 
+//方法名的前缀和服务端accessibleRoles一致，这些方法调用时会带上令牌
 func authMethods() map[string]bool {
-	const laptopServicePath = "/pb.LaptopService"
+	const laptopServicePath = "/pb.LaptopService/"
 
 	return map[string]bool{
-		laptopServicePath + "CreateLaptop": true,
-		laptopServicePath + "UploadImage":  true,
-		laptopServicePath + "RateLaptop":   true,
+		laptopServicePath + "CreateLaptop":        true,
+		laptopServicePath + "UpdateLaptop":        true,
+		laptopServicePath + "DeleteLaptop":        true,
+		laptopServicePath + "UploadImage":         true,
+		laptopServicePath + "DeleteImage":         true,
+		laptopServicePath + "StartImageUpload":    true,
+		laptopServicePath + "UploadImageChunks":   true,
+		laptopServicePath + "GetImageUpload":      true,
+		laptopServicePath + "FinishImageUpload":   true,
+		laptopServicePath + "GetImageUsage":       true,
+		laptopServicePath + "CollectImageGarbage": true,
+		laptopServicePath + "RateLaptop":          true,
+		laptopServicePath + "WithdrawRating":      true,
 	}
 }
 
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"grpctest/pb"
 	"grpctest/service"
+	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"google.golang.org/grpc"
@@ -32,30 +38,163 @@ func createUser(userStore service.UserStore, username, password, role string) er
 	if err != nil {
 		return err
 	}
-	return userStore.Save(user)
+	err = userStore.Save(user)
+	if errors.Is(err, service.ErrAlreadyExists) { //数据库中保存的用户在重启后仍然存在
+		return nil
+	}
+	return err
 }
 
+//gRPC的完整方法名是"/pb.LaptopService/CreateLaptop"，之前少了最后的"/"，所有方法都匹配不上，
+//没有登录也可以调用CreateLaptop、UploadImage和RateLaptop；现在这些方法没有令牌时返回Unauthenticated
 func accessibleRoles() map[string][]string {
-	const laptopServicePath = "/pb.LaptopService"
+	const laptopServicePath = "/pb.LaptopService/"
 
 	return map[string][]string{
-		laptopServicePath + "CreateLaptop": {"admin"},
-		laptopServicePath + "UploadImage":  {"admin"},
-		laptopServicePath + "RateLaptop":   {"admin", "user"},
+		laptopServicePath + "CreateLaptop":        {"admin"},
+		laptopServicePath + "UpdateLaptop":        {"admin"},
+		laptopServicePath + "DeleteLaptop":        {"admin"},
+		laptopServicePath + "UploadImage":         {"admin"},
+		laptopServicePath + "DeleteImage":         {"admin"},
+		laptopServicePath + "StartImageUpload":    {"admin"},
+		laptopServicePath + "UploadImageChunks":   {"admin"},
+		laptopServicePath + "GetImageUpload":      {"admin"},
+		laptopServicePath + "FinishImageUpload":   {"admin"},
+		laptopServicePath + "GetImageUsage":       {"admin", "user"},
+		laptopServicePath + "CollectImageGarbage": {"admin"},
+		laptopServicePath + "WithdrawRating":      {"admin", "user"},
+		laptopServicePath + "RateLaptop":          {"admin", "user"},
+	}
+}
+
+//服务器使用的所有store
+type stores struct {
+	laptopStore service.LaptopStore
+	ratingStore service.RatingStore
+	userStore   service.UserStore
+	closers     []io.Closer //服务器停止时需要关闭的资源
+}
+
+//根据命令行参数创建store，file只把电脑保存到磁盘，sqlite把电脑、评分和用户都保存到数据库
+func newStores(storeType, dataPath, fsync, dbPath string) (*stores, error) {
+	switch storeType {
+	case "memory":
+		return &stores{
+			laptopStore: service.NewInMemoryLaptopStore(),
+			ratingStore: service.NewInMemoryRatingStore(),
+			userStore:   service.NewInMemoryUserStore(),
+		}, nil
+	case "file":
+		policy, err := service.ParseFsyncPolicy(fsync)
+		if err != nil {
+			return nil, err
+		}
+		laptopStore, err := service.NewFileLaptopStore(dataPath, service.FileStoreOptions{Fsync: policy})
+		if err != nil {
+			return nil, err
+		}
+		return &stores{
+			laptopStore: laptopStore,
+			ratingStore: service.NewInMemoryRatingStore(),
+			userStore:   service.NewInMemoryUserStore(),
+			closers:     []io.Closer{laptopStore},
+		}, nil
+	case "sqlite":
+		db, err := service.OpenSQLiteDB(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		return &stores{
+			laptopStore: service.NewSQLLaptopStore(db),
+			ratingStore: service.NewSQLRatingStore(db),
+			userStore:   service.NewSQLUserStore(db),
+			closers:     []io.Closer{db},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown store type: %s", storeType)
+}
+
+//根据命令行参数创建图像store
+func newImageStore(storeType, imageFolder string, s3Config service.S3Config) (service.ImageStore, error) {
+	switch storeType {
+	case "disk":
+		return service.NewDiskImageStore(imageFolder)
+	case "content":
+		return service.NewContentAddressedImageStore(imageFolder)
+	case "s3":
+		//访问密钥和AWS的命令行工具一样从环境变量读取，不出现在命令行参数中
+		s3Config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3Config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		return service.NewS3ImageStore(s3Config)
+	}
+	return nil, fmt.Errorf("unknown image store type: %s", storeType)
+}
+
+//检查图像文件夹和图像信息是否一致，只报告不修改
+//命令行中是否给出了这个标志
+func flagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+func reportImages(imageStore *service.DiskImageStore) error {
+	report, err := imageStore.Reconcile()
+	if err != nil {
+		return err
 	}
+	for _, path := range report.OrphanFiles {
+		log.Printf("file without metadata: %s", path)
+	}
+	for _, info := range report.MissingFiles {
+		log.Printf("metadata without file: image %s of laptop %s at %s", info.ID, info.LaptopID, info.Path)
+	}
+	log.Printf("found %d files without metadata and %d images without files", len(report.OrphanFiles), len(report.MissingFiles))
+	return nil
 }
 
 func main() {
 	//使用flag.Int从命令行参数获取端口
 	port := flag.Int("port", 0, "the server port")
+	storeType := flag.String("store", "memory", "where to keep data: memory, file or sqlite")
+	dataPath := flag.String("data", "./data/", "the folder of the file store")
+	fsync := flag.String("fsync", "interval", "when the file store syncs its log to disk: always, interval or never")
+	dbPath := flag.String("db", "./laptop.db", "the database file of the sqlite store")
+	renditions := flag.String("renditions", "small=128,medium=512", "the renditions generated for uploaded images, like name=size,name=size")
+	uploadDir := flag.String("upload-dir", "", "the folder where resumable uploads are staged, empty means the system temporary folder")
+	imageStoreType := flag.String("image-store", "disk", "how to keep uploaded images: disk, content to store identical images once, or s3")
+	s3Endpoint := flag.String("s3-endpoint", "https://s3.amazonaws.com", "the endpoint of the S3 compatible image store")
+	s3Region := flag.String("s3-region", "us-east-1", "the region of the S3 bucket")
+	s3Bucket := flag.String("s3-bucket", "", "the bucket of the S3 image store")
+	s3Prefix := flag.String("s3-prefix", "", "the prefix of the keys of the images in the S3 bucket")
+	maxImageSize := flag.Int64("max-image-size", service.DefaultUploadLimits.MaxImageSize, "the maximum size of an uploaded image in bytes")
+	maxImagesPerLaptop := flag.Int("max-images-per-laptop", 0, "the maximum number of images of a laptop, 0 means no limit")
+	userQuota := flag.Int64("user-quota", 0, "the maximum total size of the images uploaded by a user in bytes, 0 means no limit")
+	gcInterval := flag.Duration("gc-interval", service.DefaultImageGCOptions.Interval, "how often unused images, files and uploads are removed, 0 disables the garbage collector")
+	gcGracePeriod := flag.Duration("gc-grace-period", service.DefaultImageGCOptions.GracePeriod, "how long unused images, files and uploads are kept before they are removed")
+	gcOrphanImages := flag.Bool("gc-orphan-images", service.DefaultImageGCOptions.OrphanImages, "remove images whose laptop is not in this server's laptop store, off by default with -image-store s3")
+	reconcileImages := flag.Bool("reconcile-images", false, "report image files without metadata and metadata without files, then exit")
 	//解析标志
 	flag.Parse()
+	//共用S3 bucket的其他副本有自己的电脑store，它们的电脑在这里找不到，除非明确指定，否则不回收电脑不存在的图像
+	if *imageStoreType == "s3" && !flagPassed("gc-orphan-images") {
+		*gcOrphanImages = false
+	}
 	//打印一个简单的日志
 	log.Printf("start server on port %d", *port)
 
+	stores, err := newStores(*storeType, *dataPath, *fsync, *dbPath)
+	if err != nil {
+		log.Fatal("cannot create stores: ", err)
+	}
+
 	//将身份验证添加到gRPC服务
-	userStore := service.NewInMemoryUserStore()
-	err := seedUsers(userStore)
+	userStore := stores.userStore
+	err = seedUsers(userStore)
 	if err != nil {
 		log.Fatal("cannot seed users: ", err)
 	}
@@ -64,11 +203,49 @@ func main() {
 	//创建一个新的身份验证服务器
 	authServer := service.NewAuthServer(userStore, jwtManager)
 
-	laptopStore := service.NewInMemoryLaptopStore()
-	imageStore := service.NewDiskImageStore("./img/") //在img文件夹中保存上传的图像
-	//使用内存存储创建一个新的laptop服务器对象
-	ratingStore := service.NewInMemoryRatingStore()
-	LaptopServer := service.NewLaptopServer(laptopStore, imageStore, ratingStore)
+	s3Config := service.S3Config{
+		Endpoint: *s3Endpoint,
+		Region:   *s3Region,
+		Bucket:   *s3Bucket,
+		Prefix:   *s3Prefix,
+	}
+	imageStore, err := newImageStore(*imageStoreType, "./img/", s3Config) //在img文件夹中保存上传的图像
+	if err != nil {
+		log.Fatal("cannot create image store: ", err)
+	}
+	if *reconcileImages {
+		diskImageStore, ok := imageStore.(*service.DiskImageStore)
+		if !ok {
+			log.Fatal("-reconcile-images only works with the disk image store")
+		}
+		if err := reportImages(diskImageStore); err != nil {
+			log.Fatal("cannot reconcile images: ", err)
+		}
+		return
+	}
+	//使用选择的store创建一个新的laptop服务器对象
+	LaptopServer := service.NewLaptopServer(stores.laptopStore, imageStore, stores.ratingStore)
+	renditionSpecs, err := service.ParseRenditions(*renditions)
+	if err != nil {
+		log.Fatal("cannot parse renditions: ", err)
+	}
+	LaptopServer.SetRenditions(renditionSpecs)
+	LaptopServer.SetUploadFolder(*uploadDir)
+	LaptopServer.SetUploadLimits(service.UploadLimits{
+		MaxImageSize:       *maxImageSize,
+		MaxImagesPerLaptop: *maxImagesPerLaptop,
+		UserQuota:          *userQuota,
+	})
+	LaptopServer.SetImageGCOptions(service.ImageGCOptions{
+		Interval:     *gcInterval,
+		GracePeriod:  *gcGracePeriod,
+		OrphanImages: *gcOrphanImages,
+	})
+	gcContext, stopGC := context.WithCancel(context.Background())
+	defer stopGC()
+	if *gcInterval > 0 {
+		go LaptopServer.RunImageGC(gcContext)
+	}
 
 	interceptor := service.NewAuthInterceptor(jwtManager, accessibleRoles())
 	//创建一个新的gRPC服务器
@@ -87,12 +264,27 @@ func main() {
 	//监听此tcp上的连接
 	listen, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Fatal("can not start server:%v", err)
+		log.Fatalf("can not start server:%v", err)
 	}
 
+	//收到退出信号时停止服务，让store有机会把数据写到磁盘
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Print("stop server")
+		grpcServer.Stop()
+	}()
+
 	//调用grpcServer.Server()来启动服务
 	err = grpcServer.Serve(listen)
 	if err != nil {
-		log.Fatal("can not start server:%v", err)
+		log.Fatalf("can not start server:%v", err)
+	}
+
+	for _, closer := range stores.closers {
+		if err := closer.Close(); err != nil {
+			log.Fatalf("cannot close store:%v", err)
+		}
 	}
 }
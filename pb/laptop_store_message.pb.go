@@ -0,0 +1,264 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.26.0
+// 	protoc        v3.21.12
+// source: laptop_store_message.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// 预写日志中的一条记录，保存修改之后的结果，重复回放同一条记录不会改变结果
+type LaptopRecord struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Record:
+	//	*LaptopRecord_Put
+	//	*LaptopRecord_DeleteId
+	Record isLaptopRecord_Record `protobuf_oneof:"record"`
+}
+
+func (x *LaptopRecord) Reset() {
+	*x = LaptopRecord{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_laptop_store_message_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *LaptopRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LaptopRecord) ProtoMessage() {}
+
+func (x *LaptopRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_laptop_store_message_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LaptopRecord.ProtoReflect.Descriptor instead.
+func (*LaptopRecord) Descriptor() ([]byte, []int) {
+	return file_laptop_store_message_proto_rawDescGZIP(), []int{0}
+}
+
+func (m *LaptopRecord) GetRecord() isLaptopRecord_Record {
+	if m != nil {
+		return m.Record
+	}
+	return nil
+}
+
+func (x *LaptopRecord) GetPut() *Laptop {
+	if x, ok := x.GetRecord().(*LaptopRecord_Put); ok {
+		return x.Put
+	}
+	return nil
+}
+
+func (x *LaptopRecord) GetDeleteId() string {
+	if x, ok := x.GetRecord().(*LaptopRecord_DeleteId); ok {
+		return x.DeleteId
+	}
+	return ""
+}
+
+type isLaptopRecord_Record interface {
+	isLaptopRecord_Record()
+}
+
+type LaptopRecord_Put struct {
+	Put *Laptop `protobuf:"bytes,1,opt,name=put,proto3,oneof"` //保存或更新之后的电脑
+}
+
+type LaptopRecord_DeleteId struct {
+	DeleteId string `protobuf:"bytes,2,opt,name=delete_id,json=deleteId,proto3,oneof"` //被删除的电脑id
+}
+
+func (*LaptopRecord_Put) isLaptopRecord_Record() {}
+
+func (*LaptopRecord_DeleteId) isLaptopRecord_Record() {}
+
+// 某一时刻store中所有电脑的快照
+type LaptopSnapshot struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	//快照包含了编号小于generation的所有日志文件中的修改
+	Generation uint64    `protobuf:"varint,1,opt,name=generation,proto3" json:"generation,omitempty"`
+	Laptops    []*Laptop `protobuf:"bytes,2,rep,name=laptops,proto3" json:"laptops,omitempty"`
+}
+
+func (x *LaptopSnapshot) Reset() {
+	*x = LaptopSnapshot{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_laptop_store_message_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *LaptopSnapshot) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LaptopSnapshot) ProtoMessage() {}
+
+func (x *LaptopSnapshot) ProtoReflect() protoreflect.Message {
+	mi := &file_laptop_store_message_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LaptopSnapshot.ProtoReflect.Descriptor instead.
+func (*LaptopSnapshot) Descriptor() ([]byte, []int) {
+	return file_laptop_store_message_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *LaptopSnapshot) GetGeneration() uint64 {
+	if x != nil {
+		return x.Generation
+	}
+	return 0
+}
+
+func (x *LaptopSnapshot) GetLaptops() []*Laptop {
+	if x != nil {
+		return x.Laptops
+	}
+	return nil
+}
+
+var File_laptop_store_message_proto protoreflect.FileDescriptor
+
+var file_laptop_store_message_proto_rawDesc = []byte{
+	0x0a, 0x1a, 0x6c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x5f, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x5f, 0x6d,
+	0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x02, 0x70, 0x62,
+	0x1a, 0x14, 0x6c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x57, 0x0a, 0x0c, 0x4c, 0x61, 0x70, 0x74, 0x6f, 0x70,
+	0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x12, 0x1e, 0x0a, 0x03, 0x70, 0x75, 0x74, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x0a, 0x2e, 0x70, 0x62, 0x2e, 0x4c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x48,
+	0x00, 0x52, 0x03, 0x70, 0x75, 0x74, 0x12, 0x1d, 0x0a, 0x09, 0x64, 0x65, 0x6c, 0x65, 0x74, 0x65,
+	0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x48, 0x00, 0x52, 0x08, 0x64, 0x65, 0x6c,
+	0x65, 0x74, 0x65, 0x49, 0x64, 0x42, 0x08, 0x0a, 0x06, 0x72, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x22,
+	0x56, 0x0a, 0x0e, 0x4c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x53, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f,
+	0x74, 0x12, 0x1e, 0x0a, 0x0a, 0x67, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0a, 0x67, 0x65, 0x6e, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x12, 0x24, 0x0a, 0x07, 0x6c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x73, 0x18, 0x02, 0x20, 0x03,
+	0x28, 0x0b, 0x32, 0x0a, 0x2e, 0x70, 0x62, 0x2e, 0x4c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x52, 0x07,
+	0x6c, 0x61, 0x70, 0x74, 0x6f, 0x70, 0x73, 0x42, 0x05, 0x5a, 0x03, 0x2f, 0x70, 0x62, 0x62, 0x06,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_laptop_store_message_proto_rawDescOnce sync.Once
+	file_laptop_store_message_proto_rawDescData = file_laptop_store_message_proto_rawDesc
+)
+
+func file_laptop_store_message_proto_rawDescGZIP() []byte {
+	file_laptop_store_message_proto_rawDescOnce.Do(func() {
+		file_laptop_store_message_proto_rawDescData = protoimpl.X.CompressGZIP(file_laptop_store_message_proto_rawDescData)
+	})
+	return file_laptop_store_message_proto_rawDescData
+}
+
+var file_laptop_store_message_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_laptop_store_message_proto_goTypes = []interface{}{
+	(*LaptopRecord)(nil),   // 0: pb.LaptopRecord
+	(*LaptopSnapshot)(nil), // 1: pb.LaptopSnapshot
+	(*Laptop)(nil),         // 2: pb.Laptop
+}
+var file_laptop_store_message_proto_depIdxs = []int32{
+	2, // 0: pb.LaptopRecord.put:type_name -> pb.Laptop
+	2, // 1: pb.LaptopSnapshot.laptops:type_name -> pb.Laptop
+	2, // [2:2] is the sub-list for method output_type
+	2, // [2:2] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_laptop_store_message_proto_init() }
+func file_laptop_store_message_proto_init() {
+	if File_laptop_store_message_proto != nil {
+		return
+	}
+	file_laptop_message_proto_init()
+	if !protoimpl.UnsafeEnabled {
+		file_laptop_store_message_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*LaptopRecord); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_laptop_store_message_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*LaptopSnapshot); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_laptop_store_message_proto_msgTypes[0].OneofWrappers = []interface{}{
+		(*LaptopRecord_Put)(nil),
+		(*LaptopRecord_DeleteId)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_laptop_store_message_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_laptop_store_message_proto_goTypes,
+		DependencyIndexes: file_laptop_store_message_proto_depIdxs,
+		MessageInfos:      file_laptop_store_message_proto_msgTypes,
+	}.Build()
+	File_laptop_store_message_proto = out.File
+	file_laptop_store_message_proto_rawDesc = nil
+	file_laptop_store_message_proto_goTypes = nil
+	file_laptop_store_message_proto_depIdxs = nil
+}
@@ -0,0 +1,274 @@
+//查询语言中可以使用的字段
+package query
+
+import (
+	"fmt"
+	"grpctest/pb"
+	"grpctest/units"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type valueKind int
+
+const (
+	textValue   valueKind = iota //字符串，不区分大小写
+	enumValue                    //枚举，值必须是allowed中的一个
+	boolValue                    //true/false
+	numberValue                  //普通数字
+	memoryValue                  //带单位的容量，例如16GB，没有单位时按GB处理
+	weightValue                  //带单位的重量，例如1.5kg、4lb，没有单位时按kg处理
+)
+
+//field描述了一个查询字段如何从电脑中取值
+//一台电脑可能有多个值（例如多块GPU），只要其中一个满足条件即可
+type field struct {
+	kind    valueKind
+	allowed []string
+	text    func(laptop *pb.Laptop) []string
+	number  func(laptop *pb.Laptop) []float64
+}
+
+var fields = map[string]*field{
+	"brand":           textField(func(l *pb.Laptop) []string { return []string{l.GetBrand()} }),
+	"name":            textField(func(l *pb.Laptop) []string { return []string{l.GetName()} }),
+	"price":           numberField(numberValue, func(l *pb.Laptop) []float64 { return []float64{l.GetPriceUsd()} }),
+	"year":            numberField(numberValue, func(l *pb.Laptop) []float64 { return []float64{float64(l.GetReleaseYear())} }),
+	"cpu.brand":       textField(func(l *pb.Laptop) []string { return []string{l.GetCpu().GetBrand()} }),
+	"cpu.name":        textField(func(l *pb.Laptop) []string { return []string{l.GetCpu().GetName()} }),
+	"cpu.cores":       numberField(numberValue, func(l *pb.Laptop) []float64 { return []float64{float64(l.GetCpu().GetNumberCores())} }),
+	"cpu.threads":     numberField(numberValue, func(l *pb.Laptop) []float64 { return []float64{float64(l.GetCpu().GetNumberThread())} }),
+	"cpu.ghz":         numberField(numberValue, func(l *pb.Laptop) []float64 { return []float64{l.GetCpu().GetMinGhz()} }),
+	"cpu.max_ghz":     numberField(numberValue, func(l *pb.Laptop) []float64 { return []float64{l.GetCpu().GetMaxGhz()} }),
+	"ram":             numberField(memoryValue, func(l *pb.Laptop) []float64 { return []float64{float64(units.MemoryBits(l.GetRam()))} }),
+	"gpu.brand":       textField(gpuBrands),
+	"gpu.memory":      numberField(memoryValue, gpuMemories),
+	"storage":         numberField(memoryValue, storageTotal(pb.Storage_UNKNOWN)),
+	"storage.ssd":     numberField(memoryValue, storageTotal(pb.Storage_SSD)),
+	"storage.hdd":     numberField(memoryValue, storageTotal(pb.Storage_HDD)),
+	"screen.size":     numberField(numberValue, func(l *pb.Laptop) []float64 { return []float64{float64(l.GetScreen().GetSizeInch())} }),
+	"screen.width":    numberField(numberValue, func(l *pb.Laptop) []float64 { return []float64{float64(l.GetScreen().GetResolution().GetWidth())} }),
+	"screen.height":   numberField(numberValue, func(l *pb.Laptop) []float64 { return []float64{float64(l.GetScreen().GetResolution().GetHeight())} }),
+	"panel":           enumField(pb.Screen_Panel_value, func(l *pb.Laptop) []string { return []string{l.GetScreen().GetPanel().String()} }),
+	"multitouch":      boolField(func(l *pb.Laptop) bool { return l.GetScreen().GetMultitouch() }),
+	"keyboard.layout": enumField(pb.Keyboard_Layout_value, func(l *pb.Laptop) []string { return []string{l.GetKeyboard().GetLayout().String()} }),
+	"backlit":         boolField(func(l *pb.Laptop) bool { return l.GetKeyboard().GetBacklit() }),
+	"weight":          numberField(weightValue, laptopWeights),
+}
+
+func textField(text func(laptop *pb.Laptop) []string) *field {
+	return &field{kind: textValue, text: text}
+}
+
+func enumField(values map[string]int32, text func(laptop *pb.Laptop) []string) *field {
+	allowed := make([]string, 0, len(values))
+	for name := range values {
+		if name != "UNKNOWN" {
+			allowed = append(allowed, name)
+		}
+	}
+	sort.Strings(allowed)
+	return &field{kind: enumValue, allowed: allowed, text: text}
+}
+
+func boolField(value func(laptop *pb.Laptop) bool) *field {
+	return &field{kind: boolValue, text: func(l *pb.Laptop) []string { return []string{strconv.FormatBool(value(l))} }}
+}
+
+func numberField(kind valueKind, number func(laptop *pb.Laptop) []float64) *field {
+	return &field{kind: kind, number: number}
+}
+
+//字符串类型的字段只支持相等和不相等
+func (f *field) supports(op string) bool {
+	if f.number != nil {
+		return true
+	}
+	return op == ":" || op == "!="
+}
+
+//把一个条件编译成语法树的节点
+func (f *field) compile(op string, raw string) (node, error) {
+	if f.number == nil {
+		value, err := f.parseText(raw)
+		if err != nil {
+			return nil, err
+		}
+		n := &textCondition{values: f.text, value: value}
+		if op == "!=" {
+			return &notNode{n}, nil
+		}
+		return n, nil
+	}
+
+	value, err := parseNumber(f.kind, raw)
+	if err != nil {
+		return nil, err
+	}
+	n := &numberCondition{values: f.number, op: op, value: value}
+	if op == "!=" {
+		n.op = ":"
+		return &notNode{n}, nil
+	}
+	return n, nil
+}
+
+func (f *field) parseText(raw string) (string, error) {
+	switch f.kind {
+	case enumValue:
+		for _, name := range f.allowed {
+			if strings.EqualFold(name, raw) {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("invalid value %q, expected one of %s", raw, strings.Join(f.allowed, ", "))
+	case boolValue:
+		switch strings.ToLower(raw) {
+		case "true", "yes":
+			return "true", nil
+		case "false", "no":
+			return "false", nil
+		}
+		return "", fmt.Errorf("invalid value %q, expected true or false", raw)
+	default:
+		return raw, nil
+	}
+}
+
+type textCondition struct {
+	values func(laptop *pb.Laptop) []string
+	value  string
+}
+
+func (n *textCondition) eval(laptop *pb.Laptop) bool {
+	for _, v := range n.values(laptop) {
+		if strings.EqualFold(v, n.value) {
+			return true
+		}
+	}
+	return false
+}
+
+type numberCondition struct {
+	values func(laptop *pb.Laptop) []float64
+	op     string
+	value  float64
+}
+
+func (n *numberCondition) eval(laptop *pb.Laptop) bool {
+	for _, v := range n.values(laptop) {
+		if compare(v, n.op, n.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func compare(a float64, op string, b float64) bool {
+	switch op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	default:
+		return a == b
+	}
+}
+
+//容量单位和对应的位数
+var memoryUnits = map[string]float64{
+	"bit": float64(units.UnitBits(pb.Memory_BIT)),
+	"b":   float64(units.UnitBits(pb.Memory_BYTE)),
+	"kb":  float64(units.UnitBits(pb.Memory_KYLOBYTE)),
+	"mb":  float64(units.UnitBits(pb.Memory_MEGABYTE)),
+	"gb":  float64(units.UnitBits(pb.Memory_GIGABYTE)),
+	"tb":  float64(units.UnitBits(pb.Memory_TERABYTE)),
+}
+
+//重量单位和对应的千克数
+var weightUnits = map[string]float64{
+	"kg":  1,
+	"lb":  units.KgPerLb,
+	"lbs": units.KgPerLb,
+}
+
+//解析数字和它后面的单位，容量统一换算成位，重量统一换算成千克
+func parseNumber(kind valueKind, raw string) (float64, error) {
+	end := 0
+	for end < len(raw) && (raw[end] >= '0' && raw[end] <= '9' || raw[end] == '.') {
+		end++
+	}
+	value, err := strconv.ParseFloat(raw[:end], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", raw)
+	}
+	unit := strings.ToLower(raw[end:])
+
+	switch kind {
+	case memoryValue:
+		if unit == "" {
+			unit = "gb"
+		}
+		factor, ok := memoryUnits[unit]
+		if !ok {
+			return 0, fmt.Errorf("unknown memory unit %q in %q", raw[end:], raw)
+		}
+		return value * factor, nil
+	case weightValue:
+		if unit == "" {
+			unit = "kg"
+		}
+		factor, ok := weightUnits[unit]
+		if !ok {
+			return 0, fmt.Errorf("unknown weight unit %q in %q", raw[end:], raw)
+		}
+		return value * factor, nil
+	default:
+		if unit != "" {
+			return 0, fmt.Errorf("invalid number %q", raw)
+		}
+		return value, nil
+	}
+}
+
+func gpuBrands(laptop *pb.Laptop) []string {
+	brands := make([]string, 0, len(laptop.GetGpus()))
+	for _, gpu := range laptop.GetGpus() {
+		brands = append(brands, gpu.GetBrand())
+	}
+	return brands
+}
+
+func gpuMemories(laptop *pb.Laptop) []float64 {
+	memories := make([]float64, 0, len(laptop.GetGpus()))
+	for _, gpu := range laptop.GetGpus() {
+		memories = append(memories, float64(units.MemoryBits(gpu.GetMemory())))
+	}
+	return memories
+}
+
+//统计某种类型磁盘的总容量，driver为UNKNOWN时统计所有磁盘
+func storageTotal(driver pb.Storage_Driver) func(laptop *pb.Laptop) []float64 {
+	return func(laptop *pb.Laptop) []float64 {
+		var total float64
+		for _, storage := range laptop.GetStorages() {
+			if driver == pb.Storage_UNKNOWN || storage.GetDriver() == driver {
+				total += float64(units.MemoryBits(storage.GetMemory()))
+			}
+		}
+		return []float64{total}
+	}
+}
+
+//电脑没有重量时不返回任何值，这样任何重量条件都不满足
+func laptopWeights(laptop *pb.Laptop) []float64 {
+	if weight, ok := units.LaptopWeightKg(laptop); ok {
+		return []float64{weight}
+	}
+	return nil
+}
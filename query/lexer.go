@@ -0,0 +1,111 @@
+//把查询语句切分成一个个的token
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF    tokenKind = iota
+	tokenWord             //字段名、值或者关键字，例如brand、16GB、OR
+	tokenString           //带引号的值，例如"Macbook Pro"
+	tokenOp               //比较运算符 : = != < <= > >=
+	tokenLParen           //(
+	tokenRParen           //)
+	tokenNot              //-，放在条件前面表示取反
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	pos   int //token在查询语句中的位置，从1开始
+	input string
+}
+
+func (tok token) String() string {
+	switch tok.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenString:
+		return fmt.Sprintf("%q", tok.text)
+	default:
+		return fmt.Sprintf("%q", tok.input)
+	}
+}
+
+//把整条查询语句切分成token，最后一个token总是tokenEOF
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(':
+			i++
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: start + 1, input: "("})
+		case r == ')':
+			i++
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: start + 1, input: ")"})
+		case r == '-':
+			i++
+			tokens = append(tokens, token{kind: tokenNot, text: "-", pos: start + 1, input: "-"})
+		case strings.ContainsRune(":=!<>", r):
+			i++
+			//两个字符的运算符
+			if i < len(runes) && runes[i] == '=' && r != ':' && r != '=' {
+				i++
+			}
+			op := string(runes[start:i])
+			if op == "!" {
+				return nil, &Error{Pos: start + 1, Msg: "expected '=' after '!'"}
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: start + 1, input: op})
+		case r == '"':
+			i++
+			var text strings.Builder
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) { //支持\"和\\转义
+					text.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				text.WriteRune(runes[i])
+				i++
+			}
+			if !closed {
+				return nil, &Error{Pos: start + 1, Msg: "unterminated quoted string"}
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text.String(), pos: start + 1, input: string(runes[start:i])})
+		case isWordRune(r):
+			for i < len(runes) && (isWordRune(runes[i]) || runes[i] == '-') {
+				i++
+			}
+			word := string(runes[start:i])
+			tokens = append(tokens, token{kind: tokenWord, text: word, pos: start + 1, input: word})
+		default:
+			return nil, &Error{Pos: start + 1, Msg: fmt.Sprintf("unexpected character %q", r)}
+		}
+	}
+
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(runes) + 1})
+	return tokens, nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_'
+}
@@ -0,0 +1,217 @@
+//Package query 实现了一个用于检索电脑的简单查询语言，例如：
+//
+//	brand:Apple price<2000 ram>=16GB cpu.cores>=8 (panel:OLED OR panel:IPS)
+//
+//多个条件之间默认是AND的关系，可以使用OR、NOT（或者-）和括号组合条件
+package query
+
+import (
+	"fmt"
+	"grpctest/pb"
+	"strings"
+)
+
+// Limits on the size of a query, so that a client cannot exhaust the server's stack or CPU
+const (
+	MaxQueryLength = 4096 //查询的最大字节数
+	MaxQueryDepth  = 32   //括号和NOT最多嵌套的层数
+)
+
+// Predicate reports whether a laptop matches a compiled query
+type Predicate func(laptop *pb.Laptop) bool
+
+// Error is a syntax or semantic error in a query, Pos is the 1-based position in the query
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("position %d: %s", err.Pos, err.Msg)
+}
+
+//语法树中的一个节点
+type node interface {
+	eval(laptop *pb.Laptop) bool
+}
+
+type andNode struct{ left, right node }
+type orNode struct{ left, right node }
+type notNode struct{ operand node }
+
+func (n *andNode) eval(laptop *pb.Laptop) bool { return n.left.eval(laptop) && n.right.eval(laptop) }
+func (n *orNode) eval(laptop *pb.Laptop) bool  { return n.left.eval(laptop) || n.right.eval(laptop) }
+func (n *notNode) eval(laptop *pb.Laptop) bool { return !n.operand.eval(laptop) }
+
+// Parse compiles a query into a predicate, an empty query matches every laptop
+func Parse(input string) (Predicate, error) {
+	//先检查长度再分词，过长的查询不会占用内存和CPU
+	if len(input) > MaxQueryLength {
+		return nil, &Error{Pos: MaxQueryLength + 1, Msg: fmt.Sprintf("query is longer than %d bytes", MaxQueryLength)}
+	}
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	if p.peek().kind == tokenEOF {
+		return func(laptop *pb.Laptop) bool { return true }, nil
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, &Error{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %v", tok)}
+	}
+	return root.eval, nil
+}
+
+//递归下降解析器，优先级从低到高为：OR、AND、NOT
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int //当前嵌套的层数，每一层递归都会用掉一些栈
+}
+
+//进入一层括号或者NOT，超过MaxQueryDepth时返回错误，tok是引起嵌套的token
+func (p *parser) enter(tok token) error {
+	if p.depth >= MaxQueryDepth {
+		return &Error{Pos: tok.pos, Msg: fmt.Sprintf("query is nested more than %d levels deep", MaxQueryDepth)}
+	}
+	p.depth++
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func isKeyword(tok token, keyword string) bool {
+	return tok.kind == tokenWord && tok.text == keyword
+}
+
+//or := and ("OR" and)*
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for isKeyword(p.peek(), "OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+//and := not (["AND"] not)*，两个条件之间什么都不写也表示AND
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if isKeyword(tok, "AND") {
+			p.next()
+		} else if tok.kind == tokenEOF || tok.kind == tokenRParen || isKeyword(tok, "OR") {
+			return left, nil
+		}
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+}
+
+//not := ("NOT" | "-") not | primary
+func (p *parser) parseNot() (node, error) {
+	tok := p.peek()
+	if tok.kind == tokenNot || isKeyword(tok, "NOT") {
+		p.next()
+		if err := p.enter(tok); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+//primary := "(" or ")" | field op value
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenLParen:
+		if err := p.enter(tok); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, &Error{Pos: closing.pos, Msg: fmt.Sprintf("expected ')' to close '(' at position %d, got %v", tok.pos, closing)}
+		}
+		return inner, nil
+	case tokenWord:
+		return p.parseCondition(tok)
+	default:
+		return nil, &Error{Pos: tok.pos, Msg: fmt.Sprintf("expected a condition, got %v", tok)}
+	}
+}
+
+func (p *parser) parseCondition(fieldToken token) (node, error) {
+	f, ok := fields[strings.ToLower(fieldToken.text)]
+	if !ok {
+		return nil, &Error{Pos: fieldToken.pos, Msg: fmt.Sprintf("unknown field %q", fieldToken.text)}
+	}
+
+	opToken := p.next()
+	if opToken.kind != tokenOp {
+		return nil, &Error{Pos: opToken.pos, Msg: fmt.Sprintf("expected an operator after %q, got %v", fieldToken.text, opToken)}
+	}
+	op := opToken.text
+	if op == "=" {
+		op = ":"
+	}
+	if !f.supports(op) {
+		return nil, &Error{Pos: opToken.pos, Msg: fmt.Sprintf("operator %q is not supported by field %q", opToken.text, fieldToken.text)}
+	}
+
+	valueToken := p.next()
+	if valueToken.kind != tokenWord && valueToken.kind != tokenString {
+		return nil, &Error{Pos: valueToken.pos, Msg: fmt.Sprintf("expected a value after %q, got %v", fieldToken.text+opToken.text, valueToken)}
+	}
+
+	n, err := f.compile(op, valueToken.text)
+	if err != nil {
+		return nil, &Error{Pos: valueToken.pos, Msg: fmt.Sprintf("%s: %v", fieldToken.text, err)}
+	}
+	return n, nil
+}
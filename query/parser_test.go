@@ -0,0 +1,127 @@
+package query_test
+
+import (
+	"errors"
+	"grpctest/pb"
+	"grpctest/query"
+	"grpctest/sample"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newQueryTestLaptop() *pb.Laptop {
+	laptop := sample.NewLaptop()
+	laptop.Brand = "Apple"
+	laptop.Name = "Macbook Pro"
+	laptop.PriceUsd = 1999
+	laptop.Cpu.NumberCores = 8
+	laptop.Cpu.MinGhz = 2.5
+	laptop.Ram = &pb.Memory{Value: 16384, Uint: pb.Memory_MEGABYTE}
+	laptop.Gpus = []*pb.GPU{
+		{Brand: "Nvidia", Memory: &pb.Memory{Value: 6, Uint: pb.Memory_GIGABYTE}},
+		{Brand: "AMD", Memory: &pb.Memory{Value: 2, Uint: pb.Memory_GIGABYTE}},
+	}
+	laptop.Storages = []*pb.Storage{{Driver: pb.Storage_SSD, Memory: &pb.Memory{Value: 1, Uint: pb.Memory_TERABYTE}}}
+	laptop.Screen = &pb.Screen{SizeInch: 16, Panel: pb.Screen_OLED, Resolution: &pb.Screen_Resolution{Width: 3456, Height: 2234}}
+	laptop.Keyboard = &pb.Keyboard{Layout: pb.Keyboard_QWERTY, Backlit: true}
+	laptop.Weight = &pb.Laptop_WeightKg{WeightKg: 2.1}
+	laptop.ReleaseYear = 2019
+	return laptop
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	laptop := newQueryTestLaptop()
+
+	testCases := []struct {
+		query   string
+		matched bool
+	}{
+		{"", true},
+		{"brand:Apple price<2000 ram>=16GB cpu.cores>=8 (panel:OLED OR panel:IPS)", true},
+		{"brand:apple AND name:\"Macbook Pro\"", true},
+		{"brand:Dell OR brand:Lenovo", false},
+		{"-brand:Dell", true},
+		{"NOT brand:Apple", false},
+		{"brand!=Apple", false},
+		{"price>=1999 price<=1999", true},
+		{"price=2000", false},
+		{"ram>16GB", false},
+		{"ram>=16384MB", true},
+		{"ram:16", true},
+		{"cpu.ghz>2.4 cpu.cores<10", true},
+		{"gpu.brand:AMD gpu.memory>=6GB", true}, //不同的GPU分别满足条件
+		{"gpu.brand!=AMD", false},
+		{"storage.ssd>=1TB storage.hdd>0", false},
+		{"storage>=1024GB", true},
+		{"screen.size>=15.6 screen.width>=3000", true},
+		{"panel:ips", false},
+		{"keyboard.layout:qwerty backlit:true multitouch:false", true},
+		{"weight<=5lb", true},
+		{"weight<2kg", false},
+		{"year>=2018 (brand:Dell OR (cpu.cores>=8 AND -panel:IPS))", true},
+		{strings.Repeat("(", query.MaxQueryDepth) + "cpu.cores>1" + strings.Repeat(")", query.MaxQueryDepth), true},
+		{strings.Repeat("NOT ", query.MaxQueryDepth) + "brand:Apple", true},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.query, func(t *testing.T) {
+			t.Parallel()
+
+			predicate, err := query.Parse(tc.query)
+			require.NoError(t, err)
+			require.Equal(t, tc.matched, predicate(laptop))
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		query string
+		pos   int
+	}{
+		{"color:red", 1},
+		{"brand Apple", 7},
+		{"brand:", 7},
+		{"price<cheap", 7},
+		{"brand<Apple", 6},
+		{"ram>=16XB", 6},
+		{"panel:TN", 7},
+		{"(brand:Apple OR brand:Dell", 27},
+		{"brand:Apple)", 12},
+		{"name:\"Macbook", 6},
+		{"price>1000 & ram>8", 12},
+		{"brand:Apple OR", 15},
+		//嵌套太深或者太长的查询在解析之前就被拒绝，不会耗尽栈
+		{strings.Repeat("(", query.MaxQueryDepth+1) + "cpu.cores>1" + strings.Repeat(")", query.MaxQueryDepth+1), query.MaxQueryDepth + 1},
+		{"brand:Apple " + strings.Repeat("-", query.MaxQueryDepth+1) + "brand:Dell", 13 + query.MaxQueryDepth},
+		{strings.Repeat("(", 2000000) + "cpu.cores>1" + strings.Repeat(")", 2000000), query.MaxQueryLength + 1},
+		{strings.Repeat("brand:Apple ", 1000), query.MaxQueryLength + 1},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		name := tc.query
+		if len(name) > 100 {
+			name = name[:100]
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := query.Parse(tc.query)
+			require.Error(t, err)
+
+			var queryErr *query.Error
+			require.True(t, errors.As(err, &queryErr))
+			require.Equal(t, tc.pos, queryErr.Pos, err.Error())
+		})
+	}
+}
@@ -0,0 +1,176 @@
+//store中电脑变化的事件流，用于WatchLaptops
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"grpctest/pb"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	changeFeedHistorySize = 1024 //保留最近的事件数量，断线重连时可以从这些事件中续传
+	subscriberBufferSize  = 256  //每个订阅者最多缓存的事件数量
+)
+
+// ErrEventsExpired is returned when the events after the resume sequence are no longer kept
+var ErrEventsExpired = errors.New("events after the resume sequence are no longer available")
+
+// ErrSubscriberTooSlow is returned when a watcher falls too far behind the change feed
+var ErrSubscriberTooSlow = errors.New("subscriber is too slow to keep up with changes")
+
+//changeFeed保存最近的事件，并把新的事件发给所有订阅者
+//发布事件时不会等待订阅者，缓冲区满了的订阅者会被断开，之后可以用最后收到的序号续传
+type changeFeed struct {
+	mutex       sync.Mutex
+	sequence    uint64       //最后一个事件的序号
+	history     []*feedEvent //最近的事件，按序号排列
+	subscribers map[*feedSubscriber]bool
+}
+
+//除了发给订阅者的事件，还保存修改之前的电脑，用来判断电脑是否离开了订阅的过滤条件
+type feedEvent struct {
+	event    *pb.LaptopEvent
+	previous *pb.Laptop //只有UPDATED事件有
+}
+
+type feedSubscriber struct {
+	events  chan *feedEvent
+	dropped chan struct{} //订阅者跟不上时被关闭
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{
+		subscribers: make(map[*feedSubscriber]bool),
+	}
+}
+
+//发布一个事件，调用方需要保证按照修改的顺序调用，previous是UPDATED事件中修改之前的电脑
+func (feed *changeFeed) publish(eventType pb.LaptopEvent_Type, laptop *pb.Laptop, previous *pb.Laptop) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	feed.sequence++
+	event := &feedEvent{
+		event: &pb.LaptopEvent{
+			Sequence: feed.sequence,
+			Type:     eventType,
+			Laptop:   proto.Clone(laptop).(*pb.Laptop),
+			Time:     timestamppb.Now(),
+		},
+	}
+	if previous != nil {
+		event.previous = proto.Clone(previous).(*pb.Laptop)
+	}
+
+	feed.history = append(feed.history, event)
+	if len(feed.history) > changeFeedHistorySize {
+		feed.history = feed.history[len(feed.history)-changeFeedHistorySize:]
+	}
+
+	for subscriber := range feed.subscribers {
+		select {
+		case subscriber.events <- event:
+		default:
+			//不能因为一个慢的订阅者阻塞store的写入
+			close(subscriber.dropped)
+			delete(feed.subscribers, subscriber)
+		}
+	}
+}
+
+//订阅之后的事件，resumeAfter不为nil时还会返回序号大于它的历史事件
+//历史事件和之后的事件之间不会有遗漏
+func (feed *changeFeed) subscribe(resumeAfter *uint64) (*feedSubscriber, []*feedEvent, error) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	var backlog []*feedEvent
+	if resumeAfter != nil && *resumeAfter > feed.sequence {
+		//序号比最后一个事件还大，可能是store重启后序号重新开始了
+		return nil, nil, fmt.Errorf("%w: unknown sequence %d, latest is %d", ErrEventsExpired, *resumeAfter, feed.sequence)
+	}
+	if resumeAfter != nil && *resumeAfter < feed.sequence {
+		oldest := feed.sequence - uint64(len(feed.history)) + 1
+		if *resumeAfter+1 < oldest {
+			return nil, nil, fmt.Errorf("%w: resume after %d, oldest available %d", ErrEventsExpired, *resumeAfter, oldest)
+		}
+		backlog = append(backlog, feed.history[*resumeAfter+1-oldest:]...)
+	}
+
+	subscriber := &feedSubscriber{
+		events:  make(chan *feedEvent, subscriberBufferSize),
+		dropped: make(chan struct{}),
+	}
+	feed.subscribers[subscriber] = true
+	return subscriber, backlog, nil
+}
+
+func (feed *changeFeed) unsubscribe(subscriber *feedSubscriber) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	delete(feed.subscribers, subscriber)
+}
+
+//把事件发给订阅者，直到ctx结束或者订阅者被断开，filter和isQualified的规则相同
+//电脑修改之前符合filter、修改之后不符合时发送LEFT_FILTER事件，订阅者维护的结果不会留下过时的电脑
+func (feed *changeFeed) watch(
+	ctx context.Context,
+	filter *pb.Filter,
+	resumeAfter *uint64,
+	found func(event *pb.LaptopEvent) error,
+) error {
+	subscriber, backlog, err := feed.subscribe(resumeAfter)
+	if err != nil {
+		return err
+	}
+	defer feed.unsubscribe(subscriber)
+
+	send := func(e *feedEvent) error {
+		//事件会发给多个订阅者，复制之后再交给调用方
+		switch {
+		case isQualified(filter, e.event.GetLaptop()):
+			return found(proto.Clone(e.event).(*pb.LaptopEvent))
+		case e.previous != nil && isQualified(filter, e.previous):
+			event := proto.Clone(e.event).(*pb.LaptopEvent)
+			event.Type = pb.LaptopEvent_LEFT_FILTER
+			return found(event)
+		default:
+			return nil
+		}
+	}
+
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event := <-subscriber.events:
+			if err := send(event); err != nil {
+				return err
+			}
+		case <-subscriber.dropped:
+			//先把已经缓存的事件发完，客户端可以从最后一个事件的序号续传
+			for {
+				select {
+				case event := <-subscriber.events:
+					if err := send(event); err != nil {
+						return err
+					}
+				default:
+					return ErrSubscriberTooSlow
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,392 @@
+//按内容寻址的图像存储，相同内容的图像只保存一份
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	blobFolderName    = "blobs" //保存图像内容的子文件夹
+	blobTmpFolderName = "tmp"   //写入中的图像内容，计算出SHA-256之后再移动到blobs
+)
+
+//ContentAddressedImageStore把图像内容按SHA-256保存为blob，图像id只是指向blob的引用
+//多张图像内容相同时共用一个blob，最后一个引用被删除时才删除blob
+//引用计数不单独保存，加载manifest时根据图像信息重新计算
+type ContentAddressedImageStore struct {
+	mutex       sync.RWMutex
+	imageFolder string
+	images      map[string]*ImageInfo //key是图像id
+	refs        map[string]int        //key是blob的SHA-256，value是引用它的原图和缩略图的数量
+	manifest    *imageManifestLog
+}
+
+// NewContentAddressedImageStore returns a deduplicating store that saves blobs in imageFolder
+func NewContentAddressedImageStore(imageFolder string) (*ContentAddressedImageStore, error) {
+	for _, folder := range []string{blobFolderName, blobTmpFolderName} {
+		if err := os.MkdirAll(filepath.Join(imageFolder, folder), 0755); err != nil {
+			return nil, fmt.Errorf("cannot create image folder: %w", err)
+		}
+	}
+	//上次没有写完的blob不会被任何图像引用
+	tmpFiles, err := os.ReadDir(filepath.Join(imageFolder, blobTmpFolderName))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image folder: %w", err)
+	}
+	for _, entry := range tmpFiles {
+		os.Remove(filepath.Join(imageFolder, blobTmpFolderName, entry.Name()))
+	}
+
+	images, manifest, err := openImageManifest(imageFolder)
+	if err != nil {
+		return nil, err
+	}
+	store := &ContentAddressedImageStore{
+		imageFolder: imageFolder,
+		images:      images,
+		refs:        make(map[string]int),
+		manifest:    manifest,
+	}
+	for _, info := range images {
+		store.refs[info.Checksum]++
+		for _, rendition := range info.Renditions {
+			store.refs[rendition.Checksum]++
+		}
+	}
+	return store, nil
+}
+
+//blob按SHA-256的前两个字符分到不同的子文件夹，避免一个文件夹中文件太多
+func (store *ContentAddressedImageStore) blobPath(checksum string) string {
+	return filepath.Join(store.imageFolder, blobFolderName, checksum[:2], checksum)
+}
+
+//把内容写到临时文件并计算SHA-256，返回临时文件路径、SHA-256和字节数
+func (store *ContentAddressedImageStore) writeTmpBlob(data io.Reader) (string, string, int64, error) {
+	file, err := os.CreateTemp(filepath.Join(store.imageFolder, blobTmpFolderName), "blob-*")
+	if err != nil {
+		return "", "", 0, fmt.Errorf("cannot create image file: %w", err)
+	}
+	tmpPath := file.Name()
+	file.Close()
+
+	hash := sha256.New()
+	size, err := writeImageFile(tmpPath, io.TeeReader(data, hash))
+	if err != nil {
+		return "", "", 0, err
+	}
+	return tmpPath, hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+//增加blob的引用，第一个引用时把临时文件移动到blob的位置，否则删除临时文件
+//调用方需要持有写锁
+func (store *ContentAddressedImageStore) addBlobRef(tmpPath string, checksum string) error {
+	if store.refs[checksum] > 0 {
+		os.Remove(tmpPath)
+		store.refs[checksum]++
+		return nil
+	}
+
+	path := store.blobPath(checksum)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("cannot create blob folder: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("cannot move blob: %w", err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	store.refs[checksum]++
+	return nil
+}
+
+//减少blob的引用，最后一个引用被删除时删除blob
+//调用方需要持有写锁，并且已经把不再引用blob的图像信息写到了manifest
+func (store *ContentAddressedImageStore) releaseBlobRef(checksum string) error {
+	store.refs[checksum]--
+	if store.refs[checksum] > 0 {
+		return nil
+	}
+	delete(store.refs, checksum)
+	if err := os.Remove(store.blobPath(checksum)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove blob: %w", err)
+	}
+	return nil
+}
+
+// Save saves the image as a blob, an existing blob with the same content is reused
+func (store *ContentAddressedImageStore) Save(laptopID string, imageType string, owner string, imageData io.Reader) (string, error) {
+	imageID, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("cannot generate image id: %w", err)
+	}
+	tmpPath, checksum, size, err := store.writeTmpBlob(imageData)
+	if err != nil {
+		return "", err
+	}
+
+	defer store.manifest.compact(&store.mutex, store.images) //在释放锁之后执行
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err := store.addBlobRef(tmpPath, checksum); err != nil {
+		return "", err
+	}
+	info := &ImageInfo{
+		ID:         imageID.String(),
+		LaptopID:   laptopID,
+		Owner:      owner,
+		Type:       imageType,
+		Path:       store.blobPath(checksum),
+		Size:       size,
+		Checksum:   checksum,
+		UploadTime: time.Now(),
+	}
+	if err := store.manifest.put(info); err != nil {
+		store.releaseBlobRef(checksum)
+		return "", err
+	}
+	store.images[imageID.String()] = info
+	return imageID.String(), nil
+}
+
+// SaveRendition saves the rendition as a blob, see ImageStore.SaveRendition
+func (store *ContentAddressedImageStore) SaveRendition(imageID string, rendition *Rendition) error {
+	if !renditionNamePattern.MatchString(rendition.Name) {
+		return fmt.Errorf("invalid rendition name %q", rendition.Name)
+	}
+	tmpPath, checksum, size, err := store.writeTmpBlob(bytes.NewReader(rendition.Data))
+	if err != nil {
+		return err
+	}
+
+	defer store.manifest.compact(&store.mutex, store.images)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		os.Remove(tmpPath)
+		return ErrNotFound
+	}
+	if err := store.addBlobRef(tmpPath, checksum); err != nil {
+		return err
+	}
+
+	saved := &RenditionInfo{
+		Name:     rendition.Name,
+		Type:     rendition.Type,
+		Path:     store.blobPath(checksum),
+		Size:     size,
+		Checksum: checksum,
+		Width:    rendition.Width,
+		Height:   rendition.Height,
+	}
+	previous := info.Renditions
+	renditions := []*RenditionInfo{saved}
+	var replaced *RenditionInfo
+	for _, other := range previous {
+		if other.Name == rendition.Name {
+			replaced = other
+			continue
+		}
+		renditions = append(renditions, other)
+	}
+	sort.Slice(renditions, func(i, j int) bool { return renditions[i].Name < renditions[j].Name })
+	info.Renditions = renditions
+
+	if err := store.manifest.put(info); err != nil {
+		info.Renditions = previous
+		store.releaseBlobRef(checksum)
+		return err
+	}
+	if replaced != nil {
+		return store.releaseBlobRef(replaced.Checksum)
+	}
+	return nil
+}
+
+// Find returns the information of the image, or nil if there is no such image
+func (store *ContentAddressedImageStore) Find(imageID string) (*ImageInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		return nil, nil
+	}
+	return info.clone(), nil
+}
+
+// Open opens the blob of the image or rendition and seeks to offset
+func (store *ContentAddressedImageStore) Open(imageID string, rendition string, offset int64) (io.ReadCloser, error) {
+	//持有读锁打开文件，打开之后blob即使被删除也能读完
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		return nil, ErrNotFound
+	}
+	path, size := info.Path, info.Size
+	if rendition != "" {
+		saved := info.Rendition(rendition)
+		if saved == nil {
+			return nil, ErrNotFound
+		}
+		path, size = saved.Path, saved.Size
+	}
+	if offset < 0 || offset > size {
+		return nil, fmt.Errorf("offset %d is out of range [0, %d]", offset, size)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image file: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot seek image file: %w", err)
+	}
+	return file, nil
+}
+
+// List returns the images of the laptop ordered by image id
+func (store *ContentAddressedImageStore) List(laptopID string) ([]*ImageInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var images []*ImageInfo
+	for _, info := range store.images {
+		if info.LaptopID == laptopID {
+			images = append(images, info.clone())
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images, nil
+}
+
+// Delete removes the image and deletes its blobs when nothing else references them
+func (store *ContentAddressedImageStore) Delete(imageID string) error {
+	defer store.manifest.compact(&store.mutex, store.images)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		return ErrNotFound
+	}
+
+	//先从manifest中删除，删除blob失败时只会留下一个没有引用的blob
+	if err := store.manifest.delete(imageID); err != nil {
+		return err
+	}
+	delete(store.images, imageID)
+	//即使删除某个blob失败，其他blob的引用也要减少
+	err := store.releaseBlobRef(info.Checksum)
+	for _, rendition := range info.Renditions {
+		if releaseErr := store.releaseBlobRef(rendition.Checksum); err == nil {
+			err = releaseErr
+		}
+	}
+	return err
+}
+
+// Usage returns the number and the total size of the images uploaded by owner
+//相同内容的图像只保存一份，但是每张图像都计算在上传者的配额中
+func (store *ContentAddressedImageStore) Usage(owner string) (*ImageUsage, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return imageUsage(store.images, owner), nil
+}
+
+//返回所有图像，按图像id排序
+func (store *ContentAddressedImageStore) all() ([]*ImageInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return sortedImages(store.images), nil
+}
+
+//返回没有被引用的blob，以及写入中途失败留下的临时文件
+func (store *ContentAddressedImageStore) orphanFiles() ([]*ImageGarbage, error) {
+	var paths []string
+	err := filepath.WalkDir(filepath.Join(store.imageFolder, blobFolderName), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read blob folder: %w", err)
+	}
+	tmpFiles, err := os.ReadDir(filepath.Join(store.imageFolder, blobTmpFolderName))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image folder: %w", err)
+	}
+	for _, entry := range tmpFiles {
+		paths = append(paths, filepath.Join(store.imageFolder, blobTmpFolderName, entry.Name()))
+	}
+
+	var garbage []*ImageGarbage
+	for _, path := range paths {
+		if store.referenced(path) {
+			continue
+		}
+		file, err := fileGarbage(OrphanFile, path)
+		if err != nil {
+			return nil, err
+		}
+		if file != nil {
+			garbage = append(garbage, file)
+		}
+	}
+	return garbage, nil
+}
+
+//是否是被引用的blob
+func (store *ContentAddressedImageStore) referenced(path string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	checksum := filepath.Base(path)
+	return store.refs[checksum] > 0 && len(checksum) > 2 && store.blobPath(checksum) == path
+}
+
+//持有写锁删除文件，Save不会在检查之后开始引用它
+func (store *ContentAddressedImageStore) removeOrphanFile(path string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	checksum := filepath.Base(path)
+	if store.refs[checksum] > 0 && len(checksum) > 2 && store.blobPath(checksum) == path {
+		return errFileInUse
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove blob: %w", err)
+	}
+	return nil
+}
+
+// BlobCount returns the number of distinct blobs referenced by the images
+func (store *ContentAddressedImageStore) BlobCount() int {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return len(store.refs)
+}
@@ -0,0 +1,80 @@
+package service_test
+
+import (
+	"grpctest/service"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentAddressedImageStore(t *testing.T) {
+	t.Parallel()
+
+	folder := t.TempDir()
+	store, err := service.NewContentAddressedImageStore(folder)
+	require.NoError(t, err)
+
+	//同一张图像上传给多台电脑时只保存一个blob
+	var imageIDs []string
+	for _, laptopID := range []string{"laptop1", "laptop2", "laptop3"} {
+		imageID, err := store.Save(laptopID, ".jpg", "sales", strings.NewReader("marketing photo"))
+		require.NoError(t, err)
+		imageIDs = append(imageIDs, imageID)
+	}
+	otherID, err := store.Save("laptop1", ".png", "other", strings.NewReader("another photo"))
+	require.NoError(t, err)
+	require.Equal(t, 2, store.BlobCount())
+
+	//每张图像都计算在上传者的配额中
+	usage, err := store.Usage("sales")
+	require.NoError(t, err)
+	require.Equal(t, &service.ImageUsage{Images: 3, Bytes: 3 * int64(len("marketing photo"))}, usage)
+
+	first, err := store.Find(imageIDs[0])
+	require.NoError(t, err)
+	second, err := store.Find(imageIDs[1])
+	require.NoError(t, err)
+	require.NotEqual(t, first.ID, second.ID)
+	require.Equal(t, first.Path, second.Path)
+	require.Equal(t, "laptop2", second.LaptopID)
+
+	//相同内容的缩略图也共用blob
+	rendition := &service.Rendition{Name: "small", Type: ".jpg", Width: 1, Height: 1, Data: []byte("small photo")}
+	require.NoError(t, store.SaveRendition(imageIDs[0], rendition))
+	require.NoError(t, store.SaveRendition(imageIDs[1], rendition))
+	require.Equal(t, 3, store.BlobCount())
+
+	//删除一个引用后blob仍然存在
+	require.NoError(t, store.Delete(imageIDs[0]))
+	require.ErrorIs(t, store.Delete(imageIDs[0]), service.ErrNotFound)
+	require.FileExists(t, first.Path)
+	reader, err := store.Open(imageIDs[1], "small", 0)
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, "small photo", string(data))
+
+	//重启后根据manifest重新计算引用计数
+	store, err = service.NewContentAddressedImageStore(folder)
+	require.NoError(t, err)
+	require.Equal(t, 3, store.BlobCount())
+
+	second, err = store.Find(imageIDs[1])
+	require.NoError(t, err)
+	require.NoError(t, store.Delete(imageIDs[1]))
+	require.FileExists(t, first.Path)
+	require.NoFileExists(t, second.Rendition("small").Path)
+	require.NoError(t, store.Delete(imageIDs[2]))
+	require.NoFileExists(t, first.Path)
+	require.Equal(t, 1, store.BlobCount())
+
+	other, err := store.Find(otherID)
+	require.NoError(t, err)
+	contents, err := os.ReadFile(other.Path)
+	require.NoError(t, err)
+	require.Equal(t, "another photo", string(contents))
+}
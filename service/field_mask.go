@@ -0,0 +1,89 @@
+//用FieldMask对laptop进行部分更新
+package service
+
+import (
+	"errors"
+	"fmt"
+	"grpctest/pb"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// ErrInvalidFieldMask is returned when an update mask names a field that cannot be updated
+var ErrInvalidFieldMask = errors.New("invalid field mask")
+
+//这些字段由服务器维护，客户端不能通过mask修改它们或者它们的子字段
+var readOnlyLaptopFields = map[string]bool{
+	"id":        true,
+	"version":   true,
+	"update_at": true,
+}
+
+//检查mask中的每一个路径是否都指向laptop中存在并且可以修改的字段
+func validateFieldMask(paths []string) error {
+	descriptor := (&pb.Laptop{}).ProtoReflect().Descriptor()
+	for _, path := range paths {
+		if _, err := resolveFieldPath(descriptor, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//把path解析成从laptop开始的一串字段，中间的字段必须是非repeated的message
+func resolveFieldPath(descriptor protoreflect.MessageDescriptor, path string) ([]protoreflect.FieldDescriptor, error) {
+	names := strings.Split(path, ".")
+	if readOnlyLaptopFields[names[0]] { //例如update_at.seconds
+		return nil, fmt.Errorf("%w: field %q is read-only", ErrInvalidFieldMask, path)
+	}
+
+	fields := make([]protoreflect.FieldDescriptor, 0, len(names))
+	for i, name := range names {
+		field := descriptor.Fields().ByName(protoreflect.Name(name))
+		if field == nil {
+			return nil, fmt.Errorf("%w: unknown field %q in path %q", ErrInvalidFieldMask, name, path)
+		}
+		fields = append(fields, field)
+
+		if i == len(names)-1 {
+			break
+		}
+		if field.Kind() != protoreflect.MessageKind || field.IsList() || field.IsMap() {
+			return nil, fmt.Errorf("%w: field %q in path %q has no sub-fields", ErrInvalidFieldMask, name, path)
+		}
+		descriptor = field.Message()
+	}
+	return fields, nil
+}
+
+//把src中paths列出的字段复制到dst，其他字段保持不变
+//src中没有设置的字段会在dst中被清除，repeated字段会被整体替换
+func applyFieldMask(dst *pb.Laptop, src *pb.Laptop, paths []string) error {
+	src = proto.Clone(src).(*pb.Laptop) //避免dst和调用方的laptop共用子消息
+
+	for _, path := range paths {
+		fields, err := resolveFieldPath(dst.ProtoReflect().Descriptor(), path)
+		if err != nil {
+			return err
+		}
+
+		dstMessage := dst.ProtoReflect()
+		srcMessage := src.ProtoReflect()
+		last := len(fields) - 1
+		for _, field := range fields[:last] {
+			//src中缺少的子消息按默认值处理
+			srcMessage = srcMessage.Get(field).Message()
+			dstMessage = dstMessage.Mutable(field).Message()
+		}
+
+		field := fields[last]
+		if srcMessage.IsValid() && srcMessage.Has(field) {
+			dstMessage.Set(field, srcMessage.Get(field))
+		} else {
+			dstMessage.Clear(field)
+		}
+	}
+	return nil
+}
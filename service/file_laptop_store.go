@@ -0,0 +1,559 @@
+//把电脑持久化到磁盘的LaptopStore，修改先追加到预写日志，再定期压缩成快照
+package service
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"grpctest/pb"
+	"grpctest/serializer"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+const (
+	snapshotFileName = "snapshot.bin"
+	walFilePrefix    = "wal-"
+	walFileSuffix    = ".log"
+	walHeaderSize    = 8        //记录长度和校验和各4字节
+	maxWALRecordSize = 64 << 20 //超过这个长度的记录一定是损坏的
+)
+
+//日志记录的校验和使用CRC-32C
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptedLog is returned when a write-ahead log other than the last one is damaged
+var ErrCorruptedLog = errors.New("write-ahead log is corrupted")
+
+// FsyncPolicy decides when the write-ahead log is flushed to disk
+type FsyncPolicy int
+
+const (
+	FsyncAlways   FsyncPolicy = iota //每次修改都同步，崩溃时不会丢失已经返回成功的修改
+	FsyncInterval                    //每隔FsyncInterval同步一次，崩溃时最多丢失这段时间内的修改
+	FsyncNever                       //交给操作系统决定，只有进程崩溃而系统正常时不会丢失修改
+)
+
+// ParseFsyncPolicy converts always, interval or never to a FsyncPolicy
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	switch name {
+	case "always":
+		return FsyncAlways, nil
+	case "interval":
+		return FsyncInterval, nil
+	case "never":
+		return FsyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown fsync policy: %s", name)
+}
+
+// FileStoreOptions configures a FileLaptopStore
+type FileStoreOptions struct {
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration //Fsync为FsyncInterval时的同步间隔，默认1秒
+	SnapshotEvery int           //日志中累积了这么多条记录后压缩成快照，默认10000，小于0时不自动压缩
+}
+
+//FileLaptopStore在内存中保存所有电脑，修改时先写预写日志
+//目录中有一个快照和若干个按编号排列的日志文件，快照包含了编号小于它的generation的所有日志
+type FileLaptopStore struct {
+	*InMemoryLaptopStore
+	dir     string
+	options FileStoreOptions
+
+	//walMutex保护下面的字段，写日志时已经持有store的写锁，同步和压缩时只需要这个锁
+	walMutex   sync.Mutex
+	wal        *os.File
+	writer     *bufio.Writer
+	generation uint64 //当前日志文件的编号
+	records    int    //当前日志文件中的记录数量
+	size       int64  //当前日志文件的长度，追加失败时截回这个长度
+	dirty      bool   //有没有还没同步到磁盘的记录
+	closed     bool
+	failed     error //追加失败后没能撤销，日志中可能留下了调用方以为失败了的修改，不再接受写入
+
+	snapshotMutex sync.Mutex    //同一时间只写一个快照
+	snapshotc     chan struct{} //日志太长时通知后台压缩
+	done          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// NewFileLaptopStore loads the laptops saved in dir and returns a store that keeps saving to it
+func NewFileLaptopStore(dir string, options FileStoreOptions) (*FileLaptopStore, error) {
+	if options.FsyncInterval <= 0 {
+		options.FsyncInterval = time.Second
+	}
+	if options.SnapshotEvery == 0 {
+		options.SnapshotEvery = 10000
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create data folder: %w", err)
+	}
+
+	store := &FileLaptopStore{
+		InMemoryLaptopStore: NewInMemoryLaptopStore(),
+		dir:                 dir,
+		options:             options,
+		snapshotc:           make(chan struct{}, 1),
+		done:                make(chan struct{}),
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	store.wg.Add(1)
+	go store.run()
+	return store, nil
+}
+
+//读取快照，然后按顺序回放快照之后的日志，最后打开最新的日志文件继续写
+func (store *FileLaptopStore) load() error {
+	snapshot := &pb.LaptopSnapshot{}
+	snapshotPath := filepath.Join(store.dir, snapshotFileName)
+	if _, err := os.Stat(snapshotPath); err == nil {
+		if err := serializer.ReadProtobufFromBinaryFile(snapshot, snapshotPath); err != nil {
+			return fmt.Errorf("cannot load snapshot: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("cannot load snapshot: %w", err)
+	}
+	for _, laptop := range snapshot.GetLaptops() {
+		store.replay(&pb.LaptopRecord{Record: &pb.LaptopRecord_Put{Put: laptop}})
+	}
+
+	generations, err := store.walGenerations()
+	if err != nil {
+		return err
+	}
+
+	store.generation = snapshot.GetGeneration()
+	for i, generation := range generations {
+		if generation < snapshot.GetGeneration() {
+			//已经包含在快照中，上次压缩之后还没来得及删除
+			if err := os.Remove(store.walPath(generation)); err != nil {
+				return fmt.Errorf("cannot remove compacted log: %w", err)
+			}
+			continue
+		}
+
+		last := i == len(generations)-1
+		records, err := store.replayWAL(generation, last)
+		if err != nil {
+			return err
+		}
+		store.generation = generation
+		store.records = records
+	}
+
+	return store.openWAL()
+}
+
+//返回目录中所有日志文件的编号，从小到大排列
+func (store *FileLaptopStore) walGenerations() ([]uint64, error) {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read data folder: %w", err)
+	}
+
+	var generations []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, walFilePrefix) || !strings.HasSuffix(name, walFileSuffix) {
+			continue
+		}
+		generation, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, walFilePrefix), walFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+	return generations, nil
+}
+
+func (store *FileLaptopStore) walPath(generation uint64) string {
+	return filepath.Join(store.dir, fmt.Sprintf("%s%020d%s", walFilePrefix, generation, walFileSuffix))
+}
+
+//回放一个日志文件，返回其中完整的记录数量
+//最后一个日志文件末尾不完整的记录是崩溃时没有写完的，直接截掉；其他日志文件损坏时返回ErrCorruptedLog
+func (store *FileLaptopStore) replayWAL(generation uint64, last bool) (int, error) {
+	path := store.walPath(generation)
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open log: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	records := 0
+	for {
+		record, size, err := readWALRecord(reader)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			if !last {
+				return 0, fmt.Errorf("%w: %s at offset %d: %v", ErrCorruptedLog, path, offset, err)
+			}
+			log.Printf("truncate torn record in %s at offset %d: %v", path, offset, err)
+			if err := file.Truncate(offset); err != nil {
+				return 0, fmt.Errorf("cannot truncate log: %w", err)
+			}
+			if err := file.Sync(); err != nil {
+				return 0, fmt.Errorf("cannot sync log: %w", err)
+			}
+			return records, nil
+		}
+
+		store.replay(record)
+		offset += size
+		records++
+	}
+}
+
+//读一条记录，返回记录和它在文件中占用的字节数，文件正好结束时返回io.EOF
+func readWALRecord(reader io.Reader) (*pb.LaptopRecord, int64, error) {
+	payload, size, err := readWALFrame(reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	record := &pb.LaptopRecord{}
+	if err := proto.Unmarshal(payload, record); err != nil {
+		return nil, 0, fmt.Errorf("cannot unmarshal record: %w", err)
+	}
+	return record, size, nil
+}
+
+//读一条带长度和校验和的记录内容，返回内容和它在文件中占用的字节数，文件正好结束时返回io.EOF
+func readWALFrame(reader io.Reader) ([]byte, int64, error) {
+	header := make([]byte, walHeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("incomplete header of %d bytes", n)
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	//正常的记录一定不为空，长度为0通常是崩溃后文件末尾填充的0
+	if length == 0 || length > maxWALRecordSize {
+		return nil, 0, fmt.Errorf("invalid record length %d", length)
+	}
+
+	payload := make([]byte, length)
+	n, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, 0, fmt.Errorf("incomplete record of %d/%d bytes", n, length)
+	}
+	if crc32.Checksum(payload, walCRCTable) != checksum {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	return payload, int64(walHeaderSize + length), nil
+}
+
+//返回写在记录内容之前的长度和校验和
+func walHeader(payload []byte) []byte {
+	header := make([]byte, walHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(payload, walCRCTable))
+	return header
+}
+
+func (store *FileLaptopStore) openWAL() error {
+	file, err := os.OpenFile(store.walPath(store.generation), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open log: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot stat log: %w", err)
+	}
+	store.wal = file
+	store.writer = bufio.NewWriter(file)
+	store.size = stat.Size()
+	return syncDir(store.dir)
+}
+
+// Save writes the laptop to the write-ahead log and then saves it in memory
+func (store *FileLaptopStore) Save(laptop *pb.Laptop) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	other, err := store.checkSave(laptop)
+	if err != nil {
+		return err
+	}
+	if err := store.append(&pb.LaptopRecord{Record: &pb.LaptopRecord_Put{Put: other}}); err != nil {
+		return err
+	}
+	store.applySave(other)
+	return nil
+}
+
+// Update writes the updated laptop to the write-ahead log and then updates it in memory, see LaptopStore.Update
+func (store *FileLaptopStore) Update(laptop *pb.Laptop, mask *fieldmaskpb.FieldMask, version *uint64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current, other, err := store.checkUpdate(laptop, mask, version)
+	if err != nil {
+		return err
+	}
+	if err := store.append(&pb.LaptopRecord{Record: &pb.LaptopRecord_Put{Put: other}}); err != nil {
+		return err
+	}
+	store.applyUpdate(laptop, current, other)
+	return nil
+}
+
+// Delete writes the deletion to the write-ahead log and then deletes the laptop in memory, see LaptopStore.Delete
+func (store *FileLaptopStore) Delete(id string, version *uint64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current, err := store.checkDelete(id, version)
+	if err != nil {
+		return err
+	}
+	if err := store.append(&pb.LaptopRecord{Record: &pb.LaptopRecord_DeleteId{DeleteId: id}}); err != nil {
+		return err
+	}
+	store.applyDelete(current)
+	return nil
+}
+
+//追加一条记录，调用方需要持有store的写锁
+//返回错误时记录不会留在日志中，重启后不会回放出调用方以为失败了的修改
+func (store *FileLaptopStore) append(record *pb.LaptopRecord) error {
+	payload, err := proto.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot marshal record: %w", err)
+	}
+
+	header := walHeader(payload)
+
+	store.walMutex.Lock()
+	defer store.walMutex.Unlock()
+
+	if store.closed {
+		return errors.New("store is closed")
+	}
+	if store.failed != nil {
+		return store.failed
+	}
+	if err := store.writeWAL(header, payload); err != nil {
+		return fmt.Errorf("cannot write log: %w", store.rollbackWAL(err))
+	}
+
+	store.size += int64(len(header) + len(payload))
+	store.records++
+	if store.options.SnapshotEvery > 0 && store.records >= store.options.SnapshotEvery {
+		select {
+		case store.snapshotc <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+//调用方需要持有walMutex
+func (store *FileLaptopStore) writeWAL(header, payload []byte) error {
+	if _, err := store.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := store.writer.Write(payload); err != nil {
+		return err
+	}
+	//记录要写到文件里，进程崩溃时才不会丢失
+	if err := store.writer.Flush(); err != nil {
+		return err
+	}
+	store.dirty = true
+	if store.options.Fsync == FsyncAlways {
+		return store.syncWAL()
+	}
+	return nil
+}
+
+//把日志截回追加之前的长度，返回cause
+//截断也失败时记录可能留在日志中，store不再接受写入，调用方需要修复磁盘后重新打开store
+//调用方需要持有walMutex
+func (store *FileLaptopStore) rollbackWAL(cause error) error {
+	store.writer.Reset(store.wal) //丢掉缓冲区中没有写出去的数据
+	if err := store.wal.Truncate(store.size); err != nil {
+		store.failed = fmt.Errorf("log is unusable after %v, cannot truncate it: %w", cause, err)
+		return store.failed
+	}
+	if err := store.wal.Sync(); err != nil {
+		store.failed = fmt.Errorf("log is unusable after %v, cannot sync it: %w", cause, err)
+		return store.failed
+	}
+	return cause
+}
+
+//调用方需要持有walMutex
+func (store *FileLaptopStore) syncWAL() error {
+	if !store.dirty {
+		return nil
+	}
+	if err := store.wal.Sync(); err != nil {
+		return err
+	}
+	store.dirty = false
+	return nil
+}
+
+//后台定期同步日志，并在日志太长时压缩
+func (store *FileLaptopStore) run() {
+	defer store.wg.Done()
+
+	var tick <-chan time.Time
+	if store.options.Fsync == FsyncInterval {
+		ticker := time.NewTicker(store.options.FsyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-store.done:
+			return
+		case <-tick:
+			store.walMutex.Lock()
+			if err := store.syncWAL(); err != nil {
+				log.Printf("cannot sync log: %v", err)
+			}
+			store.walMutex.Unlock()
+		case <-store.snapshotc:
+			if err := store.Snapshot(); err != nil {
+				log.Printf("cannot take snapshot: %v", err)
+			}
+		}
+	}
+}
+
+// Snapshot writes every laptop to a new snapshot and removes the logs it covers
+func (store *FileLaptopStore) Snapshot() error {
+	store.snapshotMutex.Lock()
+	defer store.snapshotMutex.Unlock()
+
+	//持有写锁时切换到新的日志文件，并记下此刻所有的电脑
+	//store中的电脑在更新时会被替换而不会被修改，所以释放锁之后仍然可以安全地读取它们
+	store.mutex.Lock()
+	snapshot := &pb.LaptopSnapshot{Laptops: make([]*pb.Laptop, 0, len(store.data))}
+	for _, laptop := range store.data {
+		snapshot.Laptops = append(snapshot.Laptops, laptop)
+	}
+	err := store.rotateWAL()
+	snapshot.Generation = store.generation
+	store.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	//先写到临时文件，同步之后再重命名，崩溃时不会留下不完整的快照
+	snapshotPath := filepath.Join(store.dir, snapshotFileName)
+	tmpPath := snapshotPath + ".tmp"
+	if err := serializer.WriteProtobufToBinaryFile(snapshot, tmpPath); err != nil {
+		return err
+	}
+	if err := syncFile(tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, snapshotPath); err != nil {
+		return fmt.Errorf("cannot rename snapshot: %w", err)
+	}
+	if err := syncDir(store.dir); err != nil {
+		return err
+	}
+
+	generations, err := store.walGenerations()
+	if err != nil {
+		return err
+	}
+	for _, generation := range generations {
+		if generation < snapshot.Generation {
+			if err := os.Remove(store.walPath(generation)); err != nil {
+				return fmt.Errorf("cannot remove compacted log: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+//同步并关闭当前的日志文件，之后的记录写到下一个编号的日志文件
+func (store *FileLaptopStore) rotateWAL() error {
+	store.walMutex.Lock()
+	defer store.walMutex.Unlock()
+
+	if store.closed {
+		return errors.New("store is closed")
+	}
+	if err := store.syncWAL(); err != nil {
+		return fmt.Errorf("cannot sync log: %w", err)
+	}
+	if err := store.wal.Close(); err != nil {
+		return fmt.Errorf("cannot close log: %w", err)
+	}
+	store.generation++
+	store.records = 0
+	return store.openWAL()
+}
+
+// Close flushes the write-ahead log to disk and stops the background work
+func (store *FileLaptopStore) Close() error {
+	store.walMutex.Lock()
+	if store.closed {
+		store.walMutex.Unlock()
+		return nil
+	}
+	store.closed = true
+	close(store.done)
+	store.walMutex.Unlock()
+
+	//等待正在进行的压缩结束
+	store.wg.Wait()
+
+	store.walMutex.Lock()
+	defer store.walMutex.Unlock()
+	if err := store.syncWAL(); err != nil {
+		return fmt.Errorf("cannot sync log: %w", err)
+	}
+	return store.wal.Close()
+}
+
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync %s: %w", path, err)
+	}
+	return nil
+}
+
+//新建和重命名文件之后需要同步目录，否则崩溃后文件可能不在目录中
+func syncDir(dir string) error {
+	return syncFile(dir)
+}
@@ -0,0 +1,143 @@
+package service_test
+
+import (
+	"context"
+	"grpctest/pb"
+	"grpctest/sample"
+	"grpctest/service"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+//按id排序返回store中所有的电脑
+func listAllLaptops(t *testing.T, store service.LaptopStore) []*pb.Laptop {
+	laptops, err := store.List(context.Background(), "", 1<<20)
+	require.NoError(t, err)
+	sort.Slice(laptops, func(i, j int) bool { return laptops[i].GetId() < laptops[j].GetId() })
+	return laptops
+}
+
+func requireSameLaptops(t *testing.T, expected, actual []*pb.Laptop) {
+	require.Len(t, actual, len(expected))
+	for i := range expected {
+		requireSameLaptop(t, expected[i], actual[i])
+	}
+}
+
+func walFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	require.NoError(t, err)
+	return files
+}
+
+func TestFileLaptopStoreReplay(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	options := service.FileStoreOptions{Fsync: service.FsyncAlways, SnapshotEvery: -1}
+	store, err := service.NewFileLaptopStore(dir, options)
+	require.NoError(t, err)
+
+	var laptops []*pb.Laptop
+	for i := 0; i < 10; i++ {
+		laptop := sample.NewLaptop()
+		require.NoError(t, store.Save(laptop))
+		laptops = append(laptops, laptop)
+	}
+	laptops[0].PriceUsd = 999
+	require.NoError(t, store.Update(laptops[0], nil, nil))
+	laptops[1].Name = "renamed"
+	require.NoError(t, store.Update(laptops[1], &fieldmaskpb.FieldMask{Paths: []string{"name"}}, nil))
+	require.NoError(t, store.Delete(laptops[2].Id, nil))
+
+	//压缩之后再修改，重新打开时要先读快照再回放新的日志
+	require.NoError(t, store.Snapshot())
+	require.Len(t, walFiles(t, dir), 1)
+	require.NoError(t, store.Delete(laptops[3].Id, nil))
+	laptops[4].PriceUsd = 1234
+	require.NoError(t, store.Update(laptops[4], nil, nil))
+
+	expected := listAllLaptops(t, store)
+	require.Len(t, expected, 8)
+	require.NoError(t, store.Close())
+
+	reopened, err := service.NewFileLaptopStore(dir, options)
+	require.NoError(t, err)
+	defer reopened.Close()
+	requireSameLaptops(t, expected, listAllLaptops(t, reopened))
+
+	//回放之后索引也是正确的
+	var found []string
+	err = reopened.Search(context.Background(), &pb.Filter{MinPriceUsd: 1234, MaxPriceUsd: 1234}, nil, func(laptop *pb.Laptop) error {
+		found = append(found, laptop.GetId())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{laptops[4].Id}, found)
+}
+
+func TestFileLaptopStoreTornTail(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	options := service.FileStoreOptions{Fsync: service.FsyncNever, SnapshotEvery: -1}
+	store, err := service.NewFileLaptopStore(dir, options)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.Save(sample.NewLaptop()))
+	}
+	expected := listAllLaptops(t, store)
+	require.NoError(t, store.Close())
+
+	files := walFiles(t, dir)
+	require.Len(t, files, 1)
+	info, err := os.Stat(files[0])
+	require.NoError(t, err)
+	size := info.Size()
+
+	testCases := []struct {
+		name string
+		tail []byte
+	}{
+		{"partial header", []byte{0x10, 0x00}},
+		{"partial payload", []byte{0x10, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04, 0x0a}},
+		{"zero filled", make([]byte, 64)},
+	}
+
+	for _, tc := range testCases {
+		//模拟写到一半时崩溃
+		file, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		_, err = file.Write(tc.tail)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		reopened, err := service.NewFileLaptopStore(dir, options)
+		require.NoError(t, err, tc.name)
+		requireSameLaptops(t, expected, listAllLaptops(t, reopened))
+
+		//不完整的记录被截掉，之后追加的记录可以正常回放
+		info, err := os.Stat(files[0])
+		require.NoError(t, err)
+		require.Equal(t, size, info.Size(), tc.name)
+
+		laptop := sample.NewLaptop()
+		require.NoError(t, reopened.Save(laptop))
+		require.NoError(t, reopened.Delete(laptop.Id, nil))
+		require.NoError(t, reopened.Close())
+
+		info, err = os.Stat(files[0])
+		require.NoError(t, err)
+		size = info.Size()
+	}
+
+	reopened, err := service.NewFileLaptopStore(dir, options)
+	require.NoError(t, err)
+	defer reopened.Close()
+	requireSameLaptops(t, expected, listAllLaptops(t, reopened))
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"grpctest/sample"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+//把数据全部写到文件之后仍然返回错误，和同步失败时一样，记录已经在日志文件中了
+type failingWALWriter struct {
+	file *os.File
+}
+
+func (writer *failingWALWriter) Write(p []byte) (int, error) {
+	if _, err := writer.file.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), errors.New("disk failure")
+}
+
+func TestFileLaptopStoreRollbackFailedAppend(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	store, err := NewFileLaptopStore(dir, FileStoreOptions{Fsync: FsyncAlways})
+	require.NoError(t, err)
+
+	saved := sample.NewLaptop()
+	require.NoError(t, store.Save(saved))
+
+	//追加失败时调用方收到错误，内存和日志中都没有这台电脑
+	store.writer = bufio.NewWriter(&failingWALWriter{store.wal})
+	failed := sample.NewLaptop()
+	require.Error(t, store.Save(failed))
+	found, err := store.Find(failed.Id)
+	require.NoError(t, err)
+	require.Nil(t, found)
+
+	//撤销之后可以继续写入
+	other := sample.NewLaptop()
+	require.NoError(t, store.Save(other))
+	require.NoError(t, store.Close())
+
+	store, err = NewFileLaptopStore(dir, FileStoreOptions{Fsync: FsyncAlways})
+	require.NoError(t, err)
+	defer store.Close()
+	for _, id := range []string{saved.Id, other.Id} {
+		found, err := store.Find(id)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+	}
+	found, err = store.Find(failed.Id)
+	require.NoError(t, err)
+	require.Nil(t, found)
+}
+
+func TestFileLaptopStoreRefusesWritesAfterFailedRollback(t *testing.T) {
+	t.Parallel()
+
+	store, err := NewFileLaptopStore(t.TempDir(), FileStoreOptions{Fsync: FsyncAlways})
+	require.NoError(t, err)
+	defer store.Close()
+
+	//日志文件已经关闭，写入和截断都会失败
+	require.NoError(t, store.wal.Close())
+	require.Error(t, store.Save(sample.NewLaptop()))
+	require.NotNil(t, store.failed)
+
+	err = store.Save(sample.NewLaptop())
+	require.ErrorIs(t, err, store.failed)
+	require.Empty(t, listLaptopIDs(t, store))
+}
+
+func listLaptopIDs(t *testing.T, store LaptopStore) []string {
+	laptops, err := store.List(context.Background(), "", 100)
+	require.NoError(t, err)
+	var ids []string
+	for _, laptop := range laptops {
+		ids = append(ids, laptop.GetId())
+	}
+	return ids
+}
@@ -0,0 +1,199 @@
+//回收没有用的图像、文件和上传
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// ImageGarbageKind is the kind of data found by the image garbage collector
+type ImageGarbageKind int //和pb.ImageGarbage_Kind的值相同
+
+const (
+	// OrphanImage is an image whose laptop doesn't exist any more
+	OrphanImage ImageGarbageKind = iota + 1
+	// OrphanFile is a file or object that no image refers to
+	OrphanFile
+	// StaleUpload is an abandoned upload, or a staged upload file that no upload owns
+	StaleUpload
+)
+
+// ImageGarbage is data that the image garbage collector removes
+type ImageGarbage struct {
+	Kind     ImageGarbageKind
+	Name     string    //图像id、文件路径或者上传id
+	LaptopID string    //图像或者上传所属的电脑，文件没有
+	Size     int64     //删除后释放的字节数
+	ModTime  time.Time //最后一次修改的时间，超过宽限期才会被删除
+}
+
+// ImageGCReport is the garbage removed by one collection, or found by a dry run
+type ImageGCReport struct {
+	Removed    []*ImageGarbage
+	Failed     int //删除失败的数量
+	FreedBytes int64
+}
+
+// ImageGCOptions configures the image garbage collector
+type ImageGCOptions struct {
+	Interval    time.Duration //两次回收之间的时间
+	GracePeriod time.Duration //数据至少这么久没有修改才会被删除，正在写入的文件不会被误删
+	//回收电脑已经不存在的图像，只能在电脑store包含了图像store中所有电脑时开启
+	//多个副本共用一个S3 bucket而各自有自己的电脑store时，其他副本的电脑在这里找不到，不能开启
+	OrphanImages bool
+}
+
+// DefaultImageGCOptions are the options used when the server is not configured otherwise
+var DefaultImageGCOptions = ImageGCOptions{Interval: time.Hour, GracePeriod: time.Hour, OrphanImages: true}
+
+//可以找出没有被图像引用的文件的图像store
+//删除前需要重新检查文件没有被引用，找到之后可能被新的图像使用了
+type imageGarbageSource interface {
+	//返回所有图像，按图像id排序
+	all() ([]*ImageInfo, error)
+	//返回没有被任何图像引用的文件
+	orphanFiles() ([]*ImageGarbage, error)
+	//删除orphanFiles返回的文件
+	removeOrphanFile(path string) error
+}
+
+//文件被图像引用时不能删除
+var errFileInUse = errors.New("file is in use")
+
+//返回文件的信息，文件已经不存在时返回nil
+func fileGarbage(kind ImageGarbageKind, path string) (*ImageGarbage, error) {
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat file: %w", err)
+	}
+	return &ImageGarbage{Kind: kind, Name: path, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// SetImageGCOptions sets how often the image garbage collector runs and how old garbage must be
+func (server *LaptopServer) SetImageGCOptions(options ImageGCOptions) {
+	server.gcOptions = options
+}
+
+// RunImageGC collects image garbage every interval until ctx is done
+func (server *LaptopServer) RunImageGC(ctx context.Context) {
+	ticker := time.NewTicker(server.gcOptions.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := server.collectImageGarbage(false); err != nil {
+			log.Printf("cannot collect image garbage: %v", err)
+		}
+	}
+}
+
+//找出超过宽限期的垃圾，不是dryRun时删除它们
+//单个数据删除失败时记录日志并继续
+func (server *LaptopServer) collectImageGarbage(dryRun bool) (*ImageGCReport, error) {
+	before := time.Now().Add(-server.gcOptions.GracePeriod)
+	garbage, err := server.findImageGarbage(before)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImageGCReport{}
+	for _, item := range garbage {
+		if !dryRun {
+			if err := server.removeImageGarbage(item, before); err != nil {
+				log.Printf("gc cannot remove %s: %v", item.Name, err)
+				report.Failed++
+				continue
+			}
+			log.Printf("gc removed %s (%d bytes)", item.Name, item.Size)
+		}
+		report.Removed = append(report.Removed, item)
+		report.FreedBytes += item.Size
+	}
+	if !dryRun && (len(report.Removed) > 0 || report.Failed > 0) {
+		log.Printf("gc removed %d items and freed %d bytes, %d items failed", len(report.Removed), report.FreedBytes, report.Failed)
+	}
+	return report, nil
+}
+
+//找出在before之前最后修改的垃圾
+func (server *LaptopServer) findImageGarbage(before time.Time) ([]*ImageGarbage, error) {
+	var garbage []*ImageGarbage
+	if source, ok := server.imageStore.(imageGarbageSource); ok {
+		var images []*ImageInfo
+		if server.gcOptions.OrphanImages {
+			var err error
+			images, err = source.all()
+			if err != nil {
+				return nil, err
+			}
+		}
+		exists := make(map[string]bool) //key是电脑id
+		for _, info := range images {
+			found, checked := exists[info.LaptopID]
+			if !checked {
+				laptop, err := server.laptopStore.Find(info.LaptopID)
+				if err != nil {
+					return nil, fmt.Errorf("cannot find laptop: %w", err)
+				}
+				found = laptop != nil
+				exists[info.LaptopID] = found
+			}
+			if found || !info.UploadTime.Before(before) {
+				continue
+			}
+			size := info.Size
+			for _, rendition := range info.Renditions {
+				size += rendition.Size
+			}
+			garbage = append(garbage, &ImageGarbage{
+				Kind:     OrphanImage,
+				Name:     info.ID,
+				LaptopID: info.LaptopID,
+				Size:     size,
+				ModTime:  info.UploadTime,
+			})
+		}
+
+		files, err := source.orphanFiles()
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.ModTime.Before(before) {
+				garbage = append(garbage, file)
+			}
+		}
+	}
+
+	uploads, err := server.uploads.staleUploads(before)
+	if err != nil {
+		return nil, err
+	}
+	return append(garbage, uploads...), nil
+}
+
+func (server *LaptopServer) removeImageGarbage(garbage *ImageGarbage, before time.Time) error {
+	switch garbage.Kind {
+	case OrphanImage:
+		err := server.imageStore.Delete(garbage.Name)
+		if errors.Is(err, ErrNotFound) { //可能同时被DeleteImage删除了
+			return nil
+		}
+		return err
+	case OrphanFile:
+		return server.imageStore.(imageGarbageSource).removeOrphanFile(garbage.Name)
+	case StaleUpload:
+		return server.uploads.removeStale(garbage.Name, before)
+	}
+	return fmt.Errorf("unknown garbage kind %d", garbage.Kind)
+}
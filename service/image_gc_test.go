@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"grpctest/pb"
+	"grpctest/sample"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+//把文件的修改时间改到宽限期之前
+func ageFile(t *testing.T, path string) {
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(path, old, old))
+}
+
+func garbageNames(report *ImageGCReport) []string {
+	var names []string
+	for _, garbage := range report.Removed {
+		names = append(names, garbage.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCollectImageGarbage(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	uploadFolder := t.TempDir()
+	imageStore, err := NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+	laptopStore := NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	server := NewLaptopServer(laptopStore, imageStore, NewInMemoryRatingStore())
+	server.SetUploadFolder(uploadFolder)
+	server.SetImageGCOptions(ImageGCOptions{Interval: time.Hour, GracePeriod: time.Hour, OrphanImages: true})
+
+	//电脑存在的图像和刚上传的图像不会被回收
+	keptID, err := imageStore.Save(laptop.Id, ".jpg", "alice", strings.NewReader("kept"))
+	require.NoError(t, err)
+	newID, err := imageStore.Save("new-laptop", ".jpg", "alice", strings.NewReader("new"))
+	require.NoError(t, err)
+	orphanID, err := imageStore.Save("deleted-laptop", ".jpg", "alice", strings.NewReader("orphan"))
+	require.NoError(t, err)
+	imageStore.images[orphanID].UploadTime = time.Now().Add(-2 * time.Hour)
+
+	//保存失败时留下的文件，只有超过宽限期的才会被回收
+	orphanFile := filepath.Join(imageFolder, "lost.jpg")
+	require.NoError(t, os.WriteFile(orphanFile, []byte("lost"), 0644))
+	ageFile(t, orphanFile)
+	writingFile := filepath.Join(imageFolder, "writing.jpg")
+	require.NoError(t, os.WriteFile(writingFile, []byte("writing"), 0644))
+
+	//超时的上传和服务器重启后留下的暂存文件，不是暂存文件的文件不会被删除
+	stale, err := server.uploads.start(laptop.Id, ".jpg", "alice")
+	require.NoError(t, err)
+	active, err := server.uploads.start(laptop.Id, ".jpg", "alice")
+	require.NoError(t, err)
+	stale.updatedAt = time.Now().Add(-2 * time.Hour)
+	strayFile := filepath.Join(uploadFolder, uploadFilePrefix+uuid.NewString()+"-123")
+	require.NoError(t, os.WriteFile(strayFile, []byte("stray"), 0644))
+	ageFile(t, strayFile)
+	otherFile := filepath.Join(uploadFolder, "upload-notes.txt")
+	require.NoError(t, os.WriteFile(otherFile, []byte("notes"), 0644))
+	ageFile(t, otherFile)
+
+	expected := []string{orphanID, strayFile, orphanFile, stale.id}
+	sort.Strings(expected)
+
+	//dry run只列出会被删除的数据
+	res, err := server.CollectImageGarbage(context.Background(), &pb.CollectImageGarbageRequest{DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, res.GetRemoved(), len(expected))
+	require.Equal(t, uint64(len("orphan")+len("lost")+len("stray")), res.GetFreedBytes())
+	for _, garbage := range res.GetRemoved() {
+		if garbage.GetName() == orphanID {
+			require.Equal(t, pb.ImageGarbage_ORPHAN_IMAGE, garbage.GetKind())
+			require.Equal(t, "deleted-laptop", garbage.GetLaptopId())
+		}
+	}
+	require.FileExists(t, orphanFile)
+	require.NotNil(t, server.uploads.find(stale.id))
+
+	report, err := server.collectImageGarbage(false)
+	require.NoError(t, err)
+	require.Equal(t, expected, garbageNames(report))
+	require.Zero(t, report.Failed)
+
+	for _, imageID := range []string{keptID, newID} {
+		info, err := imageStore.Find(imageID)
+		require.NoError(t, err)
+		require.NotNil(t, info)
+	}
+	info, err := imageStore.Find(orphanID)
+	require.NoError(t, err)
+	require.Nil(t, info)
+	require.NoFileExists(t, orphanFile)
+	require.FileExists(t, writingFile)
+	require.Nil(t, server.uploads.find(stale.id))
+	require.NotNil(t, server.uploads.find(active.id))
+	require.NoFileExists(t, strayFile)
+	require.FileExists(t, otherFile)
+
+	report, err = server.collectImageGarbage(false)
+	require.NoError(t, err)
+	require.Empty(t, report.Removed)
+}
+
+func TestCollectImageGarbageKeepsImagesOfUnknownLaptops(t *testing.T) {
+	t.Parallel()
+
+	imageFolder := t.TempDir()
+	imageStore, err := NewDiskImageStore(imageFolder)
+	require.NoError(t, err)
+
+	//图像属于另一个副本的电脑，本地的电脑store中没有这台电脑
+	server := NewLaptopServer(NewInMemoryLaptopStore(), imageStore, NewInMemoryRatingStore())
+	server.SetUploadFolder(t.TempDir())
+	server.SetImageGCOptions(ImageGCOptions{Interval: time.Hour, GracePeriod: time.Hour})
+	imageID, err := imageStore.Save("other-replica-laptop", ".jpg", "alice", strings.NewReader("image"))
+	require.NoError(t, err)
+	imageStore.images[imageID].UploadTime = time.Now().Add(-2 * time.Hour)
+
+	//没有图像信息引用的文件仍然会被回收
+	orphanFile := filepath.Join(imageFolder, "lost.jpg")
+	require.NoError(t, os.WriteFile(orphanFile, []byte("lost"), 0644))
+	ageFile(t, orphanFile)
+
+	report, err := server.collectImageGarbage(false)
+	require.NoError(t, err)
+	require.Equal(t, []string{orphanFile}, garbageNames(report))
+	info, err := imageStore.Find(imageID)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+}
+
+func TestContentAddressedImageStoreOrphanFiles(t *testing.T) {
+	t.Parallel()
+
+	folder := t.TempDir()
+	store, err := NewContentAddressedImageStore(folder)
+	require.NoError(t, err)
+	imageID, err := store.Save("laptop1", ".jpg", "alice", strings.NewReader("photo"))
+	require.NoError(t, err)
+	info, err := store.Find(imageID)
+	require.NoError(t, err)
+
+	//删除图像后manifest已经更新，但是blob没有删除
+	lostBlob := store.blobPath("ab" + strings.Repeat("0", 62))
+	require.NoError(t, os.MkdirAll(filepath.Dir(lostBlob), 0755))
+	require.NoError(t, os.WriteFile(lostBlob, []byte("lost"), 0644))
+	tmpFile := filepath.Join(folder, blobTmpFolderName, "blob-1")
+	require.NoError(t, os.WriteFile(tmpFile, []byte("tmp"), 0644))
+
+	files, err := store.orphanFiles()
+	require.NoError(t, err)
+	var paths []string
+	for _, file := range files {
+		require.Equal(t, OrphanFile, file.Kind)
+		paths = append(paths, file.Name)
+	}
+	require.ElementsMatch(t, []string{lostBlob, tmpFile}, paths)
+
+	require.ErrorIs(t, store.removeOrphanFile(info.Path), errFileInUse)
+	require.NoError(t, store.removeOrphanFile(lostBlob))
+	require.NoFileExists(t, lostBlob)
+	require.FileExists(t, info.Path)
+}
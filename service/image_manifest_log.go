@@ -0,0 +1,302 @@
+//图像信息的修改日志，每次修改只追加一条记录，记录足够多时再压缩到manifest
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"grpctest/pb"
+	"grpctest/serializer"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	imageManifestLogPrefix       = "manifest-"
+	imageManifestLogSuffix       = ".log"
+	defaultImageManifestLogLimit = 1000 //日志中累积了这么多条记录后压缩到manifest
+)
+
+//imageManifestLog和FileLaptopStore的预写日志一样，记录的格式也相同
+//manifest包含了编号小于它的generation的所有日志，压缩时切换到下一个编号的日志文件，在store的锁外写manifest
+type imageManifestLog struct {
+	imageFolder  string
+	compactEvery int
+
+	//mutex保护下面的字段，追加时调用方已经持有store的写锁
+	mutex      sync.Mutex
+	generation uint64 //当前日志文件的编号
+	size       int64  //当前日志文件的长度，追加失败时截回这个长度
+	records    int    //manifest之后累积的记录数量
+	failed     error  //追加失败后没能撤销，不再接受写入
+
+	compactMutex sync.Mutex //同一时间只压缩一次
+}
+
+//读取manifest，然后按顺序回放之后的日志，返回所有图像信息和继续记录修改的日志
+func openImageManifest(imageFolder string) (map[string]*ImageInfo, *imageManifestLog, error) {
+	manifest := &pb.ImageManifest{}
+	manifestPath := filepath.Join(imageFolder, imageManifestName)
+	if _, err := os.Stat(manifestPath); err == nil {
+		if err := serializer.ReadProtobufFromBinaryFile(manifest, manifestPath); err != nil {
+			return nil, nil, fmt.Errorf("cannot load image manifest: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("cannot load image manifest: %w", err)
+	}
+
+	manifestLog := &imageManifestLog{
+		imageFolder:  imageFolder,
+		compactEvery: defaultImageManifestLogLimit,
+		generation:   manifest.GetGeneration(),
+	}
+	images := make(map[string]*ImageInfo)
+	for _, record := range manifest.GetImages() {
+		images[record.GetId()] = imageInfoFromRecord(record, manifestLog.filePath)
+	}
+
+	generations, err := manifestLog.generations()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, generation := range generations {
+		if generation < manifest.GetGeneration() {
+			//已经包含在manifest中，上次压缩之后还没来得及删除
+			if err := os.Remove(manifestLog.path(generation)); err != nil {
+				return nil, nil, fmt.Errorf("cannot remove compacted image manifest log: %w", err)
+			}
+			continue
+		}
+
+		last := i == len(generations)-1
+		records, size, err := manifestLog.replay(generation, last, images)
+		if err != nil {
+			return nil, nil, err
+		}
+		manifestLog.generation = generation
+		manifestLog.size = size
+		manifestLog.records += records
+	}
+	return images, manifestLog, nil
+}
+
+//返回图像文件夹中所有日志文件的编号，从小到大排列
+func (manifestLog *imageManifestLog) generations() ([]uint64, error) {
+	entries, err := os.ReadDir(manifestLog.imageFolder)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image folder: %w", err)
+	}
+
+	var generations []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, imageManifestLogPrefix) || !strings.HasSuffix(name, imageManifestLogSuffix) {
+			continue
+		}
+		generation, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, imageManifestLogPrefix), imageManifestLogSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+	return generations, nil
+}
+
+func (manifestLog *imageManifestLog) path(generation uint64) string {
+	name := fmt.Sprintf("%s%020d%s", imageManifestLogPrefix, generation, imageManifestLogSuffix)
+	return filepath.Join(manifestLog.imageFolder, name)
+}
+
+//把记录中相对于图像文件夹的文件名转换为路径
+func (manifestLog *imageManifestLog) filePath(name string) string {
+	return filepath.Join(manifestLog.imageFolder, name)
+}
+
+//把路径转换为记录中相对于图像文件夹的文件名
+func (manifestLog *imageManifestLog) fileName(path string) (string, error) {
+	name, err := filepath.Rel(manifestLog.imageFolder, path)
+	if err != nil {
+		return "", fmt.Errorf("image %s is not in the image folder: %w", path, err)
+	}
+	return name, nil
+}
+
+//回放一个日志文件，返回其中完整的记录数量和它们的总长度
+//最后一个日志文件末尾不完整的记录是崩溃时没有写完的，直接截掉；其他日志文件损坏时返回ErrCorruptedLog
+func (manifestLog *imageManifestLog) replay(generation uint64, last bool, images map[string]*ImageInfo) (int, int64, error) {
+	path := manifestLog.path(generation)
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot open image manifest log: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	records := 0
+	for {
+		payload, size, err := readWALFrame(reader)
+		record := &pb.ImageManifestRecord{}
+		if err == nil {
+			err = proto.Unmarshal(payload, record)
+		}
+		if err == io.EOF {
+			return records, offset, nil
+		}
+		if err != nil {
+			if !last {
+				return 0, 0, fmt.Errorf("%w: %s at offset %d: %v", ErrCorruptedLog, path, offset, err)
+			}
+			log.Printf("truncate torn record in %s at offset %d: %v", path, offset, err)
+			if err := file.Truncate(offset); err != nil {
+				return 0, 0, fmt.Errorf("cannot truncate image manifest log: %w", err)
+			}
+			if err := file.Sync(); err != nil {
+				return 0, 0, fmt.Errorf("cannot sync image manifest log: %w", err)
+			}
+			return records, offset, nil
+		}
+
+		switch r := record.GetRecord().(type) {
+		case *pb.ImageManifestRecord_Put:
+			images[r.Put.GetId()] = imageInfoFromRecord(r.Put, manifestLog.filePath)
+		case *pb.ImageManifestRecord_DeleteId:
+			delete(images, r.DeleteId)
+		}
+		offset += size
+		records++
+	}
+}
+
+//记录保存或者修改之后的图像，调用方需要持有store的写锁
+func (manifestLog *imageManifestLog) put(info *ImageInfo) error {
+	record, err := imageRecordFromInfo(info, manifestLog.fileName)
+	if err != nil {
+		return err
+	}
+	return manifestLog.append(&pb.ImageManifestRecord{Record: &pb.ImageManifestRecord_Put{Put: record}})
+}
+
+//记录被删除的图像，调用方需要持有store的写锁
+func (manifestLog *imageManifestLog) delete(imageID string) error {
+	return manifestLog.append(&pb.ImageManifestRecord{Record: &pb.ImageManifestRecord_DeleteId{DeleteId: imageID}})
+}
+
+//追加一条记录并同步到磁盘，失败时截回追加之前的长度
+//调用方需要持有store的写锁，日志中记录的顺序和内存中修改的顺序相同
+func (manifestLog *imageManifestLog) append(record *pb.ImageManifestRecord) error {
+	payload, err := proto.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot marshal image manifest record: %w", err)
+	}
+	header := walHeader(payload)
+
+	manifestLog.mutex.Lock()
+	defer manifestLog.mutex.Unlock()
+
+	if manifestLog.failed != nil {
+		return manifestLog.failed
+	}
+	if err := manifestLog.write(header, payload); err != nil {
+		return fmt.Errorf("cannot write image manifest log: %w", manifestLog.rollback(err))
+	}
+	manifestLog.size += int64(len(header) + len(payload))
+	manifestLog.records++
+	return nil
+}
+
+//store没有Close，每次追加都重新打开日志文件，不会一直占用文件描述符
+//调用方需要持有mutex
+func (manifestLog *imageManifestLog) write(header, payload []byte) error {
+	file, err := os.OpenFile(manifestLog.path(manifestLog.generation), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(header, payload...))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && manifestLog.size == 0 { //新建的日志文件
+		err = syncDir(manifestLog.imageFolder)
+	}
+	return err
+}
+
+//把日志截回追加之前的长度，返回cause
+//截断也失败时记录可能留在日志中，不再接受写入
+//调用方需要持有mutex
+func (manifestLog *imageManifestLog) rollback(cause error) error {
+	file, err := os.OpenFile(manifestLog.path(manifestLog.generation), os.O_WRONLY, 0644)
+	if os.IsNotExist(err) && manifestLog.size == 0 {
+		return cause
+	}
+	if err == nil {
+		err = file.Truncate(manifestLog.size)
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+	}
+	if err != nil {
+		manifestLog.failed = fmt.Errorf("image manifest log is unusable after %v, cannot truncate it: %w", cause, err)
+		return manifestLog.failed
+	}
+	return cause
+}
+
+//日志中的记录足够多时把images写到manifest，然后删除已经包含在manifest中的日志
+//持有storeMutex时只复制图像信息并切换到下一个日志文件，序列化和写文件都在锁外进行
+//调用方不能持有storeMutex，压缩失败只会记录日志，之前的日志文件仍然保留
+func (manifestLog *imageManifestLog) compact(storeMutex sync.Locker, images map[string]*ImageInfo) {
+	if !manifestLog.compactMutex.TryLock() { //另一个修改正在压缩
+		return
+	}
+	defer manifestLog.compactMutex.Unlock()
+
+	storeMutex.Lock()
+	manifestLog.mutex.Lock()
+	if manifestLog.failed != nil || manifestLog.compactEvery <= 0 || manifestLog.records < manifestLog.compactEvery {
+		manifestLog.mutex.Unlock()
+		storeMutex.Unlock()
+		return
+	}
+	//SaveRendition会修改store中的图像信息，所以要复制
+	copied := make([]*ImageInfo, 0, len(images))
+	for _, info := range images {
+		copied = append(copied, info.clone())
+	}
+	manifestLog.generation++
+	manifestLog.size = 0
+	manifestLog.records = 0
+	generation := manifestLog.generation
+	manifestLog.mutex.Unlock()
+	storeMutex.Unlock()
+
+	if err := writeImageManifest(manifestLog.imageFolder, copied, generation); err != nil {
+		log.Printf("cannot compact image manifest log: %v", err)
+		return
+	}
+	generations, err := manifestLog.generations()
+	if err != nil {
+		log.Printf("cannot compact image manifest log: %v", err)
+		return
+	}
+	for _, old := range generations {
+		if old < generation {
+			if err := os.Remove(manifestLog.path(old)); err != nil {
+				log.Printf("cannot remove compacted image manifest log: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageManifestLogCompact(t *testing.T) {
+	t.Parallel()
+
+	folder := t.TempDir()
+	store, err := NewDiskImageStore(folder)
+	require.NoError(t, err)
+	store.manifest.compactEvery = 3
+
+	var imageIDs []string
+	for i := 0; i < 7; i++ {
+		imageID, err := store.Save("laptop", ".jpg", "user1", strings.NewReader(fmt.Sprintf("image %d", i)))
+		require.NoError(t, err)
+		imageIDs = append(imageIDs, imageID)
+	}
+	require.NoError(t, store.Delete(imageIDs[0]))
+	rendition := &Rendition{Name: "small", Type: ".jpg", Width: 1, Height: 1, Data: []byte("small")}
+	require.NoError(t, store.SaveRendition(imageIDs[1], rendition))
+
+	//9次修改压缩了3次，manifest之后的日志是空的，旧日志都已经删除
+	require.FileExists(t, filepath.Join(folder, imageManifestName))
+	generations, err := store.manifest.generations()
+	require.NoError(t, err)
+	require.Empty(t, generations)
+	require.EqualValues(t, 3, store.manifest.generation)
+
+	//再修改一次，重启后从manifest和日志恢复
+	require.NoError(t, store.Delete(imageIDs[2]))
+	generations, err = store.manifest.generations()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3}, generations)
+
+	expected, err := store.all()
+	require.NoError(t, err)
+	reloaded, err := NewDiskImageStore(folder)
+	require.NoError(t, err)
+	requireSameImages(t, expected, reloaded)
+	require.Equal(t, 1, reloaded.manifest.records)
+
+	report, err := reloaded.Reconcile()
+	require.NoError(t, err)
+	require.Empty(t, report.OrphanFiles)
+	require.Empty(t, report.MissingFiles)
+}
+
+func TestImageManifestLogTruncatesTornRecord(t *testing.T) {
+	t.Parallel()
+
+	folder := t.TempDir()
+	store, err := NewDiskImageStore(folder)
+	require.NoError(t, err)
+	_, err = store.Save("laptop", ".jpg", "user1", strings.NewReader("image"))
+	require.NoError(t, err)
+	expected, err := store.all()
+	require.NoError(t, err)
+
+	//崩溃时最后一条记录只写了一半
+	path := store.manifest.path(store.manifest.generation)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{42, 0, 0, 0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	reloaded, err := NewDiskImageStore(folder)
+	require.NoError(t, err)
+	requireSameImages(t, expected, reloaded)
+
+	//截掉不完整的记录之后可以继续追加
+	imageID, err := reloaded.Save("laptop", ".png", "user1", strings.NewReader("other"))
+	require.NoError(t, err)
+	reloaded, err = NewDiskImageStore(folder)
+	require.NoError(t, err)
+	info, err := reloaded.Find(imageID)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+}
+
+func requireSameImages(t *testing.T, expected []*ImageInfo, store *DiskImageStore) {
+	images, err := store.all()
+	require.NoError(t, err)
+	require.Len(t, images, len(expected))
+	for i, info := range images {
+		require.True(t, expected[i].UploadTime.Equal(info.UploadTime))
+		info.UploadTime = expected[i].UploadTime
+		require.Equal(t, expected[i], info)
+	}
+}
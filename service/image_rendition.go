@@ -0,0 +1,190 @@
+//根据上传的原图生成不同尺寸的缩略图
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" //注册GIF解码器
+	"image/jpeg"
+	"image/png"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrCannotRender is returned when no rendition can be generated from the image
+var ErrCannotRender = errors.New("cannot render image")
+
+const (
+	maxRenditionPixels = 40 << 20 //原图像素超过这个数量时不生成缩略图，防止解码占用太多内存
+	renditionQuality   = 85       //JPEG缩略图的质量
+)
+
+// RenditionSpec describes a rendition whose longer side is at most MaxSize pixels
+type RenditionSpec struct {
+	Name    string
+	MaxSize int
+}
+
+// DefaultRenditions are the renditions generated when the server is not configured otherwise
+var DefaultRenditions = []RenditionSpec{
+	{Name: "small", MaxSize: 128},
+	{Name: "medium", MaxSize: 512},
+}
+
+//尺寸名称会成为文件名的一部分，只允许小写字母和数字
+var renditionNamePattern = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// ParseRenditions parses renditions like "small=128,medium=512", an empty string means no renditions
+func ParseRenditions(value string) ([]RenditionSpec, error) {
+	var specs []RenditionSpec
+	names := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, size, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("rendition %q must look like name=size", item)
+		}
+		if !renditionNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("rendition name %q must contain only lowercase letters and digits", name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate rendition %q", name)
+		}
+		maxSize, err := strconv.Atoi(size)
+		if err != nil || maxSize <= 0 {
+			return nil, fmt.Errorf("rendition size %q must be a positive integer", size)
+		}
+		names[name] = true
+		specs = append(specs, RenditionSpec{Name: name, MaxSize: maxSize})
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	return specs, nil
+}
+
+// Rendition is a generated rendition before it is saved to the image store
+type Rendition struct {
+	Name   string
+	Type   string //缩略图的扩展名，可能和原图不同
+	Width  int
+	Height int
+	Data   []byte
+}
+
+//解码原图并生成所有尺寸的缩略图
+//只支持标准库能解码的JPEG、PNG和GIF，GIF只使用第一帧；原图比缩略图小时不放大
+func generateRenditions(data io.ReadSeeker, specs []RenditionSpec) ([]*Rendition, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	config, format, err := image.DecodeConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCannotRender, err)
+	}
+	if config.Width*config.Height > maxRenditionPixels {
+		return nil, fmt.Errorf("%w: image is too large: %dx%d", ErrCannotRender, config.Width, config.Height)
+	}
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("cannot seek image: %w", err)
+	}
+	src, _, err := image.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCannotRender, err)
+	}
+
+	//JPEG没有透明度，其他格式的缩略图用PNG保存以保留透明度
+	imageType := ".png"
+	if format == "jpeg" {
+		imageType = ".jpg"
+	}
+
+	var renditions []*Rendition
+	for _, spec := range specs {
+		dst := resizeImage(src, spec.MaxSize)
+		var buffer bytes.Buffer
+		if imageType == ".jpg" {
+			err = jpeg.Encode(&buffer, dst, &jpeg.Options{Quality: renditionQuality})
+		} else {
+			err = png.Encode(&buffer, dst)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode rendition %s: %w", spec.Name, err)
+		}
+		renditions = append(renditions, &Rendition{
+			Name:   spec.Name,
+			Type:   imageType,
+			Width:  dst.Bounds().Dx(),
+			Height: dst.Bounds().Dy(),
+			Data:   buffer.Bytes(),
+		})
+	}
+	return renditions, nil
+}
+
+//按比例缩小图像，让长边不超过maxSize
+//每个目标像素取原图中对应区域所有像素的平均值，缩小很多倍时也不会出现锯齿
+func resizeImage(src image.Image, maxSize int) *image.RGBA {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	width, height := srcWidth, srcHeight
+	if width > maxSize || height > maxSize {
+		if width >= height {
+			width, height = maxSize, srcHeight*maxSize/srcWidth
+		} else {
+			width, height = srcWidth*maxSize/srcHeight, maxSize
+		}
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	//先转换成RGBA，在预乘alpha的颜色上求平均，透明像素不会让边缘变暗
+	rgba := image.NewRGBA(image.Rect(0, 0, srcWidth, srcHeight))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	if width == srcWidth && height == srcHeight {
+		return rgba
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, (y+1)*srcHeight/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, (x+1)*srcWidth/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride+x0*4 : sy*rgba.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			count := (y1 - y0) * (x1 - x0)
+			offset := dst.PixOffset(x, y)
+			for i := range sum {
+				dst.Pix[offset+i] = uint8((sum[i] + count/2) / count)
+			}
+		}
+	}
+	return dst
+}
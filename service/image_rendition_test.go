@@ -0,0 +1,55 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRenditions(t *testing.T) {
+	t.Parallel()
+
+	specs, err := ParseRenditions("medium=512, small=128")
+	require.NoError(t, err)
+	require.Equal(t, []RenditionSpec{{"medium", 512}, {"small", 128}}, specs)
+
+	specs, err = ParseRenditions("")
+	require.NoError(t, err)
+	require.Empty(t, specs)
+
+	for _, value := range []string{"small", "small=0", "small=x", "../small=128", "small=128,small=64"} {
+		_, err := ParseRenditions(value)
+		require.Error(t, err, value)
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	t.Parallel()
+
+	//左半边黑色，右半边白色
+	src := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 400; x++ {
+			if x >= 200 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	dst := resizeImage(src, 100)
+	require.Equal(t, image.Rect(0, 0, 100, 25), dst.Bounds())
+	require.Equal(t, color.RGBA{0, 0, 0, 255}, dst.RGBAAt(0, 0))
+	require.Equal(t, color.RGBA{255, 255, 255, 255}, dst.RGBAAt(99, 24))
+
+	//比目标尺寸小的图像不会放大
+	dst = resizeImage(src, 1000)
+	require.Equal(t, src.Bounds(), dst.Bounds())
+
+	_, err := generateRenditions(strings.NewReader("RIFF\x24\x00\x00\x00WEBPVP8 "), DefaultRenditions)
+	require.ErrorIs(t, err, ErrCannotRender)
+}
@@ -3,68 +3,556 @@ package service
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"grpctest/pb"
+	"grpctest/serializer"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type ImageStore interface {
-	//保存电脑图像
-	Save(laptopID string, imageType string, imageData bytes.Buffer) (string, error)
+	//保存电脑图像，owner是上传图像的用户
+	Save(laptopID string, imageType string, owner string, imageData io.Reader) (string, error)
+	//通过图像id查找图像信息，找不到时返回nil
+	Find(imageID string) (*ImageInfo, error)
+	//保存根据图像生成的缩略图，同名的缩略图会被替换
+	SaveRendition(imageID string, rendition *Rendition) error
+	//打开图像，从第offset个字节开始读取，rendition不为空时打开该尺寸的缩略图
+	Open(imageID string, rendition string, offset int64) (io.ReadCloser, error)
+	//返回一台电脑的所有图像，按图像id排序
+	List(laptopID string) ([]*ImageInfo, error)
+	//删除图像，图像不存在时返回ErrNotFound
+	Delete(imageID string) error
+	//返回用户上传的图像数量和总字节数
+	Usage(owner string) (*ImageUsage, error)
+}
+
+// ImageUsage is the storage used by the images of a user
+type ImageUsage struct {
+	Images int   //图像数量
+	Bytes  int64 //原图的总字节数，缩略图不计算在内
+}
+
+//统计owner上传的图像，调用方需要持有读锁
+func imageUsage(images map[string]*ImageInfo, owner string) *ImageUsage {
+	usage := &ImageUsage{}
+	for _, info := range images {
+		if info.Owner == owner {
+			usage.Images++
+			usage.Bytes += info.Size
+		}
+	}
+	return usage
+}
+
+const imageManifestName = "manifest.bin" //图像文件夹中保存所有图像信息的文件
+
+//manifest、写manifest时的临时文件和manifest之后的日志都不是图像文件
+func isImageManifestFile(name string) bool {
+	return strings.HasPrefix(name, imageManifestName) || strings.HasPrefix(name, imageManifestLogPrefix)
 }
 
 //将图片保存到磁盘,并将其信息存储在内存中。
+//图像信息的修改追加到图像文件夹中的日志，定期压缩到manifest，重启后从manifest和日志恢复
 type DiskImageStore struct{
 	mutex sync.RWMutex
 	imageFolder string
 	images map[string]*ImageInfo	//key是图像id,va是图片的信息。
+	manifest *imageManifestLog
 }
 
 //
 type ImageInfo struct {
-	LaptopID string
+	ID         string
+	LaptopID   string
+	Owner      string //上传图像的用户名
+	Type       string
+	Path       string           //在磁盘上生成图像的路径。
+	Size       int64            //图像字节大小
+	Checksum   string           //图像内容的SHA-256，十六进制
+	UploadTime time.Time        //上传的时间
+	Renditions []*RenditionInfo //已经生成的缩略图，按名称排序
+}
+
+// RenditionInfo is the information of a rendition saved next to the original image
+type RenditionInfo struct {
+	Name     string
 	Type     string
-	Path     string			//在磁盘上生成图像的路径。
+	Path     string
+	Size     int64
+	Checksum string //缩略图内容的SHA-256，十六进制
+	Width    int
+	Height   int
+}
+
+// Rendition returns the rendition with the given name, or nil if it has not been generated
+func (info *ImageInfo) Rendition(name string) *RenditionInfo {
+	for _, rendition := range info.Renditions {
+		if rendition.Name == name {
+			return rendition
+		}
+	}
+	return nil
+}
+
+//返回图像信息的副本，调用方修改副本不会影响store中的信息
+func (info *ImageInfo) clone() *ImageInfo {
+	other := *info
+	other.Renditions = nil
+	for _, rendition := range info.Renditions {
+		copied := *rendition
+		other.Renditions = append(other.Renditions, &copied)
+	}
+	return &other
 }
 
-func NewDiskImageStore(imageFolder string) *DiskImageStore {
+// NewDiskImageStore returns a store that saves images in imageFolder and loads the images saved before
+func NewDiskImageStore(imageFolder string) (*DiskImageStore, error) {
+	if err := os.MkdirAll(imageFolder, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create image folder: %w", err)
+	}
+
+	images, manifest, err := openImageManifest(imageFolder)
+	if err != nil {
+		return nil, err
+	}
 	return &DiskImageStore{
 		imageFolder: imageFolder,
-		images:      make(map[string]*ImageInfo),
+		images:      images,
+		manifest:    manifest,
+	}, nil
+}
+
+//把所有图像信息写到图像文件夹中的manifest，先写临时文件再重命名，崩溃时不会留下不完整的manifest
+//文件路径保存为相对于图像文件夹的路径，manifest包含了编号小于generation的所有日志
+func writeImageManifest(imageFolder string, images []*ImageInfo, generation uint64) error {
+	fileName := func(path string) (string, error) {
+		name, err := filepath.Rel(imageFolder, path)
+		if err != nil {
+			return "", fmt.Errorf("image %s is not in the image folder: %w", path, err)
+		}
+		return name, nil
+	}
+
+	manifest := &pb.ImageManifest{Generation: generation}
+	for _, info := range images {
+		record, err := imageRecordFromInfo(info, fileName)
+		if err != nil {
+			return err
+		}
+		manifest.Images = append(manifest.Images, record)
+	}
+	sort.Slice(manifest.Images, func(i, j int) bool { return manifest.Images[i].Id < manifest.Images[j].Id })
+
+	manifestPath := filepath.Join(imageFolder, imageManifestName)
+	tmpPath := manifestPath + ".tmp"
+	if err := serializer.WriteProtobufToBinaryFile(manifest, tmpPath); err != nil {
+		return err
+	}
+	if err := syncFile(tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		return fmt.Errorf("cannot rename image manifest: %w", err)
+	}
+	return syncDir(imageFolder)
+}
+
+//把保存的图像记录转换为图像信息，path把记录中的文件名转换为路径
+func imageInfoFromRecord(record *pb.ImageRecord, path func(name string) string) *ImageInfo {
+	var renditions []*RenditionInfo
+	for _, rendition := range record.GetRenditions() {
+		renditions = append(renditions, &RenditionInfo{
+			Name:     rendition.GetName(),
+			Type:     rendition.GetImageType(),
+			Path:     path(rendition.GetFileName()),
+			Size:     int64(rendition.GetSize()),
+			Checksum: rendition.GetSha256(),
+			Width:    int(rendition.GetWidth()),
+			Height:   int(rendition.GetHeight()),
+		})
+	}
+	return &ImageInfo{
+		ID:         record.GetId(),
+		LaptopID:   record.GetLaptopId(),
+		Owner:      record.GetOwner(),
+		Type:       record.GetImageType(),
+		Path:       path(record.GetFileName()),
+		Size:       int64(record.GetSize()),
+		Checksum:   record.GetSha256(),
+		UploadTime: record.GetUploadTime().AsTime(),
+		Renditions: renditions,
 	}
 }
 
+//把图像信息转换为保存的图像记录，fileName把路径转换为记录中的文件名
+func imageRecordFromInfo(info *ImageInfo, fileName func(path string) (string, error)) (*pb.ImageRecord, error) {
+	name, err := fileName(info.Path)
+	if err != nil {
+		return nil, err
+	}
+	record := &pb.ImageRecord{
+		Id:         info.ID,
+		LaptopId:   info.LaptopID,
+		ImageType:  info.Type,
+		FileName:   name,
+		Size:       uint64(info.Size),
+		Sha256:     info.Checksum,
+		UploadTime: timestamppb.New(info.UploadTime),
+		Owner:      info.Owner,
+	}
+	for _, rendition := range info.Renditions {
+		name, err := fileName(rendition.Path)
+		if err != nil {
+			return nil, err
+		}
+		record.Renditions = append(record.Renditions, &pb.RenditionRecord{
+			Name:      rendition.Name,
+			ImageType: rendition.Type,
+			FileName:  name,
+			Size:      uint64(rendition.Size),
+			Width:     uint32(rendition.Width),
+			Height:    uint32(rendition.Height),
+			Sha256:    rendition.Checksum,
+		})
+	}
+	return record, nil
+}
+
 func (store *DiskImageStore) Save(
 	laptopID string,
 	imageType string,
-	imageData bytes.Buffer,
+	owner string,
+	imageData io.Reader,
 ) (string, error) {
 	imageID, err := uuid.NewRandom()		//为图像生成一个ID。
 	if err != nil {
 		return "", fmt.Errorf("cannot generate image id: %w", err)
 	}
 
-	imagePath := fmt.Sprintf("%s%s%s", store.imageFolder, imageID, imageType)
+	imagePath := filepath.Join(store.imageFolder, imageID.String()+imageType)
+	checksum := sha256.New() //写文件的同时计算校验和
 
-	file, err := os.Create(imagePath)		//	创建文件夹。
+	size, err := writeImageFile(imagePath, io.TeeReader(imageData, checksum))
 	if err != nil {
-		return "", fmt.Errorf("cannot create image file : %w", err)
+		return "", err
+	}
+
+	defer store.manifest.compact(&store.mutex, store.images) //在释放锁之后执行
+	store.mutex.Lock()						//写入内存之前需要获取写锁
+	defer store.mutex.Unlock()
+
+	info := &ImageInfo{		//将图片信息保存到内存中的map中
+		ID:         imageID.String(),
+		LaptopID:   laptopID,
+		Owner:      owner,
+		Type:       imageType,
+		Path:       imagePath,
+		Size:       size,
+		Checksum:   hex.EncodeToString(checksum.Sum(nil)),
+		UploadTime: time.Now(),
+	}
+	if err := store.manifest.put(info); err != nil {
+		os.Remove(imagePath)
+		return "", err
 	}
+	store.images[imageID.String()] = info
+	return imageID.String(),nil
+}
 
-	_,err=imageData.WriteTo(file)			//将图像存入刚刚创建的文件。
+//把图像写到文件并同步到磁盘，写manifest之前图像必须已经在磁盘上
+func writeImageFile(path string, data io.Reader) (int64, error) {
+	file, err := os.Create(path)
 	if err != nil {
-		return "", fmt.Errorf("cannot write image to file: %w", err)
+		return 0, fmt.Errorf("cannot create image file : %w", err)
 	}
 
-	store.mutex.Lock()						//写入内存之前需要获取写锁
+	size, err := io.Copy(file, data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return 0, fmt.Errorf("cannot write image to file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return 0, fmt.Errorf("cannot close image file: %w", err)
+	}
+	return size, nil
+}
+
+// SaveRendition saves the rendition next to the original image, see ImageStore.SaveRendition
+func (store *DiskImageStore) SaveRendition(imageID string, rendition *Rendition) error {
+	if !renditionNamePattern.MatchString(rendition.Name) {
+		return fmt.Errorf("invalid rendition name %q", rendition.Name)
+	}
+	info, err := store.Find(imageID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return ErrNotFound
+	}
+
+	//文件名包含图像id和尺寸名称，和原图放在一起
+	path := filepath.Join(store.imageFolder, imageID+"_"+rendition.Name+rendition.Type)
+	size, err := writeImageFile(path, bytes.NewReader(rendition.Data))
+	if err != nil {
+		return err
+	}
+
+	defer store.manifest.compact(&store.mutex, store.images)
+	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	store.images[imageID.String()]=&ImageInfo{		//将图片信息保存到内存中的map中
-		LaptopID: laptopID,
-		Type: imageType,
-		Path: imagePath,
+	info = store.images[imageID]
+	if info == nil { //写文件的时候图像被删除了
+		os.Remove(path)
+		return ErrNotFound
 	}
-	return imageID.String(),nil
+	checksum := sha256.Sum256(rendition.Data)
+	saved := &RenditionInfo{
+		Name:     rendition.Name,
+		Type:     rendition.Type,
+		Path:     path,
+		Size:     size,
+		Checksum: hex.EncodeToString(checksum[:]),
+		Width:    rendition.Width,
+		Height:   rendition.Height,
+	}
+
+	//替换切片而不是修改它，Find返回的副本不受影响
+	previous := info.Renditions
+	renditions := []*RenditionInfo{saved}
+	for _, other := range previous {
+		if other.Name != rendition.Name {
+			renditions = append(renditions, other)
+		}
+	}
+	sort.Slice(renditions, func(i, j int) bool { return renditions[i].Name < renditions[j].Name })
+	info.Renditions = renditions
+
+	if err := store.manifest.put(info); err != nil {
+		info.Renditions = previous
+		os.Remove(path)
+		return err
+	}
+	for _, other := range previous {
+		if other.Name == rendition.Name && other.Path != path { //同名缩略图换了格式
+			os.Remove(other.Path)
+		}
+	}
+	return nil
+}
+
+// Find returns the information of the image, or nil if there is no such image
+func (store *DiskImageStore) Find(imageID string) (*ImageInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		return nil, nil
+	}
+	return info.clone(), nil
+}
+
+// Open opens the image or rendition file and seeks to offset
+func (store *DiskImageStore) Open(imageID string, rendition string, offset int64) (io.ReadCloser, error) {
+	info, err := store.Find(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, ErrNotFound
+	}
+	path, size := info.Path, info.Size
+	if rendition != "" {
+		saved := info.Rendition(rendition)
+		if saved == nil {
+			return nil, ErrNotFound
+		}
+		path, size = saved.Path, saved.Size
+	}
+	if offset < 0 || offset > size {
+		return nil, fmt.Errorf("offset %d is out of range [0, %d]", offset, size)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image file: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot seek image file: %w", err)
+	}
+	return file, nil
+}
+
+// List returns the images of the laptop ordered by image id
+func (store *DiskImageStore) List(laptopID string) ([]*ImageInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var images []*ImageInfo
+	for _, info := range store.images {
+		if info.LaptopID == laptopID {
+			images = append(images, info.clone())
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images, nil
+}
+
+// Delete removes the image file and its information
+func (store *DiskImageStore) Delete(imageID string) error {
+	defer store.manifest.compact(&store.mutex, store.images)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	info := store.images[imageID]
+	if info == nil {
+		return ErrNotFound
+	}
+
+	//先从manifest中删除，删除文件失败时只会留下一个没有图像信息的文件，Reconcile可以找到它
+	if err := store.manifest.delete(imageID); err != nil {
+		return err
+	}
+	delete(store.images, imageID)
+	for _, rendition := range info.Renditions {
+		if err := os.Remove(rendition.Path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove rendition file: %w", err)
+		}
+	}
+	if err := os.Remove(info.Path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove image file: %w", err)
+	}
+	return nil
+}
+
+// Usage returns the number and the total size of the images uploaded by owner
+func (store *DiskImageStore) Usage(owner string) (*ImageUsage, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return imageUsage(store.images, owner), nil
+}
+
+//返回所有图像，按图像id排序
+func (store *DiskImageStore) all() ([]*ImageInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return sortedImages(store.images), nil
+}
+
+//返回images的副本，按图像id排序，调用方需要持有读锁
+func sortedImages(images map[string]*ImageInfo) []*ImageInfo {
+	sorted := make([]*ImageInfo, 0, len(images))
+	for _, info := range images {
+		sorted = append(sorted, info.clone())
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return sorted
+}
+
+//返回图像文件夹中没有图像信息的文件
+func (store *DiskImageStore) orphanFiles() ([]*ImageGarbage, error) {
+	report, err := store.Reconcile()
+	if err != nil {
+		return nil, err
+	}
+	var garbage []*ImageGarbage
+	for _, path := range report.OrphanFiles {
+		file, err := fileGarbage(OrphanFile, path)
+		if err != nil {
+			return nil, err
+		}
+		if file != nil {
+			garbage = append(garbage, file)
+		}
+	}
+	return garbage, nil
+}
+
+//持有写锁删除文件，Save不会在检查之后开始引用它
+func (store *DiskImageStore) removeOrphanFile(path string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, info := range store.images {
+		if info.Path == path {
+			return errFileInUse
+		}
+		for _, rendition := range info.Renditions {
+			if rendition.Path == path {
+				return errFileInUse
+			}
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove image file: %w", err)
+	}
+	return nil
+}
+
+// ImageReconcileReport lists the differences between the image folder and the image information
+type ImageReconcileReport struct {
+	OrphanFiles  []string     //图像文件夹中没有图像信息的文件
+	MissingFiles []*ImageInfo //有图像信息但是原图或者缩略图文件已经不存在的图像
+}
+
+// Reconcile compares the files in the image folder with the image information without changing either
+func (store *DiskImageStore) Reconcile() (*ImageReconcileReport, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	entries, err := os.ReadDir(store.imageFolder)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image folder: %w", err)
+	}
+
+	known := make(map[string]bool)
+	for _, info := range store.images {
+		known[filepath.Base(info.Path)] = true
+		for _, rendition := range info.Renditions {
+			known[filepath.Base(rendition.Path)] = true
+		}
+	}
+
+	report := &ImageReconcileReport{}
+	files := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || isImageManifestFile(name) {
+			continue
+		}
+		files[name] = true
+		if !known[name] {
+			report.OrphanFiles = append(report.OrphanFiles, filepath.Join(store.imageFolder, name))
+		}
+	}
+
+	for _, info := range store.images {
+		missing := !files[filepath.Base(info.Path)]
+		for _, rendition := range info.Renditions {
+			missing = missing || !files[filepath.Base(rendition.Path)]
+		}
+		if missing {
+			report.MissingFiles = append(report.MissingFiles, info.clone())
+		}
+	}
+	sort.Slice(report.MissingFiles, func(i, j int) bool { return report.MissingFiles[i].ID < report.MissingFiles[j].ID })
+	return report, nil
 }
@@ -0,0 +1,98 @@
+package service_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"grpctest/service"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskImageStoreReload(t *testing.T) {
+	t.Parallel()
+
+	folder := t.TempDir()
+	store, err := service.NewDiskImageStore(folder)
+	require.NoError(t, err)
+
+	data := []byte("not really a jpeg")
+	imageID, err := store.Save("laptop", ".jpg", "user1", bytes.NewReader(data))
+	require.NoError(t, err)
+	deletedID, err := store.Save("laptop", ".png", "user1", strings.NewReader("deleted"))
+	require.NoError(t, err)
+	require.NoError(t, store.Delete(deletedID))
+	rendition := &service.Rendition{Name: "small", Type: ".jpg", Width: 1, Height: 1, Data: []byte("small")}
+	require.NoError(t, store.SaveRendition(imageID, rendition))
+	require.ErrorIs(t, store.SaveRendition(deletedID, rendition), service.ErrNotFound)
+
+	expected, err := store.Find(imageID)
+	require.NoError(t, err)
+	checksum := sha256.Sum256(data)
+	require.Equal(t, hex.EncodeToString(checksum[:]), expected.Checksum)
+	require.EqualValues(t, len(data), expected.Size)
+	require.Len(t, expected.Renditions, 1)
+	require.FileExists(t, expected.Rendition("small").Path)
+
+	//重启后从manifest恢复图像信息
+	reloaded, err := service.NewDiskImageStore(folder)
+	require.NoError(t, err)
+
+	info, err := reloaded.Find(imageID)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+	require.True(t, expected.UploadTime.Equal(info.UploadTime))
+	info.UploadTime = expected.UploadTime
+	require.Equal(t, expected, info)
+
+	info, err = reloaded.Find(deletedID)
+	require.NoError(t, err)
+	require.Nil(t, info)
+
+	images, err := reloaded.List("laptop")
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+}
+
+func TestDiskImageStoreReconcile(t *testing.T) {
+	t.Parallel()
+
+	folder := t.TempDir()
+	store, err := service.NewDiskImageStore(folder)
+	require.NoError(t, err)
+
+	keptID, err := store.Save("laptop", ".jpg", "user1", strings.NewReader("kept"))
+	require.NoError(t, err)
+	missingID, err := store.Save("laptop", ".jpg", "user1", strings.NewReader("missing"))
+	require.NoError(t, err)
+
+	report, err := store.Reconcile()
+	require.NoError(t, err)
+	require.Empty(t, report.OrphanFiles)
+	require.Empty(t, report.MissingFiles)
+
+	//文件被手动删除，或者有不是通过store保存的文件
+	missing, err := store.Find(missingID)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(missing.Path))
+	orphanPath := filepath.Join(folder, "orphan.jpg")
+	require.NoError(t, os.WriteFile(orphanPath, []byte("orphan"), 0644))
+
+	report, err = store.Reconcile()
+	require.NoError(t, err)
+	require.Equal(t, []string{orphanPath}, report.OrphanFiles)
+	require.Len(t, report.MissingFiles, 1)
+	require.Equal(t, missingID, report.MissingFiles[0].ID)
+
+	//Reconcile只报告，不修改图像信息
+	kept, err := store.Find(keptID)
+	require.NoError(t, err)
+	require.NotNil(t, kept)
+	missing, err = store.Find(missingID)
+	require.NoError(t, err)
+	require.NotNil(t, missing)
+}
@@ -0,0 +1,79 @@
+//根据图像内容开头的魔数判断图像的真实类型
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnsupportedImageType is returned when the image content is not a supported format
+var ErrUnsupportedImageType = errors.New("unsupported image type")
+
+// ErrImageTypeMismatch is returned when the image type given by the client is not the detected one
+var ErrImageTypeMismatch = errors.New("image type mismatch")
+
+const imageSniffLen = 12 //判断类型最多需要的字节数，WebP需要12个字节
+
+//支持的图像类型，按顺序检查
+var imageSignatures = []struct {
+	imageType string //保存时使用的扩展名
+	match     func(data []byte) bool
+}{
+	{".jpg", func(data []byte) bool { return bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}) }},
+	{".png", func(data []byte) bool { return bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) }},
+	{".gif", func(data []byte) bool {
+		return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+	}},
+	{".webp", func(data []byte) bool {
+		return len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP"))
+	}},
+}
+
+//根据图像开头的字节返回图像类型，data至少需要imageSniffLen个字节，除非图像本身更短
+func detectImageType(data []byte) (string, error) {
+	for _, signature := range imageSignatures {
+		if signature.match(data) {
+			return signature.imageType, nil
+		}
+	}
+	return "", fmt.Errorf("%w: only jpeg, png, gif and webp are supported", ErrUnsupportedImageType)
+}
+
+//把客户端给出的类型统一成detectImageType返回的形式，例如"JPEG"、"jpg"和".jpeg"都是".jpg"
+func normalizeImageType(imageType string) string {
+	imageType = strings.ToLower(strings.TrimSpace(imageType))
+	imageType = strings.TrimPrefix(imageType, "image/")
+	if imageType != "" && !strings.HasPrefix(imageType, ".") {
+		imageType = "." + imageType
+	}
+	if imageType == ".jpeg" {
+		return ".jpg"
+	}
+	return imageType
+}
+
+//客户端给出的类型是否是支持的类型之一
+func isSupportedImageType(imageType string) bool {
+	imageType = normalizeImageType(imageType)
+	for _, signature := range imageSignatures {
+		if signature.imageType == imageType {
+			return true
+		}
+	}
+	return false
+}
+
+//检查图像内容，返回保存时应该使用的扩展名
+//客户端给出的类型为空时直接使用检测到的类型，否则两者必须一致
+func checkImageType(clientType string, data []byte) (string, error) {
+	detected, err := detectImageType(data)
+	if err != nil {
+		return "", err
+	}
+	if clientType != "" && normalizeImageType(clientType) != detected {
+		return "", fmt.Errorf("%w: image type is %s but the content is %s", ErrImageTypeMismatch, clientType, detected)
+	}
+	return detected, nil
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckImageType(t *testing.T) {
+	t.Parallel()
+
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00, 0x01}
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	webp := []byte("RIFF\x24\x00\x00\x00WEBPVP8 ")
+
+	testCases := []struct {
+		name       string
+		clientType string
+		data       []byte
+		imageType  string
+		err        error
+	}{
+		{"jpeg", ".jpg", jpeg, ".jpg", nil},
+		{"jpeg alias", "JPEG", jpeg, ".jpg", nil},
+		{"mime type", "image/png", png, ".png", nil},
+		{"gif", ".gif", []byte("GIF89a\x01\x00"), ".gif", nil},
+		{"webp", ".webp", webp, ".webp", nil},
+		{"empty client type", "", webp, ".webp", nil},
+		{"mismatch", ".png", jpeg, "", ErrImageTypeMismatch},
+		{"riff but not webp", ".webp", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), "", ErrUnsupportedImageType},
+		{"unsupported", ".jpg", []byte("not an image"), "", ErrUnsupportedImageType},
+		{"too short", ".jpg", []byte{0xff, 0xd8}, "", ErrUnsupportedImageType},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			imageType, err := checkImageType(tc.clientType, tc.data)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.imageType, imageType)
+		})
+	}
+}
@@ -0,0 +1,330 @@
+//可以断点续传的图像上传
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrUploadOffsetMismatch is returned when a chunk doesn't start at the committed offset of the upload
+var ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+
+// ErrChecksumMismatch is returned when the uploaded data doesn't match its checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+const (
+	uploadSessionTimeout = time.Hour //超过这个时间没有收到数据的上传会被丢弃
+	uploadFilePrefix     = "upload-" //暂存文件的名字是upload-<上传id>-<随机数>
+)
+
+var uploadCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+//一次上传，已经确认的数据暂存在磁盘上的临时文件中
+type uploadSession struct {
+	mutex     sync.Mutex
+	id        string
+	laptopID  string
+	owner     string    //开始上传的用户，只有这个用户可以继续上传
+	imageType string    //客户端给出的类型，完成时和检测到的类型比较
+	file      *os.File  //暂存的数据
+	size      int64     //已经确认的字节数
+	header    []byte    //前imageSniffLen个字节，用来尽早检查图像类型
+	hash      hash.Hash //已经确认的数据的SHA-256
+	updatedAt time.Time //最后一次收到数据的时间
+	closed    bool      //上传已经完成或者被丢弃
+}
+
+//保存所有进行中的上传
+//上传只保存在内存中，服务器重启后客户端需要重新开始上传
+type uploadSessions struct {
+	mutex    sync.Mutex
+	folder   string //暂存文件的文件夹，为空时使用系统的临时文件夹
+	sessions map[string]*uploadSession
+}
+
+func newUploadSessions(folder string) *uploadSessions {
+	return &uploadSessions{
+		folder:   folder,
+		sessions: make(map[string]*uploadSession),
+	}
+}
+
+//在上传文件夹中创建一个暂存文件，返回文件和它的上传id
+//UploadImage也用它暂存图像，它的上传id不属于任何上传，服务器中途崩溃时留下的文件由图像回收删除
+func (uploads *uploadSessions) createFile() (*os.File, string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot generate upload id: %w", err)
+	}
+	file, err := os.CreateTemp(uploads.folder, uploadFilePrefix+id.String()+"-*")
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot create upload file: %w", err)
+	}
+	return file, id.String(), nil
+}
+
+//开始一次新的上传，同时丢弃超时的上传
+func (uploads *uploadSessions) start(laptopID string, imageType string, owner string) (*uploadSession, error) {
+	file, id, err := uploads.createFile()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &uploadSession{
+		id:        id,
+		laptopID:  laptopID,
+		owner:     owner,
+		imageType: imageType,
+		file:      file,
+		hash:      sha256.New(),
+		updatedAt: time.Now(),
+	}
+
+	uploads.mutex.Lock()
+	defer uploads.mutex.Unlock()
+
+	for id, other := range uploads.sessions {
+		if other.expired() {
+			delete(uploads.sessions, id)
+			other.close()
+		}
+	}
+	uploads.sessions[session.id] = session
+	return session, nil
+}
+
+//返回进行中的上传，找不到时返回nil
+func (uploads *uploadSessions) find(id string) *uploadSession {
+	uploads.mutex.Lock()
+	defer uploads.mutex.Unlock()
+	return uploads.sessions[id]
+}
+
+//结束上传并删除暂存文件
+func (uploads *uploadSessions) remove(session *uploadSession) {
+	uploads.mutex.Lock()
+	delete(uploads.sessions, session.id)
+	uploads.mutex.Unlock()
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.close()
+}
+
+func (session *uploadSession) expired() bool {
+	return session.idleSince(time.Now().Add(-uploadSessionTimeout))
+}
+
+//是否从before之前就没有再收到数据
+func (session *uploadSession) idleSince(before time.Time) bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.updatedAt.Before(before)
+}
+
+//上传至少保留uploadSessionTimeout，即使垃圾回收的宽限期更短
+func staleUploadTime(before time.Time) time.Time {
+	if timeout := time.Now().Add(-uploadSessionTimeout); timeout.Before(before) {
+		return timeout
+	}
+	return before
+}
+
+//返回before之前就没有再收到数据的上传，以及不属于任何上传的暂存文件
+//服务器重启后上传会丢失，但是暂存文件还留在上传文件夹中
+//系统的临时文件夹中可能有其他服务器的暂存文件，所以只在单独配置的上传文件夹中查找暂存文件
+func (uploads *uploadSessions) staleUploads(before time.Time) ([]*ImageGarbage, error) {
+	var entries []os.DirEntry
+	if uploads.folder != "" {
+		var err error
+		entries, err = os.ReadDir(uploads.folder)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read upload folder: %w", err)
+		}
+	}
+
+	uploads.mutex.Lock()
+	sessions := make([]*uploadSession, 0, len(uploads.sessions))
+	for _, session := range uploads.sessions {
+		sessions = append(sessions, session)
+	}
+	uploads.mutex.Unlock()
+
+	var garbage []*ImageGarbage
+	sessionTime := staleUploadTime(before)
+	for _, session := range sessions {
+		session.mutex.Lock()
+		if !session.closed && session.updatedAt.Before(sessionTime) {
+			garbage = append(garbage, &ImageGarbage{
+				Kind:     StaleUpload,
+				Name:     session.id,
+				LaptopID: session.laptopID,
+				Size:     session.size,
+				ModTime:  session.updatedAt,
+			})
+		}
+		session.mutex.Unlock()
+	}
+
+	for _, entry := range entries {
+		uploadID, ok := uploadFileID(entry.Name())
+		if !ok || entry.IsDir() || uploads.find(uploadID) != nil {
+			continue
+		}
+		file, err := fileGarbage(StaleUpload, filepath.Join(uploads.folder, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if file != nil && file.ModTime.Before(before) {
+			garbage = append(garbage, file)
+		}
+	}
+	return garbage, nil
+}
+
+//从暂存文件的名字中取出上传id，不是暂存文件时返回false
+//上传文件夹可能是系统的临时文件夹，所以只认可完全符合格式的文件
+func uploadFileID(name string) (string, bool) {
+	const idLen = 36 //uuid字符串的长度
+	rest := strings.TrimPrefix(name, uploadFilePrefix)
+	if rest == name || len(rest) <= idLen || rest[idLen] != '-' {
+		return "", false
+	}
+	if _, err := uuid.Parse(rest[:idLen]); err != nil {
+		return "", false
+	}
+	return rest[:idLen], true
+}
+
+//删除staleUploads返回的上传或者暂存文件，删除前重新检查它仍然是垃圾
+func (uploads *uploadSessions) removeStale(name string, before time.Time) error {
+	if _, err := uuid.Parse(name); err == nil {
+		session := uploads.find(name)
+		if session == nil {
+			return nil
+		}
+		if !session.idleSince(staleUploadTime(before)) {
+			return fmt.Errorf("upload %s has received new data", name)
+		}
+		uploads.remove(session)
+		return nil
+	}
+
+	uploadID, ok := uploadFileID(filepath.Base(name))
+	if !ok || uploads.folder == "" {
+		return fmt.Errorf("%s is not an upload file", name)
+	}
+	if uploads.find(uploadID) != nil {
+		return errFileInUse
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove upload file: %w", err)
+	}
+	return nil
+}
+
+//调用方需要持有session.mutex，或者session已经不会再被使用
+func (session *uploadSession) close() {
+	if session.closed {
+		return
+	}
+	session.closed = true
+	session.file.Close()
+	os.Remove(session.file.Name())
+}
+
+//返回已经确认的字节数
+func (session *uploadSession) committed() (uint64, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.closed {
+		return 0, ErrNotFound
+	}
+	return uint64(session.size), nil
+}
+
+//把数据块追加到暂存文件，返回已经确认的字节数
+//数据块必须从已经确认的位置开始，校验和不对或者图像类型不对时不会写入
+func (session *uploadSession) write(offset uint64, chunk []byte, checksum uint32) (uint64, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.closed {
+		return 0, ErrNotFound
+	}
+	if offset != uint64(session.size) {
+		return uint64(session.size), fmt.Errorf("%w: chunk offset is %d but committed offset is %d", ErrUploadOffsetMismatch, offset, session.size)
+	}
+	if crc32.Checksum(chunk, uploadCRCTable) != checksum {
+		return uint64(session.size), fmt.Errorf("%w: chunk at offset %d is corrupted", ErrChecksumMismatch, offset)
+	}
+
+	//收到足够的字节后马上检查图像类型
+	if len(session.header) < imageSniffLen {
+		header := append(session.header[:len(session.header):len(session.header)], chunk...)
+		if len(header) > imageSniffLen {
+			header = header[:imageSniffLen]
+		}
+		if len(header) == imageSniffLen {
+			if _, err := checkImageType(session.imageType, header); err != nil {
+				return uint64(session.size), err
+			}
+		}
+		session.header = header
+	}
+
+	if _, err := session.file.WriteAt(chunk, session.size); err != nil {
+		//写了一部分时截断到原来的长度，已经确认的数据不受影响
+		session.file.Truncate(session.size)
+		return uint64(session.size), fmt.Errorf("cannot write upload file: %w", err)
+	}
+	session.hash.Write(chunk)
+	session.size += int64(len(chunk))
+	session.updatedAt = time.Now()
+	return uint64(session.size), nil
+}
+
+//检查整个图像的SHA-256和图像类型，然后把暂存的数据交给save保存
+//数据不对或者save成功时结束上传；save失败时上传仍然保留，客户端可以再次尝试完成
+func (uploads *uploadSessions) finish(
+	session *uploadSession,
+	checksum string,
+	save func(imageType string, data io.ReadSeeker, size int64) error,
+) error {
+	session.mutex.Lock()
+	if session.closed {
+		session.mutex.Unlock()
+		return ErrNotFound
+	}
+	imageType, err := session.verify(checksum)
+	if err == nil {
+		if err := save(imageType, io.NewSectionReader(session.file, 0, session.size), session.size); err != nil {
+			session.mutex.Unlock()
+			return err
+		}
+	}
+	session.mutex.Unlock()
+
+	uploads.remove(session)
+	return err
+}
+
+//检查SHA-256和图像类型，返回保存时使用的扩展名
+func (session *uploadSession) verify(checksum string) (string, error) {
+	if actual := hex.EncodeToString(session.hash.Sum(nil)); actual != checksum {
+		return "", fmt.Errorf("%w: sha256 of the uploaded image is %s", ErrChecksumMismatch, actual)
+	}
+	return checkImageType(session.imageType, session.header) //图像比imageSniffLen还短时在这里检查
+}
@@ -2,20 +2,34 @@ package service_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"grpctest/client"
 	"grpctest/pb"
 	"grpctest/sample"
 	"grpctest/serializer"
 	"grpctest/service"
+	"hash/crc32"
+	"image/jpeg"
 	"io"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func TestClientCreateLaptop(t *testing.T) {
@@ -119,9 +133,252 @@ func TestClientSearchLaptop(t *testing.T) {
 
 }
 
+func TestClientSearchLaptopSorted(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+	filter := &pb.Filter{MaxPriceUsd: 5000}
+
+	//价格依次为1000,1100,...,1900，评分正好相反
+	n := 10
+	laptops := make([]*pb.Laptop, n)
+	for i := 0; i < n; i++ {
+		laptop := sample.NewLaptop()
+		laptop.PriceUsd = 1000 + float64(i)*100
+		laptop.Cpu.NumberCores = 4
+		laptop.Cpu.MinGhz = 2.5
+		laptop.Ram = &pb.Memory{Value: 8, Uint: pb.Memory_GIGABYTE}
+		err := laptopStore.Save(laptop)
+		require.NoError(t, err)
+
+		_, err = ratingStore.Rate(laptop.Id, "user1", float64(n-i))
+		require.NoError(t, err)
+		laptops[i] = laptop
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	testCases := []struct {
+		name     string
+		sortBy   []*pb.SortKey
+		max      uint32
+		expected []*pb.Laptop
+	}{
+		{
+			name:     "price_desc_top3",
+			sortBy:   []*pb.SortKey{{Field: pb.SortKey_PRICE, Descending: true}},
+			max:      3,
+			expected: []*pb.Laptop{laptops[9], laptops[8], laptops[7]},
+		},
+		{
+			name:     "rating_desc_top2",
+			sortBy:   []*pb.SortKey{{Field: pb.SortKey_AVERAGE_RATING, Descending: true}},
+			max:      2,
+			expected: []*pb.Laptop{laptops[0], laptops[1]},
+		},
+		{
+			name:     "cores_then_price",
+			sortBy:   []*pb.SortKey{{Field: pb.SortKey_CPU_CORES}, {Field: pb.SortKey_PRICE}},
+			expected: laptops,
+		},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			req := &pb.SearchLaptopRequest{Filter: filter, SortBy: tc.sortBy, MaxResults: tc.max}
+			stream, err := laptopClient.SearchLaptop(context.Background(), req)
+			require.NoError(t, err)
+
+			var ids []string
+			for {
+				res, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				ids = append(ids, res.GetLaptop().GetId())
+			}
+
+			require.Len(t, ids, len(tc.expected))
+			for i, laptop := range tc.expected {
+				require.Equal(t, laptop.GetId(), ids[i])
+			}
+		})
+	}
+
+	//没有给出或者不认识的排序字段
+	for _, field := range []pb.SortKey_Field{pb.SortKey_UNKNOWN, 99} {
+		req := &pb.SearchLaptopRequest{Filter: filter, SortBy: []*pb.SortKey{{Field: field}}}
+		stream, err := laptopClient.SearchLaptop(context.Background(), req)
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.Equal(t, codes.InvalidArgument, status.Code(err), field)
+	}
+}
+
+func TestClientSearchLaptopQuery(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	expectedIDs := make(map[string]bool)
+	for i := 0; i < 6; i++ {
+		laptop := sample.NewLaptop()
+		laptop.Brand = "Dell"
+		laptop.PriceUsd = 1500
+		if i%2 == 0 {
+			laptop.Brand = "Apple"
+			expectedIDs[laptop.Id] = true
+		}
+		err := laptopStore.Save(laptop)
+		require.NoError(t, err)
+	}
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	req := &pb.SearchLaptopRequest{Filter: &pb.Filter{MaxPriceUsd: 2000}, Query: "brand:apple price<2000"}
+	stream, err := laptopClient.SearchLaptop(context.Background(), req)
+	require.NoError(t, err)
+
+	found := 0
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Contains(t, expectedIDs, res.GetLaptop().GetId())
+		found++
+	}
+	require.Equal(t, len(expectedIDs), found)
+
+	//语法错误返回InvalidArgument，并且带有出错的位置
+	req = &pb.SearchLaptopRequest{Query: "brand:apple price<<2000"}
+	stream, err = laptopClient.SearchLaptop(context.Background(), req)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "position 19")
+
+	//嵌套很深的查询不会让服务器栈溢出，只返回InvalidArgument
+	nested := strings.Repeat("(", 1000000) + "cpu.cores>1" + strings.Repeat(")", 1000000)
+	stream, err = laptopClient.SearchLaptop(context.Background(), &pb.SearchLaptopRequest{Query: nested})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientUpdateLaptopWithRetry(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	laptop.PriceUsd = 1000
+	err := laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	laptopClient := client.NewLaptopClient(conn)
+
+	//多个客户端同时给同一台电脑涨价，每一次修改都不能丢失
+	//require不能在其他goroutine中调用，错误发回测试goroutine检查
+	n := 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := laptopClient.UpdateLaptopWithRetry(laptop.Id, 100, func(laptop *pb.Laptop) error {
+				laptop.PriceUsd += 10
+				return nil
+			})
+			errs <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	other, err := laptopStore.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, 1000+10*float64(n), other.GetPriceUsd())
+	require.Equal(t, uint64(n), other.GetVersion())
+}
+
+func TestClientWatchLaptops(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, nil)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	laptopClient := client.NewLaptopClient(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watch := func(resumeAfter uint64) (chan *pb.LaptopEvent, chan error) {
+		events := make(chan *pb.LaptopEvent, 10)
+		done := make(chan error, 1)
+		go func() {
+			filter := &pb.Filter{Brands: []string{"Apple"}}
+			done <- laptopClient.WatchLaptops(ctx, filter, &resumeAfter, func(event *pb.LaptopEvent) error {
+				events <- event
+				return nil
+			})
+		}()
+		return events, done
+	}
+
+	//从序号0开始订阅，不管订阅和修改谁先发生，都能收到所有的事件
+	events, _ := watch(0)
+
+	apple := sample.NewLaptop()
+	apple.Brand = "Apple"
+	require.NoError(t, laptopStore.Save(apple))
+	dell := sample.NewLaptop()
+	dell.Brand = "Dell"
+	require.NoError(t, laptopStore.Save(dell)) //不满足过滤条件
+	apple.PriceUsd = 1999
+	require.NoError(t, laptopStore.Update(apple, nil, nil))
+	require.NoError(t, laptopStore.Delete(apple.Id, nil))
+
+	expected := []struct {
+		sequence  uint64
+		eventType pb.LaptopEvent_Type
+	}{
+		{1, pb.LaptopEvent_CREATED},
+		{3, pb.LaptopEvent_UPDATED},
+		{4, pb.LaptopEvent_DELETED},
+	}
+	for _, e := range expected {
+		event := <-events
+		require.Equal(t, e.sequence, event.GetSequence())
+		require.Equal(t, e.eventType, event.GetType())
+		require.Equal(t, apple.Id, event.GetLaptop().GetId())
+	}
+
+	//断线之后从最后收到的序号续传
+	events, _ = watch(3)
+	event := <-events
+	require.Equal(t, uint64(4), event.GetSequence())
+	require.Equal(t, pb.LaptopEvent_DELETED, event.GetType())
+	require.Equal(t, 1999.0, event.GetLaptop().GetPriceUsd())
+
+	//store中不存在的序号不能续传
+	_, done := watch(100)
+	err = <-done
+	require.Error(t, err)
+	require.Equal(t, codes.OutOfRange, status.Code(errors.Unwrap(err)))
+}
+
 func newTestLaptopClient(t *testing.T, serverAddress string) pb.LaptopServiceClient { ///////////
 	//拨打服务器地址
-	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure) //只是测试，使用不安全的连接
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure()) //只是测试，使用不安全的连接
 	require.NoError(t, err)
 	return pb.NewLaptopServiceClient(conn) ////////////////////
 }
@@ -143,19 +400,82 @@ func requireSameLaptop(t *testing.T, laptop1 *pb.Laptop, laptop2 *pb.Laptop) {
 func TestClientUploadImage(t *testing.T) {
 	t.Parallel()
 
-	testImageFolder := "../tmp"
+	testImageFolder := t.TempDir() //上传的图像和图像信息都保存在临时文件夹中
 
 	laptopStore := service.NewInMemoryLaptopStore()
-	imageStore := service.NewDiskImageStore(testImageFolder)
+	imageStore, err := service.NewDiskImageStore(testImageFolder)
+	require.NoError(t, err)
 
 	laptop := sample.NewLaptop()
-	err := laptopStore.Save(laptop)
+	err = laptopStore.Save(laptop)
 	require.NoError(t, err)
 
 	serverAddress := startTestLaptopServer(t, laptopStore, imageStore,nil)
 	laptopClient := newTestLaptopClient(t, serverAddress)
 
-	imagePath := fmt.Sprintf("%s/laptop.jpg", testImageFolder)
+	imagePath := "../tmp/laptop.jpg"
+	imageType := filepath.Ext(imagePath)
+	res, size := uploadTestImage(t, laptopClient, laptop.GetId(), imagePath)
+	require.NotZero(t, res.GetId())
+	require.EqualValues(t, size, res.GetSize())
+
+	savedImagePath := fmt.Sprintf("%s/%s%s", testImageFolder, res.GetId(), imageType)
+	require.FileExists(t, savedImagePath)
+	require.NoError(t, os.Remove(savedImagePath))
+}
+
+func TestClientUploadImageInvalidType(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	err = laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	image, err := os.ReadFile("../tmp/laptop.jpg")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		imageType string
+		data      []byte
+	}{
+		{"type mismatch", ".png", image},
+		{"unsupported content", ".jpg", []byte("definitely not an image")},
+	}
+
+	for _, tc := range testCases {
+		stream, err := laptopClient.UploadImage(context.Background())
+		require.NoError(t, err)
+		err = stream.Send(&pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_Info{
+				Info: &pb.ImageInfo{LaptopId: laptop.GetId(), ImageType: tc.imageType},
+			},
+		})
+		require.NoError(t, err)
+		err = stream.Send(&pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_ChunkData{ChunkData: tc.data},
+		})
+		require.NoError(t, err, tc.name)
+
+		_, err = stream.CloseAndRecv()
+		require.Equal(t, codes.InvalidArgument, status.Code(err), tc.name)
+	}
+
+	//被拒绝的图像不会保存
+	images, err := imageStore.List(laptop.GetId())
+	require.NoError(t, err)
+	require.Empty(t, images)
+}
+
+//把图像分块上传到服务器，返回服务器的响应和上传的字节数
+func uploadTestImage(t *testing.T, laptopClient pb.LaptopServiceClient, laptopID string, imagePath string) (*pb.UploadImageResponse, int) {
 	file, err := os.Open(imagePath)
 	require.NoError(t, err)
 	defer file.Close()
@@ -163,12 +483,11 @@ func TestClientUploadImage(t *testing.T) {
 	stream, err := laptopClient.UploadImage(context.Background())
 	require.NoError(t, err)
 
-	imageType := filepath.Ext(imagePath)
 	req := &pb.UploadImageRequest{
 		Data: &pb.UploadImageRequest_Info{
 			Info: &pb.ImageInfo{
-				LaptopId:  laptop.GetId(),
-				ImageType: imageType,
+				LaptopId:  laptopID,
+				ImageType: filepath.Ext(imagePath),
 			},
 		},
 	}
@@ -201,12 +520,389 @@ func TestClientUploadImage(t *testing.T) {
 
 	res, err := stream.CloseAndRecv()
 	require.NoError(t, err)
-	require.NotZero(t, res.GetId())
-	require.EqualValues(t, size, res.GetSize())
+	return res, size
+}
 
-	savedImagePath := fmt.Sprintf("%s/%s%s", testImageFolder, res.GetId(), imageType)
-	require.FileExists(t, savedImagePath)
-	require.NoError(t, os.Remove(savedImagePath))
+func TestClientDownloadImage(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	err = laptopStore.Save(laptop)
+	require.NoError(t, err)
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	res, _ := uploadTestImage(t, newTestLaptopClient(t, serverAddress), laptop.GetId(), "../tmp/laptop.jpg")
+	image, err := os.ReadFile("../tmp/laptop.jpg")
+	require.NoError(t, err)
+
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	laptopClient := client.NewLaptopClient(conn)
+
+	testCases := []struct {
+		name   string
+		id     string
+		offset uint64
+		code   codes.Code
+	}{
+		{"whole image", res.GetId(), 0, codes.OK},
+		{"resume from offset", res.GetId(), 1000, codes.OK},
+		{"offset at the end", res.GetId(), uint64(len(image)), codes.OK},
+		{"offset out of range", res.GetId(), uint64(len(image)) + 1, codes.OutOfRange},
+		{"unknown image", uuid.New().String(), 0, codes.NotFound},
+		{"empty id", "", 0, codes.InvalidArgument},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buffer bytes.Buffer
+			info, err := laptopClient.DownloadImage(tc.id, "", tc.offset, &buffer)
+			if tc.code != codes.OK {
+				require.Error(t, err)
+				require.Equal(t, tc.code, status.Code(errors.Unwrap(err)))
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, laptop.GetId(), info.GetLaptopId())
+			require.Equal(t, ".jpg", info.GetImageType())
+			require.EqualValues(t, len(image), info.GetSize())
+			require.Equal(t, string(image[tc.offset:]), buffer.String())
+		})
+	}
+}
+
+func TestClientListAndDeleteImages(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+
+	laptop1 := sample.NewLaptop()
+	laptop2 := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop1))
+	require.NoError(t, laptopStore.Save(laptop2))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	serviceClient := newTestLaptopClient(t, serverAddress)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	laptopClient := client.NewLaptopClient(conn)
+
+	var imageIDs []string
+	for i := 0; i < 2; i++ {
+		res, _ := uploadTestImage(t, serviceClient, laptop1.GetId(), "../tmp/laptop.jpg")
+		imageIDs = append(imageIDs, res.GetId())
+	}
+	res, _ := uploadTestImage(t, serviceClient, laptop2.GetId(), "../tmp/laptop.jpg")
+	otherImageID := res.GetId()
+
+	images, err := laptopClient.ListImages(laptop1.GetId(), "")
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	for _, image := range images {
+		require.Contains(t, imageIDs, image.GetId())
+		require.Equal(t, laptop1.GetId(), image.GetInfo().GetLaptopId())
+		require.NotZero(t, image.GetInfo().GetSize())
+	}
+
+	//删除一张图像
+	info, err := imageStore.Find(imageIDs[0])
+	require.NoError(t, err)
+	require.NoError(t, laptopClient.DeleteImage(imageIDs[0]))
+	require.NoFileExists(t, info.Path)
+	images, err = laptopClient.ListImages(laptop1.GetId(), "")
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+
+	err = laptopClient.DeleteImage(imageIDs[0])
+	require.Equal(t, codes.NotFound, status.Code(errors.Unwrap(err)))
+
+	//删除电脑时同时删除它的图像，其他电脑的图像不受影响
+	info, err = imageStore.Find(imageIDs[1])
+	require.NoError(t, err)
+	require.NoError(t, laptopClient.DeleteLaptop(laptop1.GetId()))
+	require.NoFileExists(t, info.Path)
+	stored, err := imageStore.List(laptop1.GetId())
+	require.NoError(t, err)
+	require.Empty(t, stored)
+
+	images, err = laptopClient.ListImages(laptop2.GetId(), "")
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	require.Equal(t, otherImageID, images[0].GetId())
+
+	_, err = laptopClient.ListImages(laptop1.GetId(), "")
+	require.Equal(t, codes.NotFound, status.Code(errors.Unwrap(err)))
+}
+
+func TestClientImageRenditions(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	res, size := uploadTestImage(t, newTestLaptopClient(t, serverAddress), laptop.GetId(), "../tmp/laptop.jpg")
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	laptopClient := client.NewLaptopClient(conn)
+
+	images, err := laptopClient.ListImages(laptop.GetId(), "")
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	require.Equal(t, []string{"medium", "small"}, images[0].GetRenditions())
+	require.EqualValues(t, size, images[0].GetInfo().GetSize())
+
+	images, err = laptopClient.ListImages(laptop.GetId(), "small")
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	require.Less(t, images[0].GetInfo().GetSize(), uint64(size))
+	images, err = laptopClient.ListImages(laptop.GetId(), "unknown")
+	require.NoError(t, err)
+	require.Empty(t, images)
+
+	//测试图像是1600x1600，缩略图保持宽高比
+	for name, maxSize := range map[string]int{"small": 128, "medium": 512} {
+		var buffer bytes.Buffer
+		info, err := laptopClient.DownloadImage(res.GetId(), name, 0, &buffer)
+		require.NoError(t, err)
+		require.Equal(t, ".jpg", info.GetImageType())
+		require.EqualValues(t, buffer.Len(), info.GetSize())
+
+		config, err := jpeg.DecodeConfig(&buffer)
+		require.NoError(t, err)
+		require.Equal(t, maxSize, config.Width)
+		require.Equal(t, maxSize, config.Height)
+	}
+
+	_, err = laptopClient.DownloadImage(res.GetId(), "unknown", 0, io.Discard)
+	require.Equal(t, codes.NotFound, status.Code(errors.Unwrap(err)))
+
+	//删除图像时同时删除缩略图
+	info, err := imageStore.Find(res.GetId())
+	require.NoError(t, err)
+	require.Len(t, info.Renditions, 2)
+	require.NoError(t, laptopClient.DeleteImage(res.GetId()))
+	for _, rendition := range info.Renditions {
+		require.NoFileExists(t, rendition.Path)
+	}
+}
+
+func TestClientResumableImageUpload(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	serverAddress := startTestLaptopServer(t, laptopStore, imageStore, nil)
+	serviceClient := newTestLaptopClient(t, serverAddress)
+	conn, err := grpc.Dial(serverAddress, grpc.WithInsecure())
+	require.NoError(t, err)
+	laptopClient := client.NewLaptopClient(conn)
+
+	image, err := os.ReadFile("../tmp/laptop.jpg")
+	require.NoError(t, err)
+	checksum := sha256.Sum256(image)
+
+	res, err := laptopClient.UploadImageResumable(laptop.GetId(), ".jpg", bytes.NewReader(image), 3)
+	require.NoError(t, err)
+	require.EqualValues(t, len(image), res.GetSize())
+	info, err := imageStore.Find(res.GetId())
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(checksum[:]), info.Checksum)
+
+	//只上传了一部分时连接断开，之后从服务器确认的位置继续
+	startRes, err := serviceClient.StartImageUpload(context.Background(), &pb.StartImageUploadRequest{
+		Info: &pb.ImageInfo{LaptopId: laptop.GetId(), ImageType: ".jpg"},
+	})
+	require.NoError(t, err)
+	uploadID := startRes.GetUploadId()
+
+	sendChunks := func(chunks ...*pb.UploadImageChunkRequest) error {
+		stream, err := serviceClient.UploadImageChunks(context.Background())
+		require.NoError(t, err)
+		for _, chunk := range chunks {
+			chunk.UploadId = uploadID
+			if err := stream.Send(chunk); err != nil {
+				break
+			}
+		}
+		_, err = stream.CloseAndRecv()
+		return err
+	}
+	chunk := func(offset, size int) *pb.UploadImageChunkRequest {
+		data := image[offset : offset+size]
+		return &pb.UploadImageChunkRequest{
+			Offset:    uint64(offset),
+			ChunkData: data,
+			Crc32C:    crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)),
+		}
+	}
+	committed := func() uint64 {
+		res, err := serviceClient.GetImageUpload(context.Background(), &pb.GetImageUploadRequest{UploadId: uploadID})
+		require.NoError(t, err)
+		return res.GetCommittedOffset()
+	}
+
+	require.NoError(t, sendChunks(chunk(0, 1000), chunk(1000, 1000)))
+	require.EqualValues(t, 2000, committed())
+
+	//数据块的位置不对或者数据损坏时不会写入
+	err = sendChunks(chunk(3000, 1000))
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	corrupted := chunk(2000, 1000)
+	corrupted.Crc32C++
+	err = sendChunks(corrupted)
+	require.Equal(t, codes.DataLoss, status.Code(err))
+	require.EqualValues(t, 2000, committed())
+
+	res, err = laptopClient.ResumeImageUpload(uploadID, bytes.NewReader(image), 3)
+	require.NoError(t, err)
+	var buffer bytes.Buffer
+	_, err = laptopClient.DownloadImage(res.GetId(), "", 0, &buffer)
+	require.NoError(t, err)
+	require.Equal(t, string(image), buffer.String())
+
+	//完成后上传就不存在了
+	_, err = serviceClient.GetImageUpload(context.Background(), &pb.GetImageUploadRequest{UploadId: uploadID})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	//整个图像的SHA-256不对时不保存图像
+	startRes, err = serviceClient.StartImageUpload(context.Background(), &pb.StartImageUploadRequest{
+		Info: &pb.ImageInfo{LaptopId: laptop.GetId(), ImageType: ".jpg"},
+	})
+	require.NoError(t, err)
+	uploadID = startRes.GetUploadId()
+	require.NoError(t, sendChunks(chunk(0, 1000)))
+	_, err = serviceClient.FinishImageUpload(context.Background(), &pb.FinishImageUploadRequest{
+		UploadId: uploadID,
+		Sha256:   hex.EncodeToString(checksum[:]),
+	})
+	require.Equal(t, codes.DataLoss, status.Code(err))
+
+	images, err := imageStore.List(laptop.GetId())
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+
+	//上传的内容不是声明的类型
+	startRes, err = serviceClient.StartImageUpload(context.Background(), &pb.StartImageUploadRequest{
+		Info: &pb.ImageInfo{LaptopId: laptop.GetId(), ImageType: ".png"},
+	})
+	require.NoError(t, err)
+	uploadID = startRes.GetUploadId()
+	err = sendChunks(chunk(0, 1000))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = serviceClient.StartImageUpload(context.Background(), &pb.StartImageUploadRequest{
+		Info: &pb.ImageInfo{LaptopId: laptop.GetId(), ImageType: ".exe"},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestClientImageUploadLimits(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	imageStore, err := service.NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+
+	laptop1 := sample.NewLaptop()
+	laptop2 := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop1))
+	require.NoError(t, laptopStore.Save(laptop2))
+
+	image, err := os.ReadFile("../tmp/laptop.jpg")
+	require.NoError(t, err)
+	imageSize := int64(len(image))
+
+	//服务器开启身份验证，配额是两张测试图像多一点
+	laptopServer := service.NewLaptopServer(laptopStore, imageStore, nil)
+	uploadFolder := t.TempDir()
+	laptopServer.SetUploadFolder(uploadFolder)
+	laptopServer.SetUploadLimits(service.UploadLimits{
+		MaxImageSize:       imageSize + 1000,
+		MaxImagesPerLaptop: 2,
+		UserQuota:          2*imageSize + 1000,
+	})
+	serverAddress, jwtManager := startTestAuthLaptopServer(t, laptopServer, map[string][]string{
+		"/pb.LaptopService/UploadImage":   {"admin", "user"},
+		"/pb.LaptopService/GetImageUsage": {"admin", "user"},
+	})
+	laptopClient := newTestLaptopClient(t, serverAddress)
+	userContext := func(username string) context.Context {
+		return testUserContext(t, jwtManager, username)
+	}
+	upload := func(ctx context.Context, laptopID string, data []byte) error {
+		stream, err := laptopClient.UploadImage(ctx)
+		require.NoError(t, err)
+		err = stream.Send(&pb.UploadImageRequest{
+			Data: &pb.UploadImageRequest_Info{Info: &pb.ImageInfo{LaptopId: laptopID, ImageType: ".jpg"}},
+		})
+		for start := 0; err == nil && start < len(data); start += 1024 {
+			end := start + 1024
+			if end > len(data) {
+				end = len(data)
+			}
+			err = stream.Send(&pb.UploadImageRequest{
+				Data: &pb.UploadImageRequest_ChunkData{ChunkData: data[start:end]},
+			})
+		}
+		_, err = stream.CloseAndRecv()
+		return err
+	}
+
+	user1 := userContext("user1")
+	require.NoError(t, upload(user1, laptop1.GetId(), image))
+	require.NoError(t, upload(user1, laptop1.GetId(), image))
+
+	//电脑的图像数量达到上限
+	err = upload(userContext("user2"), laptop1.GetId(), image)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	//用户的配额不够再上传一张图像
+	err = upload(user1, laptop2.GetId(), image)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	//单张图像太大
+	err = upload(userContext("user2"), laptop2.GetId(), append(image, make([]byte, 2000)...))
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	//上传的图像暂存在上传文件夹中，不管成功还是失败，结束后都会删除
+	staged, err := os.ReadDir(uploadFolder)
+	require.NoError(t, err)
+	require.Empty(t, staged)
+
+	res, err := laptopClient.GetImageUsage(user1, &pb.GetImageUsageRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "user1", res.GetUsername())
+	require.EqualValues(t, 2, res.GetImageCount())
+	require.EqualValues(t, 2*imageSize, res.GetUsedBytes())
+	require.EqualValues(t, 2*imageSize+1000, res.GetQuotaBytes())
+
+	res, err = laptopClient.GetImageUsage(userContext("user2"), &pb.GetImageUsageRequest{})
+	require.NoError(t, err)
+	require.Zero(t, res.GetImageCount())
+
+	_, err = laptopClient.GetImageUsage(context.Background(), &pb.GetImageUsageRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
 }
 
 func TestClientRateLaptop(t *testing.T) {
@@ -219,42 +915,191 @@ func TestClientRateLaptop(t *testing.T) {
 	err := laptopStore.Save(laptop)
 	require.NoError(t, err)
 
-	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopServer := service.NewLaptopServer(laptopStore, nil, ratingStore)
+	serverAddress, jwtManager := startTestAuthLaptopServer(t, laptopServer, map[string][]string{
+		"/pb.LaptopService/RateLaptop":     {"admin", "user"},
+		"/pb.LaptopService/WithdrawRating": {"admin", "user"},
+	})
 	laptopClient := newTestLaptopClient(t, serverAddress)
+	user1 := testUserContext(t, jwtManager, "user1")
+	user2 := testUserContext(t, jwtManager, "user2")
 
-	stream, err := laptopClient.RateLaptop(context.Background())
-	require.NoError(t, err)
+	//用户在一个流中发送多个评分，返回每个评分之后的结果
+	rate := func(ctx context.Context, scores ...float64) []*pb.RateLaptopResponse {
+		stream, err := laptopClient.RateLaptop(ctx)
+		require.NoError(t, err)
+		for _, score := range scores {
+			err := stream.Send(&pb.RateLaptopRequest{LaptopId: laptop.GetId(), Score: score})
+			require.NoError(t, err)
+		}
+		require.NoError(t, stream.CloseSend())
 
-	scores := []float64{8, 7.5, 10}
-	averages := []float64{8, 7.75, 8.5}
-	
-	n := len(scores)
-	for i := 0; i < n; i++ {
-		req := &pb.RateLaptopRequest{
-			LaptopId: laptop.GetId(),
-			Score:    scores[i],
+		var responses []*pb.RateLaptopResponse
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return responses
+			}
+			require.NoError(t, err)
+			require.Equal(t, laptop.GetId(), res.GetLaptopId())
+			responses = append(responses, res)
 		}
+	}
 
-		err := stream.Send(req)
-		require.NoError(t, err)
+	//同一个用户再次评分时替换之前的评分，不会影响其他用户的评分
+	testCases := []struct {
+		name     string
+		ctx      context.Context
+		scores   []float64
+		counts   []uint32
+		averages []float64
+	}{
+		{"user1", user1, []float64{8, 7.5, 10}, []uint32{1, 1, 1}, []float64{8, 7.5, 10}},
+		{"user2", user2, []float64{6}, []uint32{2}, []float64{8}},
+		{"user1_again", user1, []float64{9, 9, 9, 9}, []uint32{2, 2, 2, 2}, []float64{7.5, 7.5, 7.5, 7.5}},
+	}
+	for _, tc := range testCases {
+		responses := rate(tc.ctx, tc.scores...)
+		require.Len(t, responses, len(tc.scores), tc.name)
+		for i, res := range responses {
+			require.Equal(t, tc.counts[i], res.GetRatedCount(), tc.name)
+			require.Equal(t, tc.averages[i], res.GetAverageScore(), tc.name)
+		}
 	}
 
-	err = stream.CloseSend()
+	//撤回评分之后平均分只包含其他用户的评分
+	res, err := laptopClient.WithdrawRating(user1, &pb.WithdrawRatingRequest{LaptopId: laptop.GetId()})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), res.GetRatedCount())
+	require.Equal(t, 6.0, res.GetAverageScore())
+	_, err = laptopClient.WithdrawRating(user1, &pb.WithdrawRatingRequest{LaptopId: laptop.GetId()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	res, err = laptopClient.WithdrawRating(user2, &pb.WithdrawRatingRequest{LaptopId: laptop.GetId()})
 	require.NoError(t, err)
+	require.Zero(t, res.GetRatedCount())
+	require.Zero(t, res.GetAverageScore())
+	rating, err := ratingStore.Find(laptop.GetId())
+	require.NoError(t, err)
+	require.Nil(t, rating)
+
+	//不知道是哪个用户时不能评分
+	stream, err := laptopClient.RateLaptop(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestClientRateLaptopInvalidRequests(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+
+	laptopServer := service.NewLaptopServer(laptopStore, nil, service.NewInMemoryRatingStore())
+	serverAddress, jwtManager := startTestAuthLaptopServer(t, laptopServer, map[string][]string{
+		"/pb.LaptopService/RateLaptop": {"admin", "user"},
+	})
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	stream, err := laptopClient.RateLaptop(testUserContext(t, jwtManager, "user1"))
+	require.NoError(t, err)
+
+	//不合法的请求只会被拒绝，流中后面的请求仍然会被处理
+	testCases := []struct {
+		name     string
+		laptopID string
+		score    float64
+		code     codes.Code
+		count    uint32
+		average  float64
+	}{
+		{"valid", laptop.GetId(), 4, codes.OK, 1, 4},
+		{"nan", laptop.GetId(), math.NaN(), codes.InvalidArgument, 0, 0},
+		{"negative", laptop.GetId(), -3, codes.InvalidArgument, 0, 0},
+		{"too_small", laptop.GetId(), 0.5, codes.InvalidArgument, 0, 0},
+		{"too_large", laptop.GetId(), 1e9, codes.InvalidArgument, 0, 0},
+		{"infinity", laptop.GetId(), math.Inf(1), codes.InvalidArgument, 0, 0},
+		{"unknown_laptop", uuid.NewString(), 5, codes.NotFound, 0, 0},
+		{"min", laptop.GetId(), 1, codes.OK, 1, 1},
+		{"max", laptop.GetId(), 10, codes.OK, 1, 10},
+	}
+	for _, tc := range testCases {
+		err := stream.Send(&pb.RateLaptopRequest{LaptopId: tc.laptopID, Score: tc.score})
+		require.NoError(t, err, tc.name)
 
-	for idx := 0; ; idx++ {
 		res, err := stream.Recv()
-		if err == io.EOF {
-			require.Equal(t, n, idx)
-			return
-		}
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.laptopID, res.GetLaptopId(), tc.name)
+		require.Equal(t, uint32(tc.code), res.GetCode(), tc.name)
+		require.Equal(t, tc.code == codes.OK, res.GetMessage() == "", tc.name)
+		require.Equal(t, tc.count, res.GetRatedCount(), tc.name)
+		require.Equal(t, tc.average, res.GetAverageScore(), tc.name)
+	}
+
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestClientGetRating(t *testing.T) {
+	t.Parallel()
+
+	laptopStore := service.NewInMemoryLaptopStore()
+	ratingStore := service.NewInMemoryRatingStore()
+	rated := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(rated))
+	unrated := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(unrated))
 
+	//平均分5，标准差2，中位数是4和5的平均值
+	for i, score := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		_, err := ratingStore.Rate(rated.GetId(), fmt.Sprintf("user%d", i), score)
 		require.NoError(t, err)
-		require.Equal(t, laptop.GetId(), res.GetLaptopId())
-		require.Equal(t, uint32(idx+1), res.GetRatedCount())
-		require.Equal(t, averages[idx], res.GetAverageScore())
 	}
-	
+
+	serverAddress := startTestLaptopServer(t, laptopStore, nil, ratingStore)
+	laptopClient := newTestLaptopClient(t, serverAddress)
+
+	res, err := laptopClient.GetRating(context.Background(), &pb.GetRatingRequest{
+		LaptopIds: []string{rated.GetId(), unrated.GetId()},
+	})
+	require.NoError(t, err)
+	require.Len(t, res.GetRatings(), 2)
+
+	rating := res.GetRatings()[0]
+	require.Equal(t, rated.GetId(), rating.GetLaptopId())
+	require.Equal(t, uint32(8), rating.GetCount())
+	require.Equal(t, 5.0, rating.GetMean())
+	require.Equal(t, 4.5, rating.GetMedian())
+	require.InDelta(t, 2.0, rating.GetStddev(), 1e-9)
+	require.Equal(t, []uint32{0, 1, 0, 3, 2, 0, 1, 0, 1, 0}, rating.GetHistogram())
+
+	rating = res.GetRatings()[1]
+	require.Equal(t, unrated.GetId(), rating.GetLaptopId())
+	require.Zero(t, rating.GetCount())
+	require.Zero(t, rating.GetMedian())
+	require.Equal(t, make([]uint32, 10), rating.GetHistogram())
+
+	tooMany := make([]string, 101)
+	for i := range tooMany {
+		tooMany[i] = rated.GetId()
+	}
+	testCases := []struct {
+		name      string
+		laptopIDs []string
+		code      codes.Code
+	}{
+		{"no_laptops", nil, codes.InvalidArgument},
+		{"too_many_laptops", tooMany, codes.InvalidArgument},
+		{"invalid_id", []string{rated.GetId(), "invalid"}, codes.InvalidArgument},
+		{"unknown_laptop", []string{rated.GetId(), uuid.NewString()}, codes.NotFound},
+	}
+	for _, tc := range testCases {
+		_, err := laptopClient.GetRating(context.Background(), &pb.GetRatingRequest{LaptopIds: tc.laptopIDs})
+		require.Equal(t, tc.code, status.Code(err), tc.name)
+	}
 }
 
 //启动gRPC服务
@@ -278,3 +1123,28 @@ func startTestLaptopServer(t *testing.T, laptopStore service.LaptopStore, imageS
 	return listener.Addr().String()
 
 }
+
+//启动开启身份验证的gRPC服务，roles是每个方法允许的角色，返回服务地址和签发令牌的JWT管理器
+func startTestAuthLaptopServer(t *testing.T, laptopServer *service.LaptopServer, roles map[string][]string) (string, *service.JWTManager) {
+	jwtManager := service.NewJWTManager("secret", time.Minute)
+	interceptor := service.NewAuthInterceptor(jwtManager, roles)
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.Unary()),
+		grpc.StreamInterceptor(interceptor.Stream()),
+	)
+	pb.RegisterLaptopServiceServer(grpcServer, laptopServer)
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+	return listener.Addr().String(), jwtManager
+}
+
+//返回带有用户令牌的上下文
+func testUserContext(t *testing.T, jwtManager *service.JWTManager, username string) context.Context {
+	user, err := service.NewUser(username, "secret", "user")
+	require.NoError(t, err)
+	token, err := jwtManager.Generate(user)
+	require.NoError(t, err)
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
+}
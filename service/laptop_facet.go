@@ -0,0 +1,153 @@
+//统计电脑在各个属性上的分布
+package service
+
+import (
+	"errors"
+	"fmt"
+	"grpctest/pb"
+	"sort"
+	"strconv"
+)
+
+// ErrInvalidFacet is returned when a facet definition cannot be computed
+var ErrInvalidFacet = errors.New("invalid facet")
+
+//没有指定区间边界时使用的默认值
+var defaultFacetBoundaries = map[pb.Facet_Field][]float64{
+	pb.Facet_RAM:   {8, 16, 32, 64},
+	pb.Facet_PRICE: {1000, 1500, 2000, 2500, 3000},
+}
+
+//1GB的位数，RAM区间的边界以GB为单位
+var gigabyteBits = toBit(&pb.Memory{Value: 1, Uint: pb.Memory_GIGABYTE})
+
+//一个facet的统计状态
+type facetCounter struct {
+	field      pb.Facet_Field
+	boundaries []float64         //区间统计时的边界
+	ranges     []uint64          //每个区间的数量，比边界多一个
+	terms      map[string]uint64 //按值统计时每个值的数量
+}
+
+//laptopAggregator逐台加入符合条件的电脑，最后生成统计结果
+type laptopAggregator struct {
+	total    uint64
+	counters []*facetCounter
+	minPrice float64
+	maxPrice float64
+	sumPrice float64
+}
+
+func newLaptopAggregator(facets []*pb.Facet) (*laptopAggregator, error) {
+	aggregator := &laptopAggregator{}
+	for _, facet := range facets {
+		counter := &facetCounter{field: facet.GetField()}
+		switch facet.GetField() {
+		case pb.Facet_BRAND, pb.Facet_CPU_BRAND, pb.Facet_PANEL:
+			counter.terms = make(map[string]uint64)
+		case pb.Facet_RAM, pb.Facet_PRICE:
+			counter.boundaries = facet.GetBoundaries()
+			if len(counter.boundaries) == 0 {
+				counter.boundaries = defaultFacetBoundaries[facet.GetField()]
+			}
+			for i := 1; i < len(counter.boundaries); i++ {
+				if counter.boundaries[i] <= counter.boundaries[i-1] {
+					return nil, fmt.Errorf("%w: boundaries of %v must be increasing", ErrInvalidFacet, facet.GetField())
+				}
+			}
+			counter.ranges = make([]uint64, len(counter.boundaries)+1)
+		default:
+			return nil, fmt.Errorf("%w: unknown field %v", ErrInvalidFacet, facet.GetField())
+		}
+		aggregator.counters = append(aggregator.counters, counter)
+	}
+	return aggregator, nil
+}
+
+func (aggregator *laptopAggregator) add(laptop *pb.Laptop) {
+	price := laptop.GetPriceUsd()
+	if aggregator.total == 0 || price < aggregator.minPrice {
+		aggregator.minPrice = price
+	}
+	if aggregator.total == 0 || price > aggregator.maxPrice {
+		aggregator.maxPrice = price
+	}
+	aggregator.sumPrice += price
+	aggregator.total++
+
+	for _, counter := range aggregator.counters {
+		switch counter.field {
+		case pb.Facet_BRAND:
+			counter.terms[laptop.GetBrand()]++
+		case pb.Facet_CPU_BRAND:
+			counter.terms[laptop.GetCpu().GetBrand()]++
+		case pb.Facet_PANEL:
+			counter.terms[laptop.GetScreen().GetPanel().String()]++
+		case pb.Facet_RAM:
+			counter.addRange(float64(toBit(laptop.GetRam())) / float64(gigabyteBits))
+		case pb.Facet_PRICE:
+			counter.addRange(price)
+		}
+	}
+}
+
+func (counter *facetCounter) addRange(value float64) {
+	//第一个大于value的边界就是value所在区间的上界
+	i := sort.Search(len(counter.boundaries), func(i int) bool { return counter.boundaries[i] > value })
+	counter.ranges[i]++
+}
+
+func (aggregator *laptopAggregator) result() *pb.AggregateLaptopsResponse {
+	res := &pb.AggregateLaptopsResponse{Total: aggregator.total}
+	if aggregator.total > 0 {
+		res.Price = &pb.PriceStats{
+			MinUsd:     aggregator.minPrice,
+			MaxUsd:     aggregator.maxPrice,
+			AverageUsd: aggregator.sumPrice / float64(aggregator.total),
+		}
+	}
+
+	for _, counter := range aggregator.counters {
+		result := &pb.FacetResult{Field: counter.field}
+		if counter.terms != nil {
+			for key, count := range counter.terms {
+				result.Buckets = append(result.Buckets, &pb.FacetBucket{Key: key, Count: count})
+			}
+			sort.Slice(result.Buckets, func(i, j int) bool {
+				a, b := result.Buckets[i], result.Buckets[j]
+				if a.Count != b.Count {
+					return a.Count > b.Count
+				}
+				return a.Key < b.Key
+			})
+		} else {
+			for i, count := range counter.ranges {
+				result.Buckets = append(result.Buckets, counter.rangeBucket(i, count))
+			}
+		}
+		res.Facets = append(res.Facets, result)
+	}
+	return res
+}
+
+//第i个区间是[boundaries[i-1], boundaries[i])，第一个区间没有下界，最后一个没有上界
+func (counter *facetCounter) rangeBucket(i int, count uint64) *pb.FacetBucket {
+	bucket := &pb.FacetBucket{Count: count}
+	fromKey, toKey := "*", "*"
+	if i > 0 {
+		from := counter.boundaries[i-1]
+		bucket.From = &from
+		fromKey = formatBoundary(from)
+	}
+	if i < len(counter.boundaries) {
+		to := counter.boundaries[i]
+		bucket.To = &to
+		toKey = formatBoundary(to)
+	}
+	bucket.Key = fromKey + "-" + toKey
+	return bucket
+}
+
+func formatBoundary(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
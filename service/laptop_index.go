@@ -0,0 +1,274 @@
+//InMemoryLaptopStore的二级索引，用来在检索时避免遍历所有的电脑
+package service
+
+import (
+	"grpctest/pb"
+	"math"
+	"sort"
+	"strings"
+)
+
+const indexBlockSize = 512 //每个块最多保存的entry数量，插入和删除时最多移动这么多entry
+
+//索引中的一项，先按key排序，key相同时按id排序
+type indexEntry struct {
+	key float64
+	id  string
+}
+
+func (entry indexEntry) less(other indexEntry) bool {
+	if entry.key != other.key {
+		return entry.key < other.key
+	}
+	return entry.id < other.id
+}
+
+//sortedIndex是分块的有序列表，每个块都是有序的，前一个块的entry都小于后一个块
+//相比于一个大的有序切片，插入和删除时只需要移动一个块里的数据
+type sortedIndex struct {
+	blocks [][]indexEntry
+}
+
+//找到entry应该所在的块：第一个最后一项不小于entry的块
+func (index *sortedIndex) findBlock(entry indexEntry) int {
+	i := sort.Search(len(index.blocks), func(i int) bool {
+		block := index.blocks[i]
+		return !block[len(block)-1].less(entry)
+	})
+	if i == len(index.blocks) && i > 0 {
+		i-- //比所有entry都大的放到最后一个块
+	}
+	return i
+}
+
+func searchBlock(block []indexEntry, entry indexEntry) int {
+	return sort.Search(len(block), func(i int) bool { return !block[i].less(entry) })
+}
+
+func (index *sortedIndex) insert(key float64, id string) {
+	entry := indexEntry{key, id}
+	if len(index.blocks) == 0 {
+		index.blocks = [][]indexEntry{{entry}}
+		return
+	}
+
+	i := index.findBlock(entry)
+	block := index.blocks[i]
+	pos := searchBlock(block, entry)
+	block = append(block, indexEntry{})
+	copy(block[pos+1:], block[pos:])
+	block[pos] = entry
+	index.blocks[i] = block
+
+	//块太大时拆成两个
+	if len(block) > 2*indexBlockSize {
+		left := append([]indexEntry(nil), block[:indexBlockSize]...)
+		right := append([]indexEntry(nil), block[indexBlockSize:]...)
+		index.blocks = append(index.blocks, nil)
+		copy(index.blocks[i+2:], index.blocks[i+1:])
+		index.blocks[i] = left
+		index.blocks[i+1] = right
+	}
+}
+
+func (index *sortedIndex) remove(key float64, id string) {
+	entry := indexEntry{key, id}
+	if len(index.blocks) == 0 {
+		return
+	}
+
+	i := index.findBlock(entry)
+	block := index.blocks[i]
+	pos := searchBlock(block, entry)
+	if pos == len(block) || block[pos] != entry {
+		return
+	}
+	block = append(block[:pos], block[pos+1:]...)
+	if len(block) == 0 {
+		index.blocks = append(index.blocks[:i], index.blocks[i+1:]...)
+		return
+	}
+	index.blocks[i] = block
+}
+
+//从第一个不小于start的entry开始按顺序遍历，fn返回false时停止
+func (index *sortedIndex) ascend(start indexEntry, fn func(entry indexEntry) bool) {
+	if len(index.blocks) == 0 {
+		return
+	}
+	for i := index.findBlock(start); i < len(index.blocks); i++ {
+		block := index.blocks[i]
+		for _, entry := range block[searchBlock(block, start):] {
+			if !fn(entry) {
+				return
+			}
+		}
+	}
+}
+
+//key在[min, max]之间的entry数量，完全落在范围内的块不需要逐个统计
+func (index *sortedIndex) count(min, max float64) int {
+	total := 0
+	for _, block := range index.blocks {
+		first, last := block[0].key, block[len(block)-1].key
+		if last < min {
+			continue
+		}
+		if first > max {
+			break
+		}
+		if first >= min && last <= max {
+			total += len(block)
+			continue
+		}
+		lo := sort.Search(len(block), func(i int) bool { return block[i].key >= min })
+		hi := sort.Search(len(block), func(i int) bool { return block[i].key > max })
+		total += hi - lo
+	}
+	return total
+}
+
+//key在[min, max]之间的电脑id
+func (index *sortedIndex) rangeIDs(min, max float64) []string {
+	var ids []string
+	index.ascend(indexEntry{key: min}, func(entry indexEntry) bool {
+		if entry.key > max {
+			return false
+		}
+		ids = append(ids, entry.id)
+		return true
+	})
+	return ids
+}
+
+//laptopIndexes是InMemoryLaptopStore的所有二级索引
+type laptopIndexes struct {
+	ids      sortedIndex                    //按id排序，key都是0，用于分页
+	price    sortedIndex                    //按价格排序
+	unpriced map[string]struct{}            //价格是NaN的电脑，NaN没有顺序，不能放进price
+	cores    sortedIndex                    //按CPU核心数排序
+	ram      sortedIndex                    //按内存的位数排序
+	brands   map[string]map[string]struct{} //品牌（小写）-> 电脑id
+}
+
+func newLaptopIndexes() *laptopIndexes {
+	return &laptopIndexes{
+		unpriced: make(map[string]struct{}),
+		brands:   make(map[string]map[string]struct{}),
+	}
+}
+
+func (indexes *laptopIndexes) add(laptop *pb.Laptop) {
+	id := laptop.GetId()
+	indexes.ids.insert(0, id)
+	if price := laptop.GetPriceUsd(); math.IsNaN(price) {
+		indexes.unpriced[id] = struct{}{}
+	} else {
+		indexes.price.insert(price, id)
+	}
+	indexes.cores.insert(float64(laptop.GetCpu().GetNumberCores()), id)
+	indexes.ram.insert(float64(toBit(laptop.GetRam())), id)
+
+	brand := strings.ToLower(laptop.GetBrand())
+	if indexes.brands[brand] == nil {
+		indexes.brands[brand] = make(map[string]struct{})
+	}
+	indexes.brands[brand][id] = struct{}{}
+}
+
+//remove必须传入加入索引时的电脑，否则找不到对应的entry
+func (indexes *laptopIndexes) remove(laptop *pb.Laptop) {
+	id := laptop.GetId()
+	indexes.ids.remove(0, id)
+	if price := laptop.GetPriceUsd(); math.IsNaN(price) {
+		delete(indexes.unpriced, id)
+	} else {
+		indexes.price.remove(price, id)
+	}
+	indexes.cores.remove(float64(laptop.GetCpu().GetNumberCores()), id)
+	indexes.ram.remove(float64(toBit(laptop.GetRam())), id)
+
+	brand := strings.ToLower(laptop.GetBrand())
+	delete(indexes.brands[brand], id)
+	if len(indexes.brands[brand]) == 0 {
+		delete(indexes.brands, brand)
+	}
+}
+
+//按id的顺序遍历id大于afterID的电脑
+func (indexes *laptopIndexes) ascendIDs(afterID string, fn func(id string) bool) {
+	indexes.ids.ascend(indexEntry{id: afterID}, func(entry indexEntry) bool {
+		if entry.id == afterID {
+			return true
+		}
+		return fn(entry.id)
+	})
+}
+
+//根据过滤器选出候选电脑最少的那个索引，返回这些候选电脑的id
+//返回false表示过滤器中没有可以使用索引的条件，只能遍历所有电脑
+//候选电脑只满足被选中的那个条件，调用方仍然需要用isQualified检查
+func (indexes *laptopIndexes) candidates(filter *pb.Filter) ([]string, bool) {
+	best := -1
+	var ids func() []string
+
+	consider := func(count int, collect func() []string) {
+		if best < 0 || count < best {
+			best = count
+			ids = collect
+		}
+	}
+
+	minPrice, maxPrice := filter.GetMinPriceUsd(), filter.GetMaxPriceUsd()
+	if minPrice > 0 || maxPrice > 0 {
+		if maxPrice <= 0 {
+			maxPrice = math.Inf(1)
+		}
+		//和NaN的比较都是false，isQualified不会因为价格排除NaN价格的电脑，所以它们总是候选
+		consider(indexes.price.count(minPrice, maxPrice)+len(indexes.unpriced), func() []string {
+			ids := indexes.price.rangeIDs(minPrice, maxPrice)
+			for id := range indexes.unpriced {
+				ids = append(ids, id)
+			}
+			return ids
+		})
+	}
+
+	if minCores := float64(filter.GetMinCpuCores()); minCores > 0 {
+		consider(indexes.cores.count(minCores, math.Inf(1)), func() []string {
+			return indexes.cores.rangeIDs(minCores, math.Inf(1))
+		})
+	}
+
+	if minRam := float64(toBit(filter.GetMinRam())); minRam > 0 {
+		consider(indexes.ram.count(minRam, math.Inf(1)), func() []string {
+			return indexes.ram.rangeIDs(minRam, math.Inf(1))
+		})
+	}
+
+	if len(filter.GetBrands()) > 0 {
+		brands := make(map[string]bool)
+		count := 0
+		for _, brand := range filter.GetBrands() {
+			brand = strings.ToLower(brand)
+			if !brands[brand] {
+				brands[brand] = true
+				count += len(indexes.brands[brand])
+			}
+		}
+		consider(count, func() []string {
+			ids := make([]string, 0, count)
+			for brand := range brands {
+				for id := range indexes.brands[brand] {
+					ids = append(ids, id)
+				}
+			}
+			return ids
+		})
+	}
+
+	if best < 0 {
+		return nil, false
+	}
+	return ids(), true
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"grpctest/pb"
+	"grpctest/sample"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortedIndex(t *testing.T) {
+	t.Parallel()
+
+	index := &sortedIndex{}
+	expected := make(map[string]float64)
+
+	//插入足够多的entry，让索引拆分成多个块
+	for i := 0; i < 5*indexBlockSize; i++ {
+		laptop := sample.NewLaptop()
+		index.insert(laptop.GetPriceUsd(), laptop.GetId())
+		expected[laptop.GetId()] = laptop.GetPriceUsd()
+	}
+	//删除其中的一半
+	removed := 0
+	for id, price := range expected {
+		if removed*2 >= len(expected) {
+			break
+		}
+		index.remove(price, id)
+		delete(expected, id)
+		removed++
+	}
+	require.Greater(t, len(index.blocks), 1)
+
+	//遍历的结果是有序的，并且和剩下的entry一致
+	var entries []indexEntry
+	index.ascend(indexEntry{key: math.Inf(-1)}, func(entry indexEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	require.Len(t, entries, len(expected))
+	require.True(t, sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].less(entries[j]) }))
+	for _, entry := range entries {
+		require.Equal(t, expected[entry.id], entry.key)
+	}
+
+	count := 0
+	for _, price := range expected {
+		if price >= 2000 && price <= 3000 {
+			count++
+		}
+	}
+	require.Equal(t, count, index.count(2000, 3000))
+	require.Len(t, index.rangeIDs(2000, 3000), count)
+}
+
+//用forEach遍历电脑，返回符合过滤条件的电脑id
+func qualifiedIDs(store *InMemoryLaptopStore, filter *pb.Filter, forEach func(fn func(laptop *pb.Laptop) error) error) ([]string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var ids []string
+	err := forEach(func(laptop *pb.Laptop) error {
+		if isQualified(filter, laptop) {
+			ids = append(ids, laptop.GetId())
+		}
+		return nil
+	})
+	sort.Strings(ids)
+	return ids, err
+}
+
+//使用索引和遍历所有电脑
+func indexedIDs(store *InMemoryLaptopStore, filter *pb.Filter) ([]string, error) {
+	return qualifiedIDs(store, filter, func(fn func(laptop *pb.Laptop) error) error {
+		return store.forEachCandidate(filter, fn)
+	})
+}
+
+func scannedIDs(store *InMemoryLaptopStore, filter *pb.Filter) ([]string, error) {
+	return qualifiedIDs(store, filter, store.forEachLaptop)
+}
+
+func TestInMemoryLaptopStoreSearchWithIndexes(t *testing.T) {
+	t.Parallel()
+
+	store := NewInMemoryLaptopStore()
+	for i := 0; i < 2000; i++ {
+		laptop := sample.NewLaptop()
+		require.NoError(t, store.Save(laptop))
+
+		//更新和删除之后索引仍然正确
+		switch i % 10 {
+		case 0:
+			laptop.PriceUsd = 1000
+			laptop.Brand = "Dell"
+			require.NoError(t, store.Update(laptop, nil, nil))
+		case 1:
+			require.NoError(t, store.Delete(laptop.Id, nil))
+		case 2:
+			//NaN价格不在有序的价格索引中，σ和ς转为小写后是不同的品牌
+			laptop.PriceUsd = math.NaN()
+			laptop.Brand = []string{"Σ", "σ", "ς"}[i%3]
+			require.NoError(t, store.Update(laptop, nil, nil))
+		case 3:
+			laptop.PriceUsd = math.NaN()
+			require.NoError(t, store.Update(laptop, nil, nil))
+			laptop.PriceUsd = 1500
+			require.NoError(t, store.Update(laptop, nil, nil))
+		}
+	}
+
+	filters := []*pb.Filter{
+		{MaxPriceUsd: 2000},
+		{MinPriceUsd: 3000, MinCpuCores: 4},
+		{MinCpuCores: 7, MinCpuGhz: 3},
+		{MinRam: &pb.Memory{Value: 48, Uint: pb.Memory_GIGABYTE}},
+		{Brands: []string{"dell", "Lenovo"}, MaxPriceUsd: 3000},
+		{Brands: []string{"Unknown"}},
+		{Brands: []string{"σ"}},
+		{Brands: []string{"ς"}, MinPriceUsd: 1000},
+	}
+
+	//用索引找到的电脑和遍历所有电脑找到的一致，Search使用的也是索引
+	for _, filter := range filters {
+		expected, err := scannedIDs(store, filter)
+		require.NoError(t, err)
+		actual, err := indexedIDs(store, filter)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual, filter.String())
+
+		var found []string
+		err = store.Search(context.Background(), filter, nil, func(laptop *pb.Laptop) error {
+			found = append(found, laptop.GetId())
+			return nil
+		})
+		require.NoError(t, err)
+		sort.Strings(found)
+		require.Equal(t, expected, found, filter.String())
+	}
+}
+
+func newBenchmarkLaptopStore(b *testing.B, n int) *InMemoryLaptopStore {
+	store := NewInMemoryLaptopStore()
+	for i := 0; i < n; i++ {
+		if err := store.Save(sample.NewLaptop()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return store
+}
+
+//find是indexedIDs或者scannedIDs
+func benchmarkSearch(b *testing.B, find func(store *InMemoryLaptopStore, filter *pb.Filter) ([]string, error), filter *pb.Filter) {
+	store := newBenchmarkLaptopStore(b, 100000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := find(store, filter); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//价格区间很窄，索引只需要检查很少的电脑
+var benchmarkPriceFilter = &pb.Filter{MinPriceUsd: 2000, MaxPriceUsd: 2010, MinCpuCores: 2}
+
+//内存很大的电脑很少
+var benchmarkRAMFilter = &pb.Filter{MinRam: &pb.Memory{Value: 63, Uint: pb.Memory_GIGABYTE}, MaxPriceUsd: 3500}
+
+func BenchmarkSearchPriceIndex(b *testing.B) { benchmarkSearch(b, indexedIDs, benchmarkPriceFilter) }
+func BenchmarkSearchPriceScan(b *testing.B)  { benchmarkSearch(b, scannedIDs, benchmarkPriceFilter) }
+func BenchmarkSearchRAMIndex(b *testing.B)   { benchmarkSearch(b, indexedIDs, benchmarkRAMFilter) }
+func BenchmarkSearchRAMScan(b *testing.B)    { benchmarkSearch(b, scannedIDs, benchmarkRAMFilter) }
@@ -1,31 +1,110 @@
 package service
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"grpctest/pb"
+	"grpctest/query"
 	"io"
 	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-const maxImageSize = 1 << 20 //图像的最大长度为1兆字节			1<<10是1KB;1<<20是1MB
+const downloadChunkSize = 64 << 10 //下载图像时每个响应中数据块的大小
+
+const (
+	defaultPageSize = 50    //客户端没有指定page_size时每页的电脑数量
+	maxPageSize     = 1000  //每页最多返回的电脑数量
+	pageTokenPrefix = "id:" //page token的版本前缀，以后换排序方式时可以区分旧token
+)
+
+const maxRatingLaptops = 100 //GetRating一次最多查询的电脑数量
 
 //定义一个结构体封装server的方法
 type LaptopServer struct {
 	laptopStore LaptopStore //一个接口，里面有存储和查找函数
 	imageStore  ImageStore
 	ratingStore RatingStore
+	renditions  []RenditionSpec   //上传图像后生成的缩略图尺寸
+	uploads     *uploadSessions   //进行中的可以断点续传的上传
+	limits      UploadLimits      //上传图像的限制
+	saveMutex   sync.Mutex        //保护reserved，检查配额和预留配额一起执行，并发上传不会超过配额
+	reserved    imageReservations //正在保存的图像预留的配额
+	gcOptions   ImageGCOptions    //回收没有用的图像和上传
 }
 
 //返回一个&laptop
 func NewLaptopServer(laptopStore LaptopStore, imageStore ImageStore, ratingStore RatingStore) *LaptopServer {
-	return &LaptopServer{laptopStore, imageStore, ratingStore}
+	return &LaptopServer{
+		laptopStore: laptopStore,
+		imageStore:  imageStore,
+		ratingStore: ratingStore,
+		renditions:  DefaultRenditions,
+		uploads:     newUploadSessions(""),
+		limits:      DefaultUploadLimits,
+		gcOptions:   DefaultImageGCOptions,
+	}
+}
+
+// SetUploadLimits sets the limits of uploaded images
+func (server *LaptopServer) SetUploadLimits(limits UploadLimits) {
+	server.limits = limits
+}
+
+//返回上传图像的用户名，没有身份验证时所有上传都属于空用户名
+func imageOwner(ctx context.Context) string {
+	if claims := ClaimsFromContext(ctx); claims != nil {
+		return claims.Username
+	}
+	return ""
+}
+
+//重新检查限制并预留配额，然后在saveMutex外保存图像，保存结束后释放预留
+//保存成功时图像已经在imageStore中，之后的检查会从imageStore中计算它
+func (server *LaptopServer) saveImage(owner string, laptopID string, imageType string, data io.Reader, size int64) (string, error) {
+	if err := server.reserveImage(owner, laptopID, size); err != nil {
+		return "", err
+	}
+	defer server.releaseImage(owner, laptopID, size)
+	return server.imageStore.Save(laptopID, imageType, owner, data)
+}
+
+//在saveMutex中检查限制，通过时为图像预留配额
+func (server *LaptopServer) reserveImage(owner string, laptopID string, size int64) error {
+	server.saveMutex.Lock()
+	defer server.saveMutex.Unlock()
+
+	allowance, err := server.limits.allowance(server.imageStore, &server.reserved, owner, laptopID)
+	if err != nil {
+		return err
+	}
+	if err := server.limits.checkSize(size, allowance); err != nil {
+		return err
+	}
+	server.reserved.add(owner, laptopID, size)
+	return nil
+}
+
+func (server *LaptopServer) releaseImage(owner string, laptopID string, size int64) {
+	server.saveMutex.Lock()
+	defer server.saveMutex.Unlock()
+	server.reserved.release(owner, laptopID, size)
+}
+
+// SetRenditions sets the renditions generated for uploaded images, nil means no renditions
+func (server *LaptopServer) SetRenditions(renditions []RenditionSpec) {
+	server.renditions = renditions
 }
 
 //一元rpc//////////////////////////////////////////////////
@@ -51,6 +130,10 @@ func (server *LaptopServer) CreateLaptop( ///////////////////////
 		}
 		laptop.Id = id.String()
 	}
+	if err := checkLaptopPrice(laptop); err != nil {
+		return nil, err
+	}
+	laptop.Version = 0 //新建的电脑版本号从0开始
 
 	//假设在这里做一些繁重的处理。
 	time.Sleep(2 * time.Second) //用来测试客户端的超时检测功能。
@@ -86,16 +169,196 @@ func (server *LaptopServer) CreateLaptop( ///////////////////////
 	return res, nil
 }
 
+//通过id获取一台laptop
+func (server *LaptopServer) GetLaptop(
+	ctx context.Context,
+	req *pb.GetLaptopRequest,
+) (*pb.GetLaptopResponse, error) {
+	laptopID := req.GetId()
+	log.Printf("receive a get-laptop with id:%s", laptopID)
+
+	if err := checkLaptopID(laptopID); err != nil {
+		return nil, err
+	}
+
+	laptop, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot find laptop: %v", err)
+	}
+	if laptop == nil {
+		return nil, status.Errorf(codes.NotFound, "laptop id %s doesn't exist", laptopID)
+	}
+
+	return &pb.GetLaptopResponse{Laptop: laptop}, nil
+}
+
+//用请求中的laptop替换store中id相同的laptop
+func (server *LaptopServer) UpdateLaptop(
+	ctx context.Context,
+	req *pb.UpdateLaptopRequest,
+) (*pb.UpdateLaptopResponse, error) {
+	laptop := req.GetLaptop()
+	if laptop == nil {
+		return nil, status.Error(codes.InvalidArgument, "laptop is not provided")
+	}
+	log.Printf("receive an update-laptop with id:%s", laptop.GetId())
+
+	if err := checkLaptopID(laptop.GetId()); err != nil {
+		return nil, err
+	}
+	if err := checkLaptopPrice(laptop); err != nil {
+		return nil, err
+	}
+
+	mask := req.GetUpdateMask()
+	if err := validateFieldMask(mask.GetPaths()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	err := server.laptopStore.Update(laptop, mask, req.ExpectedVersion)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		} else if errors.Is(err, ErrInvalidFieldMask) {
+			code = codes.InvalidArgument
+		} else if errors.Is(err, ErrVersionConflict) {
+			code = codes.Aborted //客户端应该重新读取电脑后再重试
+		}
+		return nil, status.Errorf(code, "cannot update laptop in the store: %v", err)
+	}
+
+	log.Printf("updated laptop with id:%s", laptop.GetId())
+	return &pb.UpdateLaptopResponse{Laptop: laptop}, nil
+}
+
+//通过id删除一台laptop
+func (server *LaptopServer) DeleteLaptop(
+	ctx context.Context,
+	req *pb.DeleteLaptopRequest,
+) (*pb.DeleteLaptopResponse, error) {
+	laptopID := req.GetId()
+	log.Printf("receive a delete-laptop with id:%s", laptopID)
+
+	if err := checkLaptopID(laptopID); err != nil {
+		return nil, err
+	}
+
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	err := server.laptopStore.Delete(laptopID, req.Version)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, ErrNotFound) {
+			code = codes.NotFound
+		} else if errors.Is(err, ErrVersionConflict) {
+			code = codes.Aborted
+		}
+		return nil, status.Errorf(code, "cannot delete laptop from the store: %v", err)
+	}
+	log.Printf("deleted laptop with id:%s", laptopID)
+
+	//电脑已经删除了，它的图像也没有用了
+	if err := server.deleteLaptopImages(laptopID); err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot delete images of laptop %s: %v", laptopID, err))
+	}
+	return &pb.DeleteLaptopResponse{}, nil
+}
+
+//删除一台电脑的所有图像
+func (server *LaptopServer) deleteLaptopImages(laptopID string) error {
+	if server.imageStore == nil {
+		return nil
+	}
+
+	images, err := server.imageStore.List(laptopID)
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		err := server.imageStore.Delete(image.ID)
+		if err != nil && !errors.Is(err, ErrNotFound) { //可能同时被DeleteImage删除了
+			return err
+		}
+		log.Printf("deleted image %s of laptop %s", image.ID, laptopID)
+	}
+	return nil
+}
+
+//按id的顺序分页列出电脑
+func (server *LaptopServer) ListLaptops(
+	ctx context.Context,
+	req *pb.ListLaptopsRequest,
+) (*pb.ListLaptopsResponse, error) {
+	log.Printf("receive a list-laptops with page size:%d", req.GetPageSize())
+
+	pageSize := int(req.GetPageSize())
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	afterID, err := decodePageToken(req.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page token: %v", err)
+	}
+
+	//多取一台，用来判断后面是否还有下一页
+	laptops, err := server.laptopStore.List(ctx, afterID, pageSize+1)
+	if err != nil {
+		if err := contextError(ctx); err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "cannot list laptops: %v", err)
+	}
+
+	res := &pb.ListLaptopsResponse{Laptops: laptops}
+	if len(laptops) > pageSize {
+		res.Laptops = laptops[:pageSize]
+		res.NextPageToken = encodePageToken(res.Laptops[pageSize-1].GetId())
+	}
+	return res, nil
+}
+
 func (server *LaptopServer) SearchLaptop(
 	req *pb.SearchLaptopRequest,
 	stream pb.LaptopService_SearchLaptopServer) error {
 	//第一件事是从请求中获取过滤器。
 	filter := req.GetFilter()
-	log.Printf("receive a search-laptop with filter:%w", filter) //找到了，记录日志
+	log.Printf("receive a search-laptop with filter:%v", filter) //找到了，记录日志
 
-	err := server.laptopStore.Search(
+	for _, key := range req.GetSortBy() {
+		if key.GetField() == pb.SortKey_UNKNOWN {
+			return status.Error(codes.InvalidArgument, "sort field is not provided")
+		}
+		if _, ok := pb.SortKey_Field_name[int32(key.GetField())]; !ok { //比服务器新的客户端可能发送不认识的字段
+			return status.Errorf(codes.InvalidArgument, "unknown sort field %d", key.GetField())
+		}
+	}
+	predicate, err := query.Parse(req.GetQuery())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid query: %v", err)
+	}
+
+	options := &SearchOptions{
+		Predicate:  predicate,
+		SortBy:     req.GetSortBy(),
+		MaxResults: int(req.GetMaxResults()),
+		Rating:     server.averageRating,
+	}
+
+	err = server.laptopStore.Search(
 		stream.Context(), //在流中获取上下文，将其传递给search函数
 		filter,           //传入过滤器
+		options,          //排序方式和最多返回的数量
 		func(laptop *pb.Laptop) error { //传入回调函数
 			res := &pb.SearchLaptopResponse{Laptop: laptop} //用此电脑创建一个新的响应对象
 
@@ -109,11 +372,74 @@ func (server *LaptopServer) SearchLaptop(
 		},
 	)
 	if err != nil {
-		return status.Errorf(codes.Internal, "unexpected error:%w", err) //发送内部错误，返回状态码
+		return status.Errorf(codes.Internal, "unexpected error:%v", err) //发送内部错误，返回状态码
 	}
 	return nil
 }
 
+//统计符合过滤条件的电脑在各个属性上的分布
+func (server *LaptopServer) AggregateLaptops(
+	ctx context.Context,
+	req *pb.AggregateLaptopsRequest,
+) (*pb.AggregateLaptopsResponse, error) {
+	log.Printf("receive an aggregate-laptops with filter:%v", req.GetFilter())
+
+	res, err := server.laptopStore.Aggregate(ctx, req.GetFilter(), req.GetFacets())
+	if err != nil {
+		if errors.Is(err, ErrInvalidFacet) {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		if err := contextError(ctx); err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "cannot aggregate laptops: %v", err)
+	}
+	return res, nil
+}
+
+//把store中电脑的变化以流的方式发给客户端，直到客户端断开
+func (server *LaptopServer) WatchLaptops(
+	req *pb.WatchLaptopsRequest,
+	stream pb.LaptopService_WatchLaptopsServer,
+) error {
+	log.Printf("receive a watch-laptops with filter:%v", req.GetFilter())
+
+	err := server.laptopStore.Watch(
+		stream.Context(),
+		req.GetFilter(),
+		req.ResumeAfter,
+		func(event *pb.LaptopEvent) error {
+			return stream.Send(&pb.WatchLaptopsResponse{Event: event})
+		},
+	)
+	switch {
+	case errors.Is(err, ErrEventsExpired):
+		return logError(status.Errorf(codes.OutOfRange, "cannot resume watch: %v", err))
+	case errors.Is(err, ErrSubscriberTooSlow):
+		//客户端可以用最后收到的事件序号重新订阅
+		return logError(status.Errorf(codes.ResourceExhausted, "watch is closed: %v", err))
+	case err != nil:
+		if err := contextError(stream.Context()); err != nil {
+			return err
+		}
+		return logError(status.Errorf(codes.Internal, "cannot watch laptops: %v", err))
+	}
+	return nil
+}
+
+//返回电脑的平均评分，没有评分时为0
+func (server *LaptopServer) averageRating(laptopID string) float64 {
+	if server.ratingStore == nil {
+		return 0
+	}
+	rating, err := server.ratingStore.Find(laptopID)
+	if err != nil {
+		log.Printf("cannot find rating of laptop %s: %v", laptopID, err)
+		return 0
+	}
+	return rating.Average()
+}
+
 //以客户端流的方式上传电脑图片
 func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServer) error {
 	req, err := stream.Recv() //接收一个包含stream信息的请求
@@ -133,8 +459,24 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 		return logError(status.Errorf(codes.InvalidArgument, "laptop id %s doesn't exist", laptopID))
 	}
 
-	imageData := bytes.Buffer{} //创建一个字节缓冲区来存储图像
-	imageSize := 0              //记录图像大小
+	owner := imageOwner(stream.Context())
+	allowance, err := server.limits.allowance(server.imageStore, nil, owner, laptopID) //这次上传最多可以使用的字节数
+	if err != nil {
+		return uploadError(err)
+	}
+
+	//图像暂存在上传文件夹中，不在内存中保存整个图像
+	imageData, _, err := server.uploads.createFile()
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot stage image: %v", err))
+	}
+	defer func() {
+		imageData.Close()
+		os.Remove(imageData.Name())
+	}()
+	var header []byte //前imageSniffLen个字节，用来检查图像类型
+	imageSize := 0    //记录图像大小
+	storedType := ""  //根据图像内容检测到的类型，不使用客户端给出的类型作为扩展名
 
 	//循环接收图像数据
 	for {
@@ -159,25 +501,46 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 
 		log.Printf("receive a chunk with size: %d", size)
 
-		imageSize += size             //图像总长度
-		if imageSize > maxImageSize { //提前设置图片的最大长度
-			return logError(status.Errorf(codes.InvalidArgument, "image is too large: %d > %d", imageSize, maxImageSize))
+		imageSize += size //图像总长度
+		//超过限制时马上停止接收
+		if err := server.limits.checkSize(int64(imageSize), allowance); err != nil {
+			return uploadError(err)
 		}
 
 		//假设缓慢写入
 		// time.Sleep(time.Second)
 
-		_, err = imageData.Write(chunk) //将接受到的数据块附加到图像数据中
+		_, err = imageData.Write(chunk) //将接受到的数据块附加到暂存文件中
 		if err != nil {
 			return logError(status.Errorf(codes.Internal, "cannot write chunk data: %v", err))
 		}
+
+		//收到足够的字节后马上检查图像类型，不合法的图像不用等到全部上传完
+		if storedType == "" {
+			header = append(header, chunk...)
+			if len(header) >= imageSniffLen {
+				storedType, err = checkImageType(imageType, header)
+				if err != nil {
+					return logError(status.Errorf(codes.InvalidArgument, "invalid image: %v", err))
+				}
+				header = nil
+			}
+		}
+	}
+
+	if storedType == "" { //图像比imageSniffLen还短
+		storedType, err = checkImageType(imageType, header)
+		if err != nil {
+			return logError(status.Errorf(codes.InvalidArgument, "invalid image: %v", err))
+		}
 	}
 
 	//将图片数据保存到store，并取回图像id
-	imageID, err := server.imageStore.Save(laptopID, imageType, imageData)
+	imageID, err := server.saveImage(owner, laptopID, storedType, io.NewSectionReader(imageData, 0, int64(imageSize)), int64(imageSize))
 	if err != nil {
-		return logError(status.Errorf(codes.Internal, "cannot save image to the store: %v", err))
+		return uploadError(err)
 	}
+	server.saveRenditions(imageID, io.NewSectionReader(imageData, 0, int64(imageSize)))
 
 	res := &pb.UploadImageResponse{ //创建带有图像ID和图像大小的响应对象。
 		Id:   imageID,
@@ -193,8 +556,424 @@ func (server *LaptopServer) UploadImage(stream pb.LaptopService_UploadImageServe
 	return nil
 }
 
+// SetUploadFolder sets the folder where resumable uploads are staged, empty means the system temporary folder
+func (server *LaptopServer) SetUploadFolder(folder string) {
+	server.uploads = newUploadSessions(folder)
+}
+
+//开始一次可以断点续传的上传，返回上传id
+func (server *LaptopServer) StartImageUpload(
+	ctx context.Context,
+	req *pb.StartImageUploadRequest,
+) (*pb.StartImageUploadResponse, error) {
+	laptopID := req.GetInfo().GetLaptopId()
+	imageType := req.GetInfo().GetImageType()
+	log.Printf("receive a start-image-upload request for laptop %s with image type %s", laptopID, imageType)
+
+	if err := server.checkImageLaptop(laptopID); err != nil {
+		return nil, err
+	}
+	if imageType != "" && !isSupportedImageType(imageType) {
+		return nil, logError(status.Errorf(codes.InvalidArgument, "%v: %s", ErrUnsupportedImageType, imageType))
+	}
+	owner := imageOwner(ctx)
+	if _, err := server.limits.allowance(server.imageStore, nil, owner, laptopID); err != nil {
+		return nil, uploadError(err)
+	}
+
+	session, err := server.uploads.start(laptopID, imageType, owner)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot start upload: %v", err))
+	}
+	log.Printf("started upload %s for laptop %s", session.id, laptopID)
+	return &pb.StartImageUploadResponse{UploadId: session.id}, nil
+}
+
+//上传的电脑必须存在
+func (server *LaptopServer) checkImageLaptop(laptopID string) error {
+	laptop, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		return logError(status.Errorf(codes.InvalidArgument, "laptop id %s doesn't exist", laptopID))
+	}
+	return nil
+}
+
+//返回当前用户进行中的上传，找不到时返回NotFound
+func (server *LaptopServer) findUpload(ctx context.Context, uploadID string) (*uploadSession, error) {
+	if uploadID == "" {
+		return nil, logError(status.Error(codes.InvalidArgument, "upload id is required"))
+	}
+	session := server.uploads.find(uploadID)
+	if session == nil || session.owner != imageOwner(ctx) { //不告诉其他用户这个上传是否存在
+		return nil, logError(status.Errorf(codes.NotFound, "upload %s is not found", uploadID))
+	}
+	return session, nil
+}
+
+//把上传数据块时的错误转换成gRPC状态
+func uploadError(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return logError(status.Errorf(codes.NotFound, "upload is not found: %v", err))
+	case errors.Is(err, ErrUploadOffsetMismatch):
+		//客户端用GetImageUpload查询已经确认的字节数后从那里继续
+		return logError(status.Errorf(codes.FailedPrecondition, "cannot write chunk: %v", err))
+	case errors.Is(err, ErrChecksumMismatch):
+		//数据在传输中损坏，客户端可以重新发送
+		return logError(status.Errorf(codes.DataLoss, "invalid image data: %v", err))
+	case errors.Is(err, ErrImageTooLarge),
+		errors.Is(err, ErrTooManyImages),
+		errors.Is(err, ErrQuotaExceeded):
+		return logError(status.Errorf(codes.ResourceExhausted, "cannot upload image: %v", err))
+	case errors.Is(err, ErrUnsupportedImageType),
+		errors.Is(err, ErrImageTypeMismatch):
+		return logError(status.Errorf(codes.InvalidArgument, "invalid image: %v", err))
+	}
+	return logError(status.Errorf(codes.Internal, "cannot upload image: %v", err))
+}
+
+//UploadImageChunks是一个客户端流RPC，每个数据块带有位置和CRC32C校验和
+//已经确认的数据块在连接断开后仍然保留
+func (server *LaptopServer) UploadImageChunks(stream pb.LaptopService_UploadImageChunksServer) error {
+	var session *uploadSession
+	var allowance int64 //这个上传最多可以使用的字节数
+	var committed uint64
+	for {
+		if err := contextError(stream.Context()); err != nil {
+			return err
+		}
+
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return logError(status.Errorf(codes.Unknown, "cannot receive chunk data: %v", err))
+		}
+
+		if session == nil || session.id != req.GetUploadId() {
+			session, err = server.findUpload(stream.Context(), req.GetUploadId())
+			if err != nil {
+				return err
+			}
+			allowance, err = server.limits.allowance(server.imageStore, nil, session.owner, session.laptopID)
+			if err != nil {
+				return uploadError(err)
+			}
+		}
+		//位置不对的数据块会被session拒绝，所以可以用它计算上传后的大小
+		if err := server.limits.checkSize(int64(req.GetOffset())+int64(len(req.GetChunkData())), allowance); err != nil {
+			return uploadError(err)
+		}
+		committed, err = session.write(req.GetOffset(), req.GetChunkData(), req.GetCrc32C())
+		if err != nil {
+			return uploadError(err)
+		}
+	}
+
+	return stream.SendAndClose(&pb.UploadImageChunksResponse{CommittedOffset: committed})
+}
+
+//返回上传已经确认的字节数，客户端断开后从这里继续上传
+func (server *LaptopServer) GetImageUpload(
+	ctx context.Context,
+	req *pb.GetImageUploadRequest,
+) (*pb.GetImageUploadResponse, error) {
+	session, err := server.findUpload(ctx, req.GetUploadId())
+	if err != nil {
+		return nil, err
+	}
+	committed, err := session.committed()
+	if err != nil {
+		return nil, uploadError(err)
+	}
+	return &pb.GetImageUploadResponse{CommittedOffset: committed}, nil
+}
+
+//检查整个图像的SHA-256，然后把暂存的图像保存到ImageStore
+func (server *LaptopServer) FinishImageUpload(
+	ctx context.Context,
+	req *pb.FinishImageUploadRequest,
+) (*pb.UploadImageResponse, error) {
+	log.Printf("receive a finish-image-upload request for upload %s", req.GetUploadId())
+
+	session, err := server.findUpload(ctx, req.GetUploadId())
+	if err != nil {
+		return nil, err
+	}
+	if err := server.checkImageLaptop(session.laptopID); err != nil { //上传的过程中电脑被删除了
+		server.uploads.remove(session)
+		return nil, err
+	}
+
+	var imageID string
+	var size int64
+	err = server.uploads.finish(session, strings.ToLower(req.GetSha256()), func(imageType string, data io.ReadSeeker, imageSize int64) error {
+		var err error
+		imageID, err = server.saveImage(session.owner, session.laptopID, imageType, data, imageSize)
+		if err != nil {
+			return err
+		}
+		size = imageSize
+		if _, err := data.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		server.saveRenditions(imageID, data)
+		return nil
+	})
+	if err != nil {
+		return nil, uploadError(err)
+	}
+
+	log.Printf("saved image with id: %s, size: %d", imageID, size)
+	return &pb.UploadImageResponse{Id: imageID, Size: uint32(size)}, nil
+}
+
+//返回当前用户上传的图像占用的空间和上传限制
+func (server *LaptopServer) GetImageUsage(
+	ctx context.Context,
+	req *pb.GetImageUsageRequest,
+) (*pb.GetImageUsageResponse, error) {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, logError(status.Error(codes.Unauthenticated, "image usage is only available to authenticated users"))
+	}
+
+	usage, err := server.imageStore.Usage(claims.Username)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot get image usage: %v", err))
+	}
+	return &pb.GetImageUsageResponse{
+		Username:           claims.Username,
+		ImageCount:         uint32(usage.Images),
+		UsedBytes:          uint64(usage.Bytes),
+		QuotaBytes:         uint64(server.limits.UserQuota),
+		MaxImageSize:       uint64(server.limits.MaxImageSize),
+		MaxImagesPerLaptop: uint32(server.limits.MaxImagesPerLaptop),
+	}, nil
+}
+
+//生成并保存缩略图，失败时只记录日志，原图已经保存成功，上传不会因此失败
+//例如标准库不能解码WebP，WebP图像只有原图
+func (server *LaptopServer) saveRenditions(imageID string, data io.ReadSeeker) {
+	renditions, err := generateRenditions(data, server.renditions)
+	if err != nil {
+		log.Printf("cannot generate renditions of image %s: %v", imageID, err)
+		return
+	}
+	for _, rendition := range renditions {
+		if err := server.imageStore.SaveRendition(imageID, rendition); err != nil {
+			log.Printf("cannot save rendition %s of image %s: %v", rendition.Name, imageID, err)
+			continue
+		}
+		log.Printf("saved rendition %s of image %s: %dx%d", rendition.Name, imageID, rendition.Width, rendition.Height)
+	}
+}
+
+//列出一台电脑的所有图像
+func (server *LaptopServer) ListImages(
+	ctx context.Context,
+	req *pb.ListImagesRequest,
+) (*pb.ListImagesResponse, error) {
+	laptopID := req.GetLaptopId()
+	rendition := req.GetRendition()
+	log.Printf("receive a list-images request for laptop %s with rendition %q", laptopID, rendition)
+
+	if err := checkLaptopID(laptopID); err != nil {
+		return nil, err
+	}
+	laptop, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if laptop == nil {
+		return nil, logError(status.Errorf(codes.NotFound, "laptop %s is not found", laptopID))
+	}
+
+	images, err := server.imageStore.List(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot list images: %v", err))
+	}
+
+	res := &pb.ListImagesResponse{}
+	for _, image := range images {
+		info := &pb.ImageInfo{
+			LaptopId:  image.LaptopID,
+			ImageType: image.Type,
+			Size:      uint64(image.Size),
+		}
+		if rendition != "" {
+			saved := image.Rendition(rendition)
+			if saved == nil { //没有这个尺寸的缩略图
+				continue
+			}
+			info.ImageType = saved.Type
+			info.Size = uint64(saved.Size)
+		}
+
+		var names []string
+		for _, saved := range image.Renditions {
+			names = append(names, saved.Name)
+		}
+		res.Images = append(res.Images, &pb.Image{
+			Id:         image.ID,
+			Info:       info,
+			Renditions: names,
+		})
+	}
+	return res, nil
+}
+
+//删除一张图像，例如上传错了的图像
+func (server *LaptopServer) DeleteImage(
+	ctx context.Context,
+	req *pb.DeleteImageRequest,
+) (*pb.DeleteImageResponse, error) {
+	imageID := req.GetImageId()
+	log.Printf("receive a delete-image request for image %s", imageID)
+
+	if imageID == "" {
+		return nil, logError(status.Error(codes.InvalidArgument, "image id is required"))
+	}
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	err := server.imageStore.Delete(imageID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, logError(status.Errorf(codes.NotFound, "image %s is not found", imageID))
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot delete image: %v", err))
+	}
+
+	log.Printf("deleted image with id: %s", imageID)
+	return &pb.DeleteImageResponse{}, nil
+}
+
+//找出超过宽限期的没有用的图像、文件和上传，不是dry run时删除它们
+func (server *LaptopServer) CollectImageGarbage(
+	ctx context.Context,
+	req *pb.CollectImageGarbageRequest,
+) (*pb.CollectImageGarbageResponse, error) {
+	log.Printf("receive a collect-image-garbage request with dry run %t", req.GetDryRun())
+
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	report, err := server.collectImageGarbage(req.GetDryRun())
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot collect image garbage: %v", err))
+	}
+
+	res := &pb.CollectImageGarbageResponse{
+		Failed:     uint32(report.Failed),
+		FreedBytes: uint64(report.FreedBytes),
+	}
+	for _, garbage := range report.Removed {
+		res.Removed = append(res.Removed, &pb.ImageGarbage{
+			Kind:       pb.ImageGarbage_Kind(garbage.Kind),
+			Name:       garbage.Name,
+			LaptopId:   garbage.LaptopID,
+			Size:       uint64(garbage.Size),
+			ModifiedAt: timestamppb.New(garbage.ModTime),
+		})
+	}
+	return res, nil
+}
+
+//DownloadImage是一个服务器流RPC，先发送图像信息，再把图像从offset开始分块发给客户端
+func (server *LaptopServer) DownloadImage(
+	req *pb.DownloadImageRequest,
+	stream pb.LaptopService_DownloadImageServer,
+) error {
+	imageID := req.GetImageId()
+	offset := req.GetOffset()
+	rendition := req.GetRendition()
+	log.Printf("receive a download-image request for image %s rendition %q from offset %d", imageID, rendition, offset)
+
+	if imageID == "" {
+		return logError(status.Error(codes.InvalidArgument, "image id is required"))
+	}
+	info, err := server.imageStore.Find(imageID)
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot find image: %v", err))
+	}
+	if info == nil {
+		return logError(status.Errorf(codes.NotFound, "image %s is not found", imageID))
+	}
+	imageType, size := info.Type, info.Size
+	if rendition != "" {
+		saved := info.Rendition(rendition)
+		if saved == nil {
+			return logError(status.Errorf(codes.NotFound, "image %s has no rendition %q", imageID, rendition))
+		}
+		imageType, size = saved.Type, saved.Size
+	}
+	if offset > uint64(size) {
+		return logError(status.Errorf(codes.OutOfRange, "offset %d is larger than image size %d", offset, size))
+	}
+
+	reader, err := server.imageStore.Open(imageID, rendition, int64(offset))
+	if errors.Is(err, ErrNotFound) { //查找之后图像被删除了
+		return logError(status.Errorf(codes.NotFound, "image %s is not found", imageID))
+	}
+	if err != nil {
+		return logError(status.Errorf(codes.Internal, "cannot open image: %v", err))
+	}
+	defer reader.Close()
+
+	res := &pb.DownloadImageResponse{
+		Data: &pb.DownloadImageResponse_Info{
+			Info: &pb.ImageInfo{
+				LaptopId:  info.LaptopID,
+				ImageType: imageType,
+				Size:      uint64(size),
+			},
+		},
+	}
+	if err := stream.Send(res); err != nil {
+		return logError(status.Errorf(codes.Unknown, "cannot send image info: %v", err))
+	}
+
+	buffer := make([]byte, downloadChunkSize)
+	for {
+		if err := contextError(stream.Context()); err != nil {
+			return err
+		}
+
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			res := &pb.DownloadImageResponse{
+				Data: &pb.DownloadImageResponse_ChunkData{ChunkData: buffer[:n]},
+			}
+			if err := stream.Send(res); err != nil {
+				return logError(status.Errorf(codes.Unknown, "cannot send chunk data: %v", err))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return logError(status.Errorf(codes.Internal, "cannot read image: %v", err))
+		}
+	}
+
+	log.Printf("sent image with id: %s, size: %d", imageID, size-int64(offset))
+	return nil
+}
+
 //RateLaptop是一个双向流RPC，它允许客户端对笔记本电脑流进行评分，并返回每个笔记本电脑的平均分数流
 func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer) error {
+	//每个用户对一台电脑只有一个评分，所以必须知道是哪个用户
+	claims := ClaimsFromContext(stream.Context())
+	if claims == nil {
+		return logError(status.Error(codes.Unauthenticated, "rating is only available to authenticated users"))
+	}
+
 	for {	//因为要在流中接收多个请求，所以我们使用for循环
 		//先检查上下文是否已失效
 		err := contextError(stream.Context())
@@ -212,39 +991,176 @@ func (server *LaptopServer) RateLaptop(stream pb.LaptopService_RateLaptopServer)
 			return logError(status.Errorf(codes.Unknown, "cannot receive stream request: %v", err))
 		}
 
-		//从请求中获取电脑ID和评级。
-		laptopID := req.GetLaptopId()
-		score := req.GetScore()
-
-		log.Printf("received a rate-laptop request: id = %s, score = %.2f", laptopID, score)
-
-		//检查收到的电脑ID是否存在
-		found, err := server.laptopStore.Find(laptopID)
+		res, err := server.rateLaptop(claims.Username, req)
 		if err != nil {
-			return logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
-		}
-		if found == nil {
-			return logError(status.Errorf(codes.NotFound, "laptopID %s is not found", laptopID))
+			return err
 		}
 
-		//将新的电脑评级添加到存储，取回更新后的评级对象。
-		rating, err := server.ratingStore.Add(laptopID, score)
+		//将响应发回客户端。
+		err = stream.Send(res)
 		if err != nil {
-			return logError(status.Errorf(codes.Internal, "cannot add rating to the store: %v", err))
+			return logError(status.Errorf(codes.Unknown, "cannot send stream response: %v", err))
 		}
+	}
+	return nil
+}
+
+//处理流中的一个评分请求
+//评分不合法或者电脑不存在时只拒绝这个请求，在响应中返回原因；服务器内部错误时返回错误并结束流
+func (server *LaptopServer) rateLaptop(username string, req *pb.RateLaptopRequest) (*pb.RateLaptopResponse, error) {
+	//从请求中获取电脑ID和评级。
+	laptopID := req.GetLaptopId()
+	score := req.GetScore()
+
+	log.Printf("received a rate-laptop request from %s: id = %s, score = %.2f", username, laptopID, score)
+
+	reject := func(code codes.Code, format string, args ...interface{}) *pb.RateLaptopResponse {
+		message := fmt.Sprintf(format, args...)
+		log.Printf("rejected a rate-laptop request: %s", message)
+		return &pb.RateLaptopResponse{LaptopId: laptopID, Code: uint32(code), Message: message}
+	}
+	if err := checkScore(score); err != nil {
+		return reject(codes.InvalidArgument, "%v", err), nil
+	}
+
+	//检查收到的电脑ID是否存在
+	found, err := server.laptopStore.Find(laptopID)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+	}
+	if found == nil {
+		return reject(codes.NotFound, "laptopID %s is not found", laptopID), nil
+	}
 
-		//创建响应对象。
-		res := &pb.RateLaptopResponse{
-			LaptopId:     laptopID,
-			RatedCount:   rating.Count,
-			AverageScore: rating.Sum / float64(rating.Count),
+	//记录用户的评分，替换这个用户之前的评分，取回更新后的评级对象。
+	rating, err := server.ratingStore.Rate(laptopID, username, score)
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot add rating to the store: %v", err))
+	}
+
+	//创建响应对象。
+	return &pb.RateLaptopResponse{
+		LaptopId:     laptopID,
+		RatedCount:   rating.Count,
+		AverageScore: rating.Average(),
+	}, nil
+}
+
+//撤回当前用户对电脑的评分，返回撤回之后的评分
+func (server *LaptopServer) WithdrawRating(
+	ctx context.Context,
+	req *pb.WithdrawRatingRequest,
+) (*pb.WithdrawRatingResponse, error) {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, logError(status.Error(codes.Unauthenticated, "rating is only available to authenticated users"))
+	}
+	laptopID := req.GetLaptopId()
+	log.Printf("receive a withdraw-rating request from %s for laptop %s", claims.Username, laptopID)
+
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	rating, err := server.ratingStore.Withdraw(laptopID, claims.Username)
+	if errors.Is(err, ErrNotFound) {
+		return nil, logError(status.Errorf(codes.NotFound, "%s has not rated laptop %s", claims.Username, laptopID))
+	}
+	if err != nil {
+		return nil, logError(status.Errorf(codes.Internal, "cannot withdraw rating: %v", err))
+	}
+
+	return &pb.WithdrawRatingResponse{
+		LaptopId:     laptopID,
+		RatedCount:   rating.Count,
+		AverageScore: rating.Average(),
+	}, nil
+}
+
+//返回一台或者多台电脑评分的分布，有一台电脑不存在时整个请求返回NotFound
+func (server *LaptopServer) GetRating(
+	ctx context.Context,
+	req *pb.GetRatingRequest,
+) (*pb.GetRatingResponse, error) {
+	laptopIDs := req.GetLaptopIds()
+	log.Printf("receive a get-rating request for %d laptops", len(laptopIDs))
+
+	if len(laptopIDs) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "laptop IDs are not provided")
+	}
+	if len(laptopIDs) > maxRatingLaptops {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot get ratings of more than %d laptops", maxRatingLaptops)
+	}
+
+	res := &pb.GetRatingResponse{}
+	for _, laptopID := range laptopIDs {
+		if err := contextError(ctx); err != nil {
+			return nil, err
+		}
+		if err := checkLaptopID(laptopID); err != nil {
+			return nil, err
+		}
+		laptop, err := server.laptopStore.Find(laptopID)
+		if err != nil {
+			return nil, logError(status.Errorf(codes.Internal, "cannot find laptop: %v", err))
+		}
+		if laptop == nil {
+			return nil, status.Errorf(codes.NotFound, "laptop id %s doesn't exist", laptopID)
 		}
 
-		//将响应发回客户端。
-		err = stream.Send(res)
+		rating, err := server.ratingStore.Find(laptopID)
 		if err != nil {
-			return logError(status.Errorf(codes.Unknown, "cannot send stream response: %v", err))
+			return nil, logError(status.Errorf(codes.Internal, "cannot find rating: %v", err))
+		}
+		if rating == nil { //还没有评分
+			rating = &Rating{}
 		}
+		res.Ratings = append(res.Ratings, &pb.LaptopRating{
+			LaptopId:  laptopID,
+			Count:     rating.Count,
+			Mean:      rating.Average(),
+			Median:    rating.Median(),
+			Stddev:    rating.StdDev(),
+			Histogram: append([]uint32(nil), rating.Histogram[:]...),
+		})
+	}
+	return res, nil
+}
+
+//page token对客户端是不透明的，里面记录的是上一页最后一台电脑的id
+func encodePageToken(lastID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(pageTokenPrefix + lastID))
+}
+
+func decodePageToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(string(data), pageTokenPrefix) {
+		return "", errors.New("unknown token format")
+	}
+	return strings.TrimPrefix(string(data), pageTokenPrefix), nil
+}
+
+//检查客户端传来的laptop id是否是一个有效的uuid
+func checkLaptopID(laptopID string) error {
+	if len(laptopID) == 0 {
+		return status.Error(codes.InvalidArgument, "laptop ID is not provided")
+	}
+	if _, err := uuid.Parse(laptopID); err != nil {
+		return status.Errorf(codes.InvalidArgument, "laptop ID is not a valid uuid:%v", err)
+	}
+	return nil
+}
+
+//价格必须是有限的数，NaN和Inf没法和过滤器中的价格比较
+func checkLaptopPrice(laptop *pb.Laptop) error {
+	if price := laptop.GetPriceUsd(); math.IsNaN(price) || math.IsInf(price, 0) {
+		return status.Errorf(codes.InvalidArgument, "laptop price %v is not a finite number", price)
 	}
 	return nil
 }
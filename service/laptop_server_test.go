@@ -5,11 +5,13 @@ import (
 	"grpctest/pb"
 	"grpctest/sample"
 	"grpctest/service"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 func TestServerCreateLaptop(t *testing.T) {
@@ -21,6 +23,9 @@ func TestServerCreateLaptop(t *testing.T) {
 	laptopInvalidID := sample.NewLaptop()
 	laptopInvalidID.Id = "invalid-uuid"
 
+	laptopNaNPrice := sample.NewLaptop()
+	laptopNaNPrice.PriceUsd = math.NaN()
+
 	laptopDuplicateID := sample.NewLaptop()
 	storeDuplicateID := service.NewInMemoryLaptopStore()
 	err := storeDuplicateID.Save(laptopDuplicateID) //测试保存之前先将laptopDuplicateID存入store
@@ -52,6 +57,12 @@ func TestServerCreateLaptop(t *testing.T) {
 			store:  service.NewInMemoryLaptopStore(),
 			code:   codes.InvalidArgument,
 		},
+		{
+			name:   "failure_nan_price", //价格不是有限的数
+			laptop: laptopNaNPrice,
+			store:  service.NewInMemoryLaptopStore(),
+			code:   codes.InvalidArgument,
+		},
 		{
 			name:   "failure_duplicate_id", //测试客户端发过来的电脑ID是无效的。
 			laptop: laptopDuplicateID,
@@ -92,3 +103,326 @@ func TestServerCreateLaptop(t *testing.T) {
 		})
 	}
 }
+
+func TestServerGetLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptop := sample.NewLaptop()
+	store := service.NewInMemoryLaptopStore()
+	err := store.Save(laptop)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name string
+		id   string
+		code codes.Code
+	}{
+		{name: "success", id: laptop.Id, code: codes.OK},
+		{name: "failure_invalid_id", id: "invalid-uuid", code: codes.InvalidArgument},
+		{name: "failure_not_found", id: sample.NewLaptop().Id, code: codes.NotFound},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := service.NewLaptopServer(store, nil, nil)
+			res, err := server.GetLaptop(context.Background(), &pb.GetLaptopRequest{Id: tc.id})
+			if tc.code == codes.OK {
+				require.NoError(t, err)
+				require.Equal(t, tc.id, res.GetLaptop().GetId())
+			} else {
+				require.Nil(t, res)
+				require.Equal(t, tc.code, status.Code(err))
+			}
+		})
+	}
+}
+
+func TestServerUpdateLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptop := sample.NewLaptop()
+	laptop.UpdateAt = nil
+	store := service.NewInMemoryLaptopStore()
+	err := store.Save(laptop)
+	require.NoError(t, err)
+
+	server := service.NewLaptopServer(store, nil, nil)
+
+	changed, err := store.Find(laptop.Id)
+	require.NoError(t, err)
+	changed.PriceUsd = 1234
+
+	res, err := server.UpdateLaptop(context.Background(), &pb.UpdateLaptopRequest{Laptop: changed})
+	require.NoError(t, err)
+	require.NotNil(t, res.GetLaptop().GetUpdateAt()) //更新时必须刷新update_at
+
+	saved, err := store.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, 1234.0, saved.GetPriceUsd())
+	require.True(t, saved.GetUpdateAt().AsTime().Equal(res.GetLaptop().GetUpdateAt().AsTime()))
+
+	require.Equal(t, uint64(1), saved.GetVersion())
+
+	//用过时的版本号更新应该返回Aborted，并且不会覆盖已保存的电脑
+	stale := sample.NewLaptop()
+	stale.Id = laptop.Id
+	_, err = server.UpdateLaptop(context.Background(), &pb.UpdateLaptopRequest{Laptop: stale})
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	saved, err = store.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, 1234.0, saved.GetPriceUsd())
+
+	//价格不是有限的数
+	saved.PriceUsd = math.Inf(1)
+	_, err = server.UpdateLaptop(context.Background(), &pb.UpdateLaptopRequest{Laptop: saved})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	//laptop不存在
+	_, err = server.UpdateLaptop(context.Background(), &pb.UpdateLaptopRequest{Laptop: sample.NewLaptop()})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	//没有提供laptop
+	_, err = server.UpdateLaptop(context.Background(), &pb.UpdateLaptopRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServerDeleteLaptop(t *testing.T) {
+	t.Parallel()
+
+	laptop := sample.NewLaptop()
+	store := service.NewInMemoryLaptopStore()
+	err := store.Save(laptop)
+	require.NoError(t, err)
+
+	server := service.NewLaptopServer(store, nil, nil)
+
+	staleVersion := uint64(3)
+	_, err = server.DeleteLaptop(context.Background(), &pb.DeleteLaptopRequest{Id: laptop.Id, Version: &staleVersion})
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	version := uint64(0)
+	_, err = server.DeleteLaptop(context.Background(), &pb.DeleteLaptopRequest{Id: laptop.Id, Version: &version})
+	require.NoError(t, err)
+
+	other, err := store.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Nil(t, other)
+
+	//再次删除同一台电脑应该返回NotFound
+	_, err = server.DeleteLaptop(context.Background(), &pb.DeleteLaptopRequest{Id: laptop.Id})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = server.DeleteLaptop(context.Background(), &pb.DeleteLaptopRequest{Id: ""})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServerUpdateLaptopWithFieldMask(t *testing.T) {
+	t.Parallel()
+
+	laptop := sample.NewLaptop()
+	store := service.NewInMemoryLaptopStore()
+	err := store.Save(laptop)
+	require.NoError(t, err)
+
+	server := service.NewLaptopServer(store, nil, nil)
+
+	//只带着需要修改的字段，其他字段都是空的
+	patch := &pb.Laptop{
+		Id:       laptop.Id,
+		PriceUsd: 999,
+		Cpu:      &pb.CPU{MaxGhz: 5.5},
+		Gpus:     []*pb.GPU{sample.NewGPU(), sample.NewGPU()},
+		Weight:   &pb.Laptop_WeightLb{WeightLb: 4.4},
+	}
+	req := &pb.UpdateLaptopRequest{
+		Laptop:     patch,
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"price_usd", "cpu.max_ghz", "gpus", "weight_lb"}},
+	}
+	res, err := server.UpdateLaptop(context.Background(), req)
+	require.NoError(t, err)
+
+	saved, err := store.Find(laptop.Id)
+	require.NoError(t, err)
+	requireSameLaptop(t, saved, res.GetLaptop())
+
+	require.Equal(t, 999.0, saved.GetPriceUsd())
+	require.Equal(t, 5.5, saved.GetCpu().GetMaxGhz())
+	require.Equal(t, laptop.GetCpu().GetMinGhz(), saved.GetCpu().GetMinGhz()) //没有在mask中的字段保持不变
+	require.Equal(t, laptop.GetCpu().GetName(), saved.GetCpu().GetName())
+	require.Len(t, saved.GetGpus(), 2)
+	require.Equal(t, 4.4, saved.GetWeightLb())
+	require.Zero(t, saved.GetWeightKg())
+	require.Equal(t, laptop.GetBrand(), saved.GetBrand())
+	require.Equal(t, uint64(1), saved.GetVersion())
+
+	//patch中没有cpu时，cpu.min_ghz会被清除
+	req = &pb.UpdateLaptopRequest{
+		Laptop:     &pb.Laptop{Id: laptop.Id},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"cpu.min_ghz"}},
+	}
+	res, err = server.UpdateLaptop(context.Background(), req)
+	require.NoError(t, err)
+	require.Zero(t, res.GetLaptop().GetCpu().GetMinGhz())
+	require.Equal(t, 5.5, res.GetLaptop().GetCpu().GetMaxGhz())
+
+	//两个客户端都读到了版本2，带着expected_version修改同一个字段，后到的修改返回Aborted
+	version := res.GetLaptop().GetVersion()
+	for i, price := range []float64{1999, 2999} {
+		req := &pb.UpdateLaptopRequest{
+			Laptop:          &pb.Laptop{Id: laptop.Id, PriceUsd: price},
+			UpdateMask:      &fieldmaskpb.FieldMask{Paths: []string{"price_usd"}},
+			ExpectedVersion: &version,
+		}
+		_, err := server.UpdateLaptop(context.Background(), req)
+		if i == 0 {
+			require.NoError(t, err)
+		} else {
+			require.Equal(t, codes.Aborted, status.Code(err))
+		}
+	}
+	saved, err = store.Find(laptop.Id)
+	require.NoError(t, err)
+	require.Equal(t, 1999.0, saved.GetPriceUsd())
+
+	//没有expected_version时不检查版本号，后写的覆盖先写的
+	req = &pb.UpdateLaptopRequest{
+		Laptop:     &pb.Laptop{Id: laptop.Id, PriceUsd: 2999},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"price_usd"}},
+	}
+	res, err = server.UpdateLaptop(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, 2999.0, res.GetLaptop().GetPriceUsd())
+
+	invalidPaths := []string{"price", "cpu.unknown", "gpus.brand", "id", "version", "update_at", "update_at.seconds", "update_at.nanos"}
+	for _, path := range invalidPaths {
+		req := &pb.UpdateLaptopRequest{
+			Laptop:     patch,
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{path}},
+		}
+		_, err := server.UpdateLaptop(context.Background(), req)
+		require.Equal(t, codes.InvalidArgument, status.Code(err), path)
+	}
+}
+
+func TestServerListLaptops(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+	expectedIDs := make(map[string]bool)
+	for i := 0; i < 25; i++ {
+		laptop := sample.NewLaptop()
+		err := store.Save(laptop)
+		require.NoError(t, err)
+		expectedIDs[laptop.Id] = true
+	}
+
+	server := service.NewLaptopServer(store, nil, nil)
+
+	seen := make(map[string]bool)
+	lastID := ""
+	token := ""
+	for page := 0; ; page++ {
+		req := &pb.ListLaptopsRequest{PageSize: 10, PageToken: token}
+		res, err := server.ListLaptops(context.Background(), req)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(res.GetLaptops()), 10)
+
+		for _, laptop := range res.GetLaptops() {
+			require.Greater(t, laptop.GetId(), lastID) //按id的顺序返回
+			require.False(t, seen[laptop.GetId()])     //同一台电脑不会出现两次
+			seen[laptop.GetId()] = true
+			lastID = laptop.GetId()
+		}
+
+		//翻页的过程中有新的电脑保存进来，已经拿到的token仍然有效
+		err = store.Save(sample.NewLaptop())
+		require.NoError(t, err)
+
+		token = res.GetNextPageToken()
+		if token == "" {
+			break
+		}
+	}
+
+	for id := range expectedIDs {
+		require.True(t, seen[id])
+	}
+
+	_, err := server.ListLaptops(context.Background(), &pb.ListLaptopsRequest{PageToken: "not a token"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServerAggregateLaptops(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+	configs := []struct {
+		brand string
+		price float64
+		ramGB uint64
+		panel pb.Screen_Panel
+	}{
+		{"Apple", 2500, 16, pb.Screen_OLED},
+		{"Apple", 1800, 8, pb.Screen_IPS},
+		{"Dell", 1200, 32, pb.Screen_IPS},
+		{"Dell", 900, 4, pb.Screen_IPS},
+		{"Lenovo", 3200, 64, pb.Screen_OLED}, //价格超出过滤条件
+	}
+	for _, config := range configs {
+		laptop := sample.NewLaptop()
+		laptop.Brand = config.brand
+		laptop.PriceUsd = config.price
+		laptop.Ram = &pb.Memory{Value: config.ramGB, Uint: pb.Memory_GIGABYTE}
+		laptop.Screen.Panel = config.panel
+		err := store.Save(laptop)
+		require.NoError(t, err)
+	}
+
+	server := service.NewLaptopServer(store, nil, nil)
+	req := &pb.AggregateLaptopsRequest{
+		Filter: &pb.Filter{MaxPriceUsd: 3000},
+		Facets: []*pb.Facet{
+			{Field: pb.Facet_BRAND},
+			{Field: pb.Facet_PANEL},
+			{Field: pb.Facet_RAM, Boundaries: []float64{8, 32}},
+			{Field: pb.Facet_PRICE, Boundaries: []float64{1000, 2000}},
+		},
+	}
+	res, err := server.AggregateLaptops(context.Background(), req)
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(4), res.GetTotal())
+	require.Equal(t, 900.0, res.GetPrice().GetMinUsd())
+	require.Equal(t, 2500.0, res.GetPrice().GetMaxUsd())
+	require.Equal(t, 1600.0, res.GetPrice().GetAverageUsd())
+
+	bucketCounts := func(result *pb.FacetResult) map[string]uint64 {
+		counts := make(map[string]uint64)
+		for _, bucket := range result.GetBuckets() {
+			counts[bucket.GetKey()] = bucket.GetCount()
+		}
+		return counts
+	}
+	require.Len(t, res.GetFacets(), 4)
+	require.Equal(t, map[string]uint64{"Apple": 2, "Dell": 2}, bucketCounts(res.GetFacets()[0]))
+	require.Equal(t, map[string]uint64{"IPS": 3, "OLED": 1}, bucketCounts(res.GetFacets()[1]))
+	require.Equal(t, "IPS", res.GetFacets()[1].GetBuckets()[0].GetKey()) //数量多的排在前面
+	require.Equal(t, map[string]uint64{"*-8": 1, "8-32": 2, "32-*": 1}, bucketCounts(res.GetFacets()[2]))
+	require.Equal(t, map[string]uint64{"*-1000": 1, "1000-2000": 2, "2000-*": 1}, bucketCounts(res.GetFacets()[3]))
+
+	priceBuckets := res.GetFacets()[3].GetBuckets()
+	require.Nil(t, priceBuckets[0].From)
+	require.Equal(t, 1000.0, priceBuckets[1].GetFrom())
+	require.Equal(t, 2000.0, priceBuckets[1].GetTo())
+	require.Nil(t, priceBuckets[2].To)
+
+	//区间边界不是递增的
+	req.Facets = []*pb.Facet{{Field: pb.Facet_PRICE, Boundaries: []float64{2000, 1000}}}
+	_, err = server.AggregateLaptops(context.Background(), req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
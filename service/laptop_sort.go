@@ -0,0 +1,177 @@
+//检索选项：额外的过滤条件、结果的排序和数量限制
+package service
+
+import (
+	"container/heap"
+	"grpctest/pb"
+	"sort"
+)
+
+// SearchOptions controls the order and the number of laptops returned by Search
+type SearchOptions struct {
+	Predicate  func(laptop *pb.Laptop) bool  //除了filter之外电脑还需要满足的条件，例如编译后的查询语句
+	SortBy     []*pb.SortKey                 //排序方式，前一个相等时才比较后一个，最后按id排序
+	MaxResults int                           //最多返回多少台电脑，为0时不限制
+	Rating     func(laptopID string) float64 //返回电脑的平均评分，按AVERAGE_RATING排序时使用
+}
+
+//电脑是否满足Predicate，没有设置时都满足
+func (options *SearchOptions) match(laptop *pb.Laptop) bool {
+	return options == nil || options.Predicate == nil || options.Predicate(laptop)
+}
+
+//没有排序也没有数量限制时，Search可以直接边找边发送
+func (options *SearchOptions) isEmpty() bool {
+	return options == nil || (len(options.SortBy) == 0 && options.MaxResults <= 0)
+}
+
+// laptopSorter按SearchOptions比较两台电脑，并缓存每台电脑的评分
+type laptopSorter struct {
+	options *SearchOptions
+	ratings map[string]float64
+}
+
+func newLaptopSorter(options *SearchOptions) *laptopSorter {
+	return &laptopSorter{
+		options: options,
+		ratings: make(map[string]float64),
+	}
+}
+
+func (sorter *laptopSorter) rating(laptop *pb.Laptop) float64 {
+	if sorter.options.Rating == nil {
+		return 0
+	}
+	score, ok := sorter.ratings[laptop.GetId()]
+	if !ok {
+		score = sorter.options.Rating(laptop.GetId())
+		sorter.ratings[laptop.GetId()] = score
+	}
+	return score
+}
+
+func (sorter *laptopSorter) sortValue(laptop *pb.Laptop, field pb.SortKey_Field) float64 {
+	switch field {
+	case pb.SortKey_PRICE:
+		return laptop.GetPriceUsd()
+	case pb.SortKey_CPU_CORES:
+		return float64(laptop.GetCpu().GetNumberCores())
+	case pb.SortKey_CPU_GHZ:
+		return laptop.GetCpu().GetMinGhz()
+	case pb.SortKey_RAM:
+		return float64(toBit(laptop.GetRam()))
+	case pb.SortKey_RELEASE_YEAR:
+		return float64(laptop.GetReleaseYear())
+	case pb.SortKey_AVERAGE_RATING:
+		return sorter.rating(laptop)
+	default:
+		return 0
+	}
+}
+
+// a是否应该排在b的前面
+func (sorter *laptopSorter) less(a, b *pb.Laptop) bool {
+	for _, key := range sorter.options.SortBy {
+		va := sorter.sortValue(a, key.GetField())
+		vb := sorter.sortValue(b, key.GetField())
+		if va == vb {
+			continue
+		}
+		if key.GetDescending() {
+			return va > vb
+		}
+		return va < vb
+	}
+	return a.GetId() < b.GetId() //所有排序字段都相等时按id排序，保证结果是确定的
+}
+
+//把电脑按顺序排好
+func (sorter *laptopSorter) sort(laptops []*pb.Laptop) {
+	sort.Slice(laptops, func(i, j int) bool {
+		return sorter.less(laptops[i], laptops[j])
+	})
+}
+
+// topLaptops只保留排在最前面的n台电脑，堆顶是其中排在最后的那一台
+type topLaptops struct {
+	sorter  *laptopSorter
+	n       int
+	laptops []*pb.Laptop
+}
+
+func (top *topLaptops) Len() int           { return len(top.laptops) }
+func (top *topLaptops) Less(i, j int) bool { return top.sorter.less(top.laptops[j], top.laptops[i]) }
+func (top *topLaptops) Swap(i, j int) {
+	top.laptops[i], top.laptops[j] = top.laptops[j], top.laptops[i]
+}
+func (top *topLaptops) Push(x interface{}) { top.laptops = append(top.laptops, x.(*pb.Laptop)) }
+func (top *topLaptops) Pop() interface{} {
+	last := top.laptops[len(top.laptops)-1]
+	top.laptops = top.laptops[:len(top.laptops)-1]
+	return last
+}
+
+//加入一台电脑，如果已经有n台，则淘汰排在最后的那一台
+func (top *topLaptops) add(laptop *pb.Laptop) {
+	if top.Len() < top.n {
+		heap.Push(top, laptop)
+		return
+	}
+	if top.sorter.less(laptop, top.laptops[0]) {
+		top.laptops[0] = laptop
+		heap.Fix(top, 0)
+	}
+}
+
+//按顺序返回保留下来的电脑
+func (top *topLaptops) sorted() []*pb.Laptop {
+	top.sorter.sort(top.laptops)
+	return top.laptops
+}
+
+//searchResults按SearchOptions处理符合条件的电脑
+//需要排序或者限制数量时，先只收集电脑的指针，最后再复制要发送的那几台；否则边找边发送
+type searchResults struct {
+	sorter  *laptopSorter
+	top     *topLaptops
+	matched []*pb.Laptop
+	found   func(laptop *pb.Laptop) error
+}
+
+func newSearchResults(options *SearchOptions, found func(laptop *pb.Laptop) error) *searchResults {
+	results := &searchResults{found: found}
+	if !options.isEmpty() {
+		results.sorter = newLaptopSorter(options)
+		if options.MaxResults > 0 {
+			results.top = &topLaptops{sorter: results.sorter, n: options.MaxResults}
+		}
+	}
+	return results
+}
+
+func (results *searchResults) add(laptop *pb.Laptop) error {
+	switch {
+	case results.top != nil:
+		results.top.add(laptop)
+	case results.sorter != nil:
+		results.matched = append(results.matched, laptop)
+	default:
+		return sendLaptop(laptop, results.found)
+	}
+	return nil
+}
+
+//按顺序发送收集到的电脑
+func (results *searchResults) flush() error {
+	if results.top != nil {
+		results.matched = results.top.sorted()
+	} else if results.sorter != nil {
+		results.sorter.sort(results.matched)
+	}
+	for _, laptop := range results.matched {
+		if err := sendLaptop(laptop, results.found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,22 +5,45 @@ import (
 	"errors"
 	"fmt"
 	"grpctest/pb"
+	"grpctest/units"
 	"log"
+	"strings"
 	"sync"
 
-	"github.com/jinzhu/copier"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var ErrAlreadyExists = errors.New("record already exists")
 
+var ErrNotFound = errors.New("record not found")
+
+//写入时携带的版本号和store中的版本号不一致
+var ErrVersionConflict = errors.New("record version conflict")
+
 //因为有不同的store，我们用接口来定义的它的功能
 type LaptopStore interface {
 	//save the laptop to the store
 	Save(laptop *pb.Laptop) error
 	//通过id查找store里是否存在此laptop
 	Find(id string) (*pb.Laptop, error)
-	//实现检索功能,输入一个过滤器和和一个回调函数（用于在找到时报告），返回一个错误
-	Search(ctx context.Context, filter *pb.Filter, found func(laptop *pb.Laptop) error) error
+	//用laptop替换store中id相同的laptop，laptop.Version必须和store中的版本号一致
+	//如果mask不为空，则只把mask中的字段合并到store中的laptop上（不检查laptop.Version），并把合并后的结果写回laptop
+	//如果version不为nil，不管有没有mask，只有版本号一致时才更新
+	//成功后laptop的version加1，并刷新它的update_at字段
+	Update(laptop *pb.Laptop, mask *fieldmaskpb.FieldMask, version *uint64) error
+	//通过id从store中删除laptop，如果version不为nil，只有版本号一致时才删除
+	Delete(id string, version *uint64) error
+	//按id从小到大返回id大于afterID的laptop，最多返回limit台
+	List(ctx context.Context, afterID string, limit int) ([]*pb.Laptop, error)
+	//统计符合过滤条件的电脑在facets上的分布以及价格
+	Aggregate(ctx context.Context, filter *pb.Filter, facets []*pb.Facet) (*pb.AggregateLaptopsResponse, error)
+	//把store中电脑的变化事件交给found，直到ctx结束，resumeAfter不为nil时先补发序号大于它的事件
+	Watch(ctx context.Context, filter *pb.Filter, resumeAfter *uint64, found func(event *pb.LaptopEvent) error) error
+	//实现检索功能,输入一个过滤器、检索选项和一个回调函数（用于在找到时报告），返回一个错误
+	//options决定结果的顺序和最多返回的数量，为nil时按store中的顺序返回所有符合条件的laptop
+	Search(ctx context.Context, filter *pb.Filter, options *SearchOptions, found func(laptop *pb.Laptop) error) error
 }
 
 //定义一个结构体封装实现LapStore中定义的函数（保存到store中，和查找...）
@@ -30,6 +53,10 @@ type InMemoryLaptopStore struct {
 	//key存储laptop的id
 	//值是laptop对象（值里同样包含id）
 	data map[string]*pb.Laptop
+	//二级索引，在Save/Update/Delete时同步更新
+	indexes *laptopIndexes
+	//电脑的变化事件，在持有写锁时发布，保证事件的顺序和修改的顺序一致
+	feed *changeFeed
 }
 
 //如果之后我们想将laptop保存到数据库中，我们可以实现另一个DBLLaptopStore来做到
@@ -38,7 +65,9 @@ type InMemoryLaptopStore struct {
 //返回一个&InMemoryLaptopStore
 func NewInMemoryLaptopStore() *InMemoryLaptopStore {
 	return &InMemoryLaptopStore{
-		data: make(map[string]*pb.Laptop),
+		data:    make(map[string]*pb.Laptop),
+		indexes: newLaptopIndexes(),
+		feed:    newChangeFeed(),
 	}
 }
 
@@ -47,19 +76,30 @@ func (store *InMemoryLaptopStore) Save(laptop *pb.Laptop) error {
 	store.mutex.Lock()         //先加锁
 	defer store.mutex.Unlock() //别忘了加锁的同时defer解锁
 
+	other, err := store.checkSave(laptop)
+	if err != nil {
+		return err
+	}
+	store.applySave(other)
+	return nil
+}
+
+//修改分成检查和应用两步，都需要持有写锁，FileLaptopStore在两步之间写预写日志
+//检查通过后返回要保存的laptop
+func (store *InMemoryLaptopStore) checkSave(laptop *pb.Laptop) (*pb.Laptop, error) {
 	if store.data[laptop.Id] != nil { //如果store中已经有了一样的id，则不存储并返回错误
-		return ErrAlreadyExists
+		return nil, ErrAlreadyExists
 	}
 
 	//id不存在的情况，我们保存到data字典中
 	//为了安全起见，我们对laptop对象进行深度复制
-	other, err := deepCopy(laptop)
-	if err != nil {
-		return err
-	}
-	//保存
+	return deepCopy(laptop)
+}
+
+func (store *InMemoryLaptopStore) applySave(other *pb.Laptop) {
 	store.data[other.Id] = other
-	return nil
+	store.indexes.add(other)
+	store.feed.publish(pb.LaptopEvent_CREATED, other, nil)
 }
 
 func (store *InMemoryLaptopStore) Find(id string) (*pb.Laptop, error) {
@@ -77,16 +117,155 @@ func (store *InMemoryLaptopStore) Find(id string) (*pb.Laptop, error) {
 	return deepCopy(laptop)
 }
 
+//更新store中已存在的laptop
+func (store *InMemoryLaptopStore) Update(laptop *pb.Laptop, mask *fieldmaskpb.FieldMask, version *uint64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current, other, err := store.checkUpdate(laptop, mask, version)
+	if err != nil {
+		return err
+	}
+	store.applyUpdate(laptop, current, other)
+	return nil
+}
+
+//检查通过后返回store中当前的laptop和更新之后要保存的laptop
+func (store *InMemoryLaptopStore) checkUpdate(laptop *pb.Laptop, mask *fieldmaskpb.FieldMask, version *uint64) (*pb.Laptop, *pb.Laptop, error) {
+	current := store.data[laptop.Id]
+	if current == nil { //只能更新已经存在的laptop
+		return nil, nil, ErrNotFound
+	}
+
+	other, err := updatedLaptop(current, laptop, mask, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	return current, other, nil
+}
+
+func (store *InMemoryLaptopStore) applyUpdate(laptop, current, other *pb.Laptop) {
+	//修改成功之后调用方拿到的laptop也能看到新的版本号和合并后的字段
+	proto.Reset(laptop)
+	proto.Merge(laptop, other)
+
+	store.indexes.remove(current)
+	store.data[other.Id] = other
+	store.indexes.add(other)
+	store.feed.publish(pb.LaptopEvent_UPDATED, other, current)
+}
+
+//从store中删除laptop
+func (store *InMemoryLaptopStore) Delete(id string, version *uint64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	current, err := store.checkDelete(id, version)
+	if err != nil {
+		return err
+	}
+	store.applyDelete(current)
+	return nil
+}
+
+//检查通过后返回要删除的laptop
+func (store *InMemoryLaptopStore) checkDelete(id string, version *uint64) (*pb.Laptop, error) {
+	current := store.data[id]
+	if current == nil {
+		return nil, ErrNotFound
+	}
+	if version != nil && current.Version != *version {
+		return nil, fmt.Errorf("%w: expected version %d, current version %d", ErrVersionConflict, *version, current.Version)
+	}
+	return current, nil
+}
+
+func (store *InMemoryLaptopStore) applyDelete(current *pb.Laptop) {
+	delete(store.data, current.Id)
+	store.indexes.remove(current)
+	store.feed.publish(pb.LaptopEvent_DELETED, current, nil)
+}
+
+//根据store中当前的laptop和Update的参数，返回更新之后要保存的laptop
+func updatedLaptop(current, laptop *pb.Laptop, mask *fieldmaskpb.FieldMask, version *uint64) (*pb.Laptop, error) {
+	if version != nil && current.Version != *version {
+		return nil, fmt.Errorf("%w: expected version %d, current version %d", ErrVersionConflict, *version, current.Version)
+	}
+
+	var other *pb.Laptop
+	if len(mask.GetPaths()) > 0 {
+		//部分更新：在当前保存的laptop上只修改mask中的字段
+		other = proto.Clone(current).(*pb.Laptop)
+		if err := applyFieldMask(other, laptop, mask.GetPaths()); err != nil {
+			return nil, err
+		}
+	} else if current.Version != laptop.Version {
+		//调用方读到的版本已经过时，说明在此期间有其他人修改了它
+		return nil, fmt.Errorf("%w: expected version %d, current version %d", ErrVersionConflict, laptop.Version, current.Version)
+	} else {
+		other = proto.Clone(laptop).(*pb.Laptop)
+	}
+
+	//记录新的版本号和最后一次更新的时间
+	other.Version = current.Version + 1
+	other.UpdateAt = timestamppb.Now()
+	return other, nil
+}
+
+//回放一条日志记录，不检查版本号也不发布事件，调用方需要持有写锁
+func (store *InMemoryLaptopStore) replay(record *pb.LaptopRecord) {
+	switch r := record.GetRecord().(type) {
+	case *pb.LaptopRecord_Put:
+		if current := store.data[r.Put.GetId()]; current != nil {
+			store.indexes.remove(current)
+		}
+		store.data[r.Put.GetId()] = r.Put
+		store.indexes.add(r.Put)
+	case *pb.LaptopRecord_DeleteId:
+		if current := store.data[r.DeleteId]; current != nil {
+			store.indexes.remove(current)
+			delete(store.data, r.DeleteId)
+		}
+	}
+}
+
+//按id的顺序分页列出laptop，因为是从afterID之后开始找，所以即使有新的laptop保存进来，也不会影响翻页
+func (store *InMemoryLaptopStore) List(ctx context.Context, afterID string, limit int) ([]*pb.Laptop, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var ids []string
+	store.indexes.ascendIDs(afterID, func(id string) bool {
+		ids = append(ids, id)
+		return len(ids) < limit
+	})
+
+	laptops := make([]*pb.Laptop, 0, len(ids))
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		other, err := deepCopy(store.data[id])
+		if err != nil {
+			return nil, err
+		}
+		laptops = append(laptops, other)
+	}
+	return laptops, nil
+}
+
 //实现接口中的检索函数
 func (store *InMemoryLaptopStore) Search(
 	ctx context.Context,
 	filter *pb.Filter,
+	options *SearchOptions,
 	found func(laptop *pb.Laptop) error) error {
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 
-	for _, laptop := range store.data { //遍历查看哪一台电脑符合过滤条件。
-
+	results := newSearchResults(options, found)
+	err := store.forEachCandidate(filter, func(laptop *pb.Laptop) error {
 		//模拟超时
 		//time.Sleep(time.Second)
 		//log.Print("checking laptop id:",laptop.GetId())		//记录轨迹
@@ -97,24 +276,96 @@ func (store *InMemoryLaptopStore) Search(
 			return errors.New("context is cancelled")
 		}
 
-		if isQualified(filter, laptop) { //检查此电脑是否符合条件
-			//假如此电脑合格，我们需要在调用回调函数之前对其进行深度复制
-			other, err := deepCopy(laptop)
-			if err != nil {
-				return err
-			}
+		if !isQualified(filter, laptop) || !options.match(laptop) { //检查此电脑是否符合条件
+			return nil
+		}
+		return results.add(laptop)
+	})
+	if err != nil {
+		return err
+	}
+	return results.flush()
+}
+
+//订阅电脑的变化，慢的订阅者会被断开而不会阻塞Save
+func (store *InMemoryLaptopStore) Watch(
+	ctx context.Context,
+	filter *pb.Filter,
+	resumeAfter *uint64,
+	found func(event *pb.LaptopEvent) error,
+) error {
+	return store.feed.watch(ctx, filter, resumeAfter, found)
+}
+
+//统计符合过滤条件的电脑，和Search使用同样的过滤规则
+func (store *InMemoryLaptopStore) Aggregate(
+	ctx context.Context,
+	filter *pb.Filter,
+	facets []*pb.Facet,
+) (*pb.AggregateLaptopsResponse, error) {
+	aggregator, err := newLaptopAggregator(facets)
+	if err != nil {
+		return nil, err
+	}
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	//统计时只读取电脑的字段，不需要复制
+	err = store.forEachCandidate(filter, func(laptop *pb.Laptop) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if isQualified(filter, laptop) {
+			aggregator.add(laptop)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			err = found(other) //使用found函数将其发送给调用方
-			if err != nil {
+	return aggregator.result(), nil
+}
+
+//遍历可能符合过滤条件的电脑：能使用索引时只遍历候选电脑，否则遍历所有电脑（需要持有读锁）
+func (store *InMemoryLaptopStore) forEachCandidate(filter *pb.Filter, fn func(laptop *pb.Laptop) error) error {
+	if ids, ok := store.indexes.candidates(filter); ok {
+		for _, id := range ids {
+			if err := fn(store.data[id]); err != nil {
 				return err
 			}
 		}
+		return nil
+	}
+	return store.forEachLaptop(fn)
+}
+
+//遍历所有电脑（需要持有读锁）
+func (store *InMemoryLaptopStore) forEachLaptop(fn func(laptop *pb.Laptop) error) error {
+	for _, laptop := range store.data { //遍历查看哪一台电脑符合过滤条件。
+		if err := fn(laptop); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+//在调用回调函数之前对电脑进行深度复制，然后使用found函数将其发送给调用方
+func sendLaptop(laptop *pb.Laptop, found func(laptop *pb.Laptop) error) error {
+	other, err := deepCopy(laptop)
+	if err != nil {
+		return err
+	}
+	return found(other)
+}
+
 func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
-	if laptop.GetPriceUsd() > filter.GetMaxPriceUsd() {
+	//价格为0表示不限制
+	if filter.GetMaxPriceUsd() > 0 && laptop.GetPriceUsd() > filter.GetMaxPriceUsd() {
+		return false
+	}
+	if laptop.GetPriceUsd() < filter.GetMinPriceUsd() {
 		return false
 	}
 	if laptop.GetCpu().GetNumberCores() < filter.GetMinCpuCores() {
@@ -128,35 +379,126 @@ func isQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
 	if toBit(laptop.GetRam()) < toBit(filter.GetMinRam()) {
 		return false
 	}
-	return true
+	if !containsString(filter.GetBrands(), laptop.GetBrand()) || !containsString(filter.GetNames(), laptop.GetName()) {
+		return false
+	}
+	if laptop.GetReleaseYear() < filter.GetMinReleaseYear() {
+		return false
+	}
+	if filter.GetMaxReleaseYear() > 0 && laptop.GetReleaseYear() > filter.GetMaxReleaseYear() {
+		return false
+	}
+	if maxWeight := units.FilterMaxWeightKg(filter); maxWeight > 0 {
+		weight, ok := units.LaptopWeightKg(laptop)
+		if !ok || weight > maxWeight { //不知道重量的电脑不符合条件
+			return false
+		}
+	}
+	return isGPUQualified(filter, laptop) &&
+		isStorageQualified(filter, laptop) &&
+		isScreenQualified(filter, laptop.GetScreen()) &&
+		isKeyboardQualified(filter, laptop.GetKeyboard())
 }
 
-func toBit(memory *pb.Memory) uint64 { //toBit将内存转为最小单位的函数
-	value := memory.GetValue() //先得到内存
-
-	switch memory.GetUint() {
-	case pb.Memory_BIT: //如果只是位直接返回
-		return value
-	case pb.Memory_BYTE: //如果是字节，我们需返回value*8（因为一字节里面有8位）
-		return value << 3 //又因为8=2^3,我们可以在这里使用位移运算左移3来避免算法
-	case pb.Memory_KYLOBYTE:
-		return value << 13 //1kilobyte = 1024 byte
-	case pb.Memory_MEGABYTE:
-		return value << 23 //
-	case pb.Memory_GIGABYTE:
-		return value << 33
-	case pb.Memory_TERABYTE:
-		return value << 43
-	default:
-		return value
+//至少要有一块GPU同时满足品牌和显存的条件
+func isGPUQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
+	minMemory := toBit(filter.GetMinGpuMemory())
+	if minMemory == 0 && len(filter.GetGpuBrands()) == 0 {
+		return true
+	}
+	for _, gpu := range laptop.GetGpus() {
+		if containsString(filter.GetGpuBrands(), gpu.GetBrand()) && toBit(gpu.GetMemory()) >= minMemory {
+			return true
+		}
+	}
+	return false
+}
+
+//统计指定类型磁盘的总容量，没有指定类型时统计所有磁盘
+func isStorageQualified(filter *pb.Filter, laptop *pb.Laptop) bool {
+	driver := filter.GetStorageDriver()
+	if driver == pb.Storage_UNKNOWN && filter.GetMinStorage() == nil {
+		return true
+	}
+
+	var total uint64
+	matched := false
+	for _, storage := range laptop.GetStorages() {
+		if driver != pb.Storage_UNKNOWN && storage.GetDriver() != driver {
+			continue
+		}
+		matched = true
+		total += toBit(storage.GetMemory())
 	}
+	return matched && total >= toBit(filter.GetMinStorage())
+}
+
+func isScreenQualified(filter *pb.Filter, screen *pb.Screen) bool {
+	if screen.GetSizeInch() < filter.GetMinScreenSizeInch() {
+		return false
+	}
+	if filter.GetMaxScreenSizeInch() > 0 && screen.GetSizeInch() > filter.GetMaxScreenSizeInch() {
+		return false
+	}
+	if screen.GetResolution().GetWidth() < filter.GetMinResolution().GetWidth() ||
+		screen.GetResolution().GetHeight() < filter.GetMinResolution().GetHeight() {
+		return false
+	}
+	if len(filter.GetPanels()) > 0 {
+		found := false
+		for _, panel := range filter.GetPanels() {
+			if panel == screen.GetPanel() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return filter.GetMultitouch() == nil || filter.GetMultitouch().GetValue() == screen.GetMultitouch()
+}
+
+func isKeyboardQualified(filter *pb.Filter, keyboard *pb.Keyboard) bool {
+	if len(filter.GetKeyboardLayouts()) > 0 {
+		found := false
+		for _, layout := range filter.GetKeyboardLayouts() {
+			if layout == keyboard.GetLayout() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return filter.GetKeyboardBacklit() == nil || filter.GetKeyboardBacklit().GetValue() == keyboard.GetBacklit()
+}
+
+//列表为空表示不限制，比较时不区分大小写
+//和品牌索引一样比较strings.ToLower的结果，EqualFold认为相等的一些字符（例如ς和σ）转为小写后并不相同
+func containsString(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	value = strings.ToLower(value)
+	for _, v := range values {
+		if strings.ToLower(v) == value {
+			return true
+		}
+	}
+	return false
+}
+
+func toBit(memory *pb.Memory) uint64 { //toBit将内存转为最小单位的函数
+	return units.MemoryBits(memory)
 }
 
 func deepCopy(laptop *pb.Laptop) (*pb.Laptop, error) {
-	other := &pb.Laptop{}
-	err := copier.Copy(other, laptop)
-	if err != nil {
-		return nil, fmt.Errorf("cannot copy laptop data : %w", err)
+	//proto.Clone比通过反射逐个字段复制快得多，检索时每一台符合条件的电脑都需要复制
+	other, ok := proto.Clone(laptop).(*pb.Laptop)
+	if !ok {
+		return nil, fmt.Errorf("cannot copy laptop data")
 	}
 	return other, nil
 }
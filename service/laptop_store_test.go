@@ -0,0 +1,197 @@
+package service_test
+
+import (
+	"context"
+	"grpctest/pb"
+	"grpctest/sample"
+	"grpctest/service"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+//固定配置的电脑，方便判断每一个过滤条件
+func newFilterTestLaptop() *pb.Laptop {
+	laptop := sample.NewLaptop()
+	laptop.Brand = "Apple"
+	laptop.Name = "Macbook Pro"
+	laptop.PriceUsd = 2000
+	laptop.Cpu.NumberCores = 8
+	laptop.Cpu.MinGhz = 3.0
+	laptop.Ram = &pb.Memory{Value: 16, Uint: pb.Memory_GIGABYTE}
+	laptop.Gpus = []*pb.GPU{{Brand: "AMD", Memory: &pb.Memory{Value: 4, Uint: pb.Memory_GIGABYTE}}}
+	laptop.Storages = []*pb.Storage{
+		{Driver: pb.Storage_SSD, Memory: &pb.Memory{Value: 512, Uint: pb.Memory_GIGABYTE}},
+		{Driver: pb.Storage_HDD, Memory: &pb.Memory{Value: 1, Uint: pb.Memory_TERABYTE}},
+	}
+	laptop.Screen = &pb.Screen{
+		SizeInch:   15.6,
+		Resolution: &pb.Screen_Resolution{Width: 2560, Height: 1600},
+		Panel:      pb.Screen_OLED,
+		Multitouch: false,
+	}
+	laptop.Keyboard = &pb.Keyboard{Layout: pb.Keyboard_QWERTY, Backlit: true}
+	laptop.Weight = &pb.Laptop_WeightLb{WeightLb: 4} //约1.81千克
+	laptop.ReleaseYear = 2018
+	return laptop
+}
+
+func TestInMemoryLaptopStoreSearchFilter(t *testing.T) {
+	t.Parallel()
+
+	laptop := newFilterTestLaptop()
+	store := service.NewInMemoryLaptopStore()
+	err := store.Save(laptop)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		filter  *pb.Filter
+		matched bool
+	}{
+		{"empty", &pb.Filter{}, true},
+		{"price_range", &pb.Filter{MinPriceUsd: 1500, MaxPriceUsd: 2500}, true},
+		{"min_price", &pb.Filter{MinPriceUsd: 2100}, false},
+		{"brands", &pb.Filter{Brands: []string{"Dell", "apple"}}, true},
+		{"brands_mismatch", &pb.Filter{Brands: []string{"Dell", "Lenovo"}}, false},
+		{"names", &pb.Filter{Names: []string{"Macbook Air"}}, false},
+		{"gpu_brand_and_memory", &pb.Filter{GpuBrands: []string{"AMD"}, MinGpuMemory: &pb.Memory{Value: 4096, Uint: pb.Memory_MEGABYTE}}, true},
+		{"gpu_memory", &pb.Filter{MinGpuMemory: &pb.Memory{Value: 6, Uint: pb.Memory_GIGABYTE}}, false},
+		{"gpu_brand", &pb.Filter{GpuBrands: []string{"Nvidia"}}, false},
+		{"total_storage", &pb.Filter{MinStorage: &pb.Memory{Value: 1536, Uint: pb.Memory_GIGABYTE}}, true},
+		{"ssd_storage", &pb.Filter{MinStorage: &pb.Memory{Value: 1, Uint: pb.Memory_TERABYTE}, StorageDriver: pb.Storage_SSD}, false},
+		{"hdd_storage", &pb.Filter{MinStorage: &pb.Memory{Value: 1, Uint: pb.Memory_TERABYTE}, StorageDriver: pb.Storage_HDD}, true},
+		{"screen_size", &pb.Filter{MinScreenSizeInch: 14, MaxScreenSizeInch: 16}, true},
+		{"screen_too_small", &pb.Filter{MinScreenSizeInch: 16}, false},
+		{"resolution", &pb.Filter{MinResolution: &pb.Screen_Resolution{Width: 3840, Height: 1600}}, false},
+		{"panels", &pb.Filter{Panels: []pb.Screen_Panel{pb.Screen_IPS, pb.Screen_OLED}}, true},
+		{"panels_mismatch", &pb.Filter{Panels: []pb.Screen_Panel{pb.Screen_IPS}}, false},
+		{"multitouch", &pb.Filter{Multitouch: wrapperspb.Bool(true)}, false},
+		{"no_multitouch", &pb.Filter{Multitouch: wrapperspb.Bool(false)}, true},
+		{"keyboard", &pb.Filter{KeyboardLayouts: []pb.Keyboard_Layout{pb.Keyboard_QWERTY}, KeyboardBacklit: wrapperspb.Bool(true)}, true},
+		{"keyboard_layout", &pb.Filter{KeyboardLayouts: []pb.Keyboard_Layout{pb.Keyboard_AZERTY}}, false},
+		{"max_weight_kg", &pb.Filter{MaxWeight: &pb.Filter_MaxWeightKg{MaxWeightKg: 2}}, true},
+		{"max_weight_kg_too_light", &pb.Filter{MaxWeight: &pb.Filter_MaxWeightKg{MaxWeightKg: 1.5}}, false},
+		{"max_weight_lb", &pb.Filter{MaxWeight: &pb.Filter_MaxWeightLb{MaxWeightLb: 3.9}}, false},
+		{"release_year", &pb.Filter{MinReleaseYear: 2017, MaxReleaseYear: 2018}, true},
+		{"release_year_too_old", &pb.Filter{MinReleaseYear: 2019}, false},
+	}
+
+	for i := range testCases {
+		tc := testCases[i]
+
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			found := 0
+			err := store.Search(context.Background(), tc.filter, nil, func(other *pb.Laptop) error {
+				require.Equal(t, laptop.Id, other.Id)
+				found++
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, tc.matched, found == 1)
+		})
+	}
+}
+
+func TestInMemoryLaptopStoreWatchSlowSubscriber(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryLaptopStore()
+
+	//订阅者收到第一个事件后就不再读取
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	received := make(chan struct{}, 1)
+	go func() {
+		done <- store.Watch(context.Background(), nil, nil, func(event *pb.LaptopEvent) error {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+			<-release
+			return nil
+		})
+	}()
+
+	//等订阅开始之后再写入，订阅者跟不上也不会阻塞Save
+	//require只能在测试goroutine中调用，所以不用require.Eventually
+	deadline := time.Now().Add(5 * time.Second)
+	for subscribed := false; !subscribed; {
+		require.NoError(t, store.Save(sample.NewLaptop()))
+		select {
+		case <-received:
+			subscribed = true
+		case <-time.After(time.Millisecond):
+			require.True(t, time.Now().Before(deadline), "subscriber did not receive any event")
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, store.Save(sample.NewLaptop()))
+	}
+
+	close(release)
+	require.ErrorIs(t, <-done, service.ErrSubscriberTooSlow)
+}
+
+func TestLaptopStoreWatchLeaveFilter(t *testing.T) {
+	t.Parallel()
+
+	db, err := service.OpenSQLiteDB(filepath.Join(t.TempDir(), "laptop.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	stores := []struct {
+		name  string
+		store service.LaptopStore
+	}{
+		{"memory", service.NewInMemoryLaptopStore()},
+		{"sqlite", service.NewSQLLaptopStore(db)},
+	}
+	for _, tc := range stores {
+		store := tc.store
+		ctx, cancel := context.WithCancel(context.Background())
+		events := make(chan *pb.LaptopEvent, 10)
+		resumeAfter := uint64(0)
+		go store.Watch(ctx, &pb.Filter{MaxPriceUsd: 2000}, &resumeAfter, func(event *pb.LaptopEvent) error {
+			events <- event
+			return nil
+		})
+
+		//涨价之后不再符合max_price，订阅者收到LEFT_FILTER，之后的修改不再收到
+		laptop := sample.NewLaptop()
+		laptop.PriceUsd = 1500
+		require.NoError(t, store.Save(laptop))
+		laptop.PriceUsd = 2500
+		require.NoError(t, store.Update(laptop, nil, nil))
+		laptop.Brand = "Dell"
+		require.NoError(t, store.Update(laptop, nil, nil))
+		//降价之后重新符合条件
+		laptop.PriceUsd = 1800
+		require.NoError(t, store.Update(laptop, nil, nil))
+
+		expected := []struct {
+			eventType pb.LaptopEvent_Type
+			price     float64
+		}{
+			{pb.LaptopEvent_CREATED, 1500},
+			{pb.LaptopEvent_LEFT_FILTER, 2500},
+			{pb.LaptopEvent_UPDATED, 1800},
+		}
+		for _, e := range expected {
+			select {
+			case event := <-events:
+				require.Equal(t, e.eventType, event.GetType(), tc.name)
+				require.Equal(t, laptop.GetId(), event.GetLaptop().GetId(), tc.name)
+				require.Equal(t, e.price, event.GetLaptop().GetPriceUsd(), tc.name)
+			case <-time.After(5 * time.Second):
+				require.Fail(t, "no event received", tc.name)
+			}
+		}
+		cancel()
+	}
+}
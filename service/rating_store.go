@@ -1,49 +1,195 @@
 //保存电脑的评级
 package service
 
-import "sync"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// The range of the scores a user can give a laptop
+const (
+	MinLaptopScore = 1
+	MaxLaptopScore = 10
+)
+
+// ErrInvalidScore is returned when a score is not a number between MinLaptopScore and MaxLaptopScore
+var ErrInvalidScore = errors.New("invalid score")
+
+//检查评分在MinLaptopScore到MaxLaptopScore之间，NaN和无穷大都不合法
+func checkScore(score float64) error {
+	if math.IsNaN(score) || score < MinLaptopScore || score > MaxLaptopScore {
+		return fmt.Errorf("%w: %v is not between %d and %d", ErrInvalidScore, score, MinLaptopScore, MaxLaptopScore)
+	}
+	return nil
+}
 
 // RatingStore is an interface to store laptop ratings
+//每个用户对一台电脑只有一个评分，再次评分时替换之前的评分
 type RatingStore interface {
-	// Add adds a new laptop score to the store and returns its rating
-	Add(laptopID string, score float64) (*Rating, error)
+	// Rate records the score of the user for a laptop and returns the rating of the laptop
+	Rate(laptopID string, username string, score float64) (*Rating, error)
+	// Withdraw removes the score of the user for a laptop and returns the rating of the laptop,
+	// it returns ErrNotFound if the user has not rated the laptop
+	Withdraw(laptopID string, username string) (*Rating, error)
+	// Find returns the rating of a laptop, or nil if it has not been rated
+	Find(laptopID string) (*Rating, error)
 }
 
 // Rating contains the rating information of a laptop
+//只保存汇总的数据，替换或者撤回评分时减去之前的评分，不需要读取所有的评分
 type Rating struct {
-	Count uint32
-	Sum   float64
+	Count      uint32
+	Sum        float64
+	SumSquares float64                                     //评分平方的和，用来计算标准差
+	Histogram  [MaxLaptopScore - MinLaptopScore + 1]uint32 //Histogram[i]是四舍五入后为MinLaptopScore+i分的评分数量
+}
+
+// Average returns the average score of the rating
+func (rating *Rating) Average() float64 {
+	if rating == nil || rating.Count == 0 {
+		return 0
+	}
+	return rating.Sum / float64(rating.Count)
+}
+
+// StdDev returns the population standard deviation of the scores
+func (rating *Rating) StdDev() float64 {
+	if rating == nil || rating.Count == 0 {
+		return 0
+	}
+	mean := rating.Average()
+	variance := rating.SumSquares/float64(rating.Count) - mean*mean
+	if variance <= 0 { //浮点误差可能让方差略小于0
+		return 0
+	}
+	return math.Sqrt(variance)
+}
+
+// Median returns the median score, computed from the histogram
+//分数不是整数时是四舍五入后的中位数
+func (rating *Rating) Median() float64 {
+	if rating == nil {
+		return 0
+	}
+	var total uint32
+	for _, count := range rating.Histogram {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+	//评分数量是偶数时取中间两个评分的平均值
+	return (rating.nthScore((total-1)/2) + rating.nthScore(total/2)) / 2
+}
+
+//返回从小到大排序后第n个评分，n从0开始
+func (rating *Rating) nthScore(n uint32) float64 {
+	for i, count := range rating.Histogram {
+		if n < count {
+			return float64(MinLaptopScore + i)
+		}
+		n -= count
+	}
+	return MaxLaptopScore
+}
+
+//评分在Histogram中的下标
+func scoreBucket(score float64) int {
+	return int(math.Round(score)) - MinLaptopScore
+}
+
+//把评分加入汇总
+func (rating *Rating) add(score float64) {
+	rating.Count++
+	rating.Sum += score
+	rating.SumSquares += score * score
+	rating.Histogram[scoreBucket(score)]++
+}
+
+//从汇总中减去之前加入的评分
+func (rating *Rating) remove(score float64) {
+	rating.Count--
+	rating.Sum -= score
+	rating.SumSquares -= score * score
+	rating.Histogram[scoreBucket(score)]--
 }
 
 // InMemoryRatingStore stores laptop ratings in memory
 type InMemoryRatingStore struct {
-	mutex  sync.RWMutex
-	rating map[string]*Rating		//键是电脑id，value是评级对象
+	mutex   sync.RWMutex
+	scores  map[string]map[string]float64 //键是电脑id，value是每个用户的评分
+	ratings map[string]*Rating            //键是电脑id，随评分一起更新的汇总
 }
 
 // NewInMemoryRatingStore returns a new InMemoryRatingStore
 func NewInMemoryRatingStore() *InMemoryRatingStore {
 	return &InMemoryRatingStore{
-		rating: make(map[string]*Rating),
+		scores:  make(map[string]map[string]float64),
+		ratings: make(map[string]*Rating),
 	}
 }
 
-// Add adds a new laptop score to the store and returns its rating
-func (store *InMemoryRatingStore) Add(laptopID string, score float64) (*Rating, error) {
+// Rate records the score of the user for a laptop and returns the rating of the laptop
+func (store *InMemoryRatingStore) Rate(laptopID string, username string, score float64) (*Rating, error) {
+	if err := checkScore(score); err != nil {
+		return nil, err
+	}
+
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	rating := store.rating[laptopID]
-	if rating == nil {					//找不到的情况下创建一个
-		rating = &Rating{
-			Count: 1,
-			Sum:   score,
-		}
-	} else {
-		rating.Count++
-		rating.Sum += score
+	scores := store.scores[laptopID]
+	rating := store.ratings[laptopID]
+	if scores == nil { //找不到的情况下创建一个
+		scores = make(map[string]float64)
+		rating = &Rating{}
+		store.scores[laptopID] = scores
+		store.ratings[laptopID] = rating
+	}
+	if previous, ok := scores[username]; ok {
+		rating.remove(previous)
+	}
+	scores[username] = score
+	rating.add(score)
+
+	other := *rating
+	return &other, nil
+}
+
+// Withdraw removes the score of the user for a laptop and returns the rating of the laptop
+func (store *InMemoryRatingStore) Withdraw(laptopID string, username string) (*Rating, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	scores := store.scores[laptopID]
+	score, ok := scores[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(scores, username)
+	if len(scores) == 0 { //最后一个评分被撤回，和没有评分一样，也不会留下浮点误差
+		delete(store.scores, laptopID)
+		delete(store.ratings, laptopID)
+		return &Rating{}, nil
 	}
 
-	store.rating[laptopID] = rating
-	return rating, nil
-}
\ No newline at end of file
+	rating := store.ratings[laptopID]
+	rating.remove(score)
+	other := *rating
+	return &other, nil
+}
+
+// Find returns the rating of a laptop, or nil if it has not been rated
+func (store *InMemoryRatingStore) Find(laptopID string) (*Rating, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	rating := store.ratings[laptopID]
+	if rating == nil {
+		return nil, nil
+	}
+	other := *rating
+	return &other, nil
+}
@@ -0,0 +1,72 @@
+package service_test
+
+import (
+	"fmt"
+	"grpctest/service"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRatingDistribution(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name      string
+		scores    []float64
+		median    float64
+		stddev    float64
+		histogram [10]uint32
+	}{
+		{"none", nil, 0, 0, [10]uint32{}},
+		{"one", []float64{7}, 7, 0, [10]uint32{6: 1}},
+		{"odd", []float64{9, 1, 5}, 5, 3.265986323710904, [10]uint32{0: 1, 4: 1, 8: 1}},
+		{"even", []float64{2, 4, 4, 4, 5, 5, 7, 9}, 4.5, 2, [10]uint32{1: 1, 3: 3, 4: 2, 6: 1, 8: 1}},
+		{"same", []float64{3, 3, 3, 3}, 3, 0, [10]uint32{2: 4}},
+		{"rounded", []float64{1.4, 7.5, 9.6}, 8, 3.4778665235393316, [10]uint32{0: 1, 7: 1, 9: 1}},
+	}
+	for _, tc := range testCases {
+		store := service.NewInMemoryRatingStore()
+		for i, score := range tc.scores {
+			_, err := store.Rate("laptop", fmt.Sprintf("user%d", i), score)
+			require.NoError(t, err, tc.name)
+		}
+		rating, err := store.Find("laptop")
+		require.NoError(t, err, tc.name)
+		if len(tc.scores) == 0 {
+			require.Nil(t, rating, tc.name)
+		} else {
+			require.Equal(t, uint32(len(tc.scores)), rating.Count, tc.name)
+			require.Equal(t, tc.histogram, rating.Histogram, tc.name)
+		}
+		require.Equal(t, tc.median, rating.Median(), tc.name)
+		require.InDelta(t, tc.stddev, rating.StdDev(), 1e-9, tc.name)
+	}
+}
+
+func TestInMemoryRatingStoreReplaceAndWithdraw(t *testing.T) {
+	t.Parallel()
+
+	store := service.NewInMemoryRatingStore()
+	_, err := store.Rate("laptop", "user1", 2)
+	require.NoError(t, err)
+	_, err = store.Rate("laptop", "user2", 6)
+	require.NoError(t, err)
+
+	//替换评分时之前的评分从直方图中移除
+	rating, err := store.Rate("laptop", "user1", 10)
+	require.NoError(t, err)
+	require.Equal(t, [10]uint32{5: 1, 9: 1}, rating.Histogram)
+	require.Equal(t, 8.0, rating.Median())
+	require.InDelta(t, 2.0, rating.StdDev(), 1e-9)
+
+	rating, err = store.Withdraw("laptop", "user2")
+	require.NoError(t, err)
+	require.Equal(t, &service.Rating{Count: 1, Sum: 10, SumSquares: 100, Histogram: [10]uint32{9: 1}}, rating)
+
+	//返回的是副本，修改它不会影响store
+	rating.Count = 100
+	rating, err = store.Find("laptop")
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), rating.Count)
+}
@@ -0,0 +1,434 @@
+//调用S3兼容的对象存储API的最小客户端，请求使用AWS Signature Version 4签名
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrObjectNotFound is returned when the object doesn't exist in the bucket
+var ErrObjectNotFound = errors.New("object not found")
+
+const (
+	s3Service         = "s3"
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+	emptyPayloadHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" //空字符串的SHA-256
+	s3ListMaxKeys     = 1000
+	s3RequestTimeout  = 30 * time.Second
+	s3ErrorBodyLimit  = 64 << 10 //最多读取错误响应的字节数
+	s3DefaultPartSize = 5 << 20  //S3要求除了最后一个分片之外每个分片至少5MiB
+)
+
+// S3Config is the configuration of an S3 compatible object storage
+type S3Config struct {
+	Endpoint  string //例如https://s3.us-east-1.amazonaws.com或者http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	Prefix    string //所有对象的key的前缀，多个服务可以共用一个bucket
+	AccessKey string
+	SecretKey string
+	PartSize  int64        //分片上传时每个分片的大小，为0时使用5MiB，S3不接受小于5MiB的分片
+	Client    *http.Client //为nil时使用http.DefaultClient
+}
+
+//s3Client使用path-style的URL访问bucket，即endpoint/bucket/key
+type s3Client struct {
+	config   S3Config
+	endpoint *url.URL
+	now      func() time.Time
+}
+
+func newS3Client(config S3Config) (*s3Client, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("s3 bucket is required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.PartSize == 0 {
+		config.PartSize = s3DefaultPartSize
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &s3Client{config: config, endpoint: endpoint, now: time.Now}, nil
+}
+
+//S3返回的错误
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (err *s3Error) Error() string {
+	return fmt.Sprintf("s3 error %d %s: %s", err.StatusCode, err.Code, err.Message)
+}
+
+func (client *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *client.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + client.config.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path) //和签名时使用相同的编码
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+//发送签名后的请求，状态码不是2xx时返回错误
+//body为nil时发送空的请求体
+func (client *s3Client) do(
+	ctx context.Context,
+	method string,
+	key string,
+	query url.Values,
+	header http.Header,
+	body []byte,
+) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, s3RequestTimeout)
+	req, err := http.NewRequestWithContext(ctx, method, client.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	signS3Request(req, payloadHash, client.config.AccessKey, client.config.SecretKey, client.config.Region, client.now())
+
+	res, err := client.config.Client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("cannot send s3 request: %w", err)
+	}
+	if res.StatusCode/100 != 2 {
+		defer cancel()
+		defer res.Body.Close()
+		s3Err := &s3Error{StatusCode: res.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(res.Body, s3ErrorBodyLimit))
+		xml.Unmarshal(data, s3Err)
+		if res.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %s: %v", ErrObjectNotFound, key, s3Err)
+		}
+		return nil, s3Err
+	}
+	res.Body = &cancelOnClose{res.Body, cancel}
+	return res, nil
+}
+
+//关闭响应体时释放请求的context
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+//发送请求并丢弃响应体
+func (client *s3Client) call(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) error {
+	res, err := client.do(ctx, method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, res.Body)
+	return res.Body.Close()
+}
+
+func (client *s3Client) putObject(ctx context.Context, key string, data []byte) error {
+	return client.call(ctx, http.MethodPut, key, nil, nil, data)
+}
+
+func (client *s3Client) getObject(ctx context.Context, key string) ([]byte, error) {
+	body, err := client.openObject(ctx, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+//从offset开始读取对象
+func (client *s3Client) openObject(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	res, err := client.do(ctx, http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+//删除对象，对象不存在时也返回nil
+func (client *s3Client) deleteObject(ctx context.Context, key string) error {
+	err := client.call(ctx, http.MethodDelete, key, nil, nil, nil)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	return err
+}
+
+//列出的对象
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+//列出key以prefix开头的所有对象
+func (client *s3Client) listObjects(ctx context.Context, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		query.Set("max-keys", strconv.Itoa(s3ListMaxKeys))
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := client.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode object list: %w", err)
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, s3Object{Key: content.Key, Size: content.Size, LastModified: content.LastModified})
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+//把reader中的数据上传为一个对象，每次只在内存中保存一个分片
+//数据不超过一个分片时直接PUT，否则使用分片上传，失败时取消分片上传
+func (client *s3Client) uploadObject(ctx context.Context, key string, reader io.Reader) (int64, error) {
+	buffer := make([]byte, client.config.PartSize)
+	n, err := io.ReadFull(reader, buffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return int64(n), client.putObject(ctx, key, buffer[:n])
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot read object data: %w", err)
+	}
+
+	uploadID, err := client.createMultipartUpload(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	size, err := client.uploadParts(ctx, key, uploadID, buffer, n, reader)
+	if err != nil {
+		client.call(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+		return 0, err
+	}
+	return size, nil
+}
+
+func (client *s3Client) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	res, err := client.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("cannot decode multipart upload: %w", err)
+	}
+	return result.UploadID, nil
+}
+
+//buffer中已经有第一个分片的n个字节，逐个上传分片后完成分片上传
+func (client *s3Client) uploadParts(
+	ctx context.Context,
+	key string,
+	uploadID string,
+	buffer []byte,
+	n int,
+	reader io.Reader,
+) (int64, error) {
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []completedPart
+	var size int64
+	for partNumber := 1; n > 0; partNumber++ {
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+		res, err := client.do(ctx, http.MethodPut, key, query, nil, buffer[:n])
+		if err != nil {
+			return 0, err
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		parts = append(parts, completedPart{PartNumber: partNumber, ETag: res.Header.Get("ETag")})
+		size += int64(n)
+
+		n, err = io.ReadFull(reader, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("cannot read object data: %w", err)
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return 0, err
+	}
+	//完成分片上传时即使状态码是200，响应中也可能是错误
+	res, err := client.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, s3ErrorBodyLimit))
+	if err != nil {
+		return 0, err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		s3Err := &s3Error{StatusCode: res.StatusCode}
+		xml.Unmarshal(data, s3Err)
+		return 0, s3Err
+	}
+	return size, nil
+}
+
+//按照AWS Signature Version 4给请求签名，签名包含host和请求中已经设置的所有头部
+func signS3Request(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := now.Format(s3DateFormat) + "/" + region + "/" + s3Service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//除了不需要编码的字符之外都用%XX编码，路径中的/保留
+func s3Escape(value string, keepSlash bool) string {
+	var builder strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', keepSlash && b == '/':
+			builder.WriteByte(b)
+		default:
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+func s3EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return s3Escape(path, true)
+}
+
+//按key排序后编码查询参数
+func s3CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,395 @@
+//保存在S3兼容的对象存储中的图像，多个服务器副本可以共用同一个bucket
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"grpctest/pb"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	s3RecordFolder = "records/" //图像记录，每张图像一个ImageRecord对象
+	s3LaptopFolder = "laptops/" //按电脑索引图像的空对象，key是laptops/<电脑id>/<图像id>
+	s3OwnerFolder  = "owners/"  //按上传者索引图像的空对象，key是owners/<用户名>/<图像id>.<原图字节数>
+	s3ImageFolder  = "images/"  //原图和缩略图的内容
+)
+
+//S3ImageStore不在内存中保存图像信息，每次都从bucket读取，所以其他副本保存的图像马上可见
+//图像信息保存在records/下，先上传内容再写记录，删除时先删除记录，所以记录指向的内容总是存在的
+//索引对象只用来列出图像，索引指向的记录不存在时忽略该索引
+type S3ImageStore struct {
+	client *s3Client
+	prefix string
+}
+
+// NewS3ImageStore returns a store that saves images in an S3 compatible bucket
+func NewS3ImageStore(config S3Config) (*S3ImageStore, error) {
+	client, err := newS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3ImageStore{client: client, prefix: prefix}, nil
+}
+
+func (store *S3ImageStore) recordKey(imageID string) string {
+	return store.prefix + s3RecordFolder + imageID
+}
+
+//电脑id和用户名可能包含/，编码后作为key的一段
+func (store *S3ImageStore) laptopIndex(laptopID string) string {
+	return store.prefix + s3LaptopFolder + url.PathEscape(laptopID) + "/"
+}
+
+func (store *S3ImageStore) ownerIndex(owner string) string {
+	return store.prefix + s3OwnerFolder + url.PathEscape(owner) + "/"
+}
+
+//上传者的索引中包含图像的大小，计算配额时只需要列出索引，不需要读取每张图像的记录
+func (store *S3ImageStore) ownerIndexKey(info *ImageInfo) string {
+	return store.ownerIndex(info.Owner) + info.ID + "." + strconv.FormatInt(info.Size, 10)
+}
+
+func (store *S3ImageStore) imageKey(imageID string, rendition string, imageType string) string {
+	if rendition != "" {
+		return store.prefix + s3ImageFolder + imageID + "_" + rendition + imageType
+	}
+	return store.prefix + s3ImageFolder + imageID + imageType
+}
+
+//读取图像记录，记录不存在时返回nil
+func (store *S3ImageStore) readRecord(ctx context.Context, imageID string) (*ImageInfo, error) {
+	data, err := store.client.getObject(ctx, store.recordKey(imageID))
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image record: %w", err)
+	}
+	record := &pb.ImageRecord{}
+	if err := proto.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("cannot decode image record: %w", err)
+	}
+	//记录中保存的是相对于前缀的key
+	return imageInfoFromRecord(record, func(name string) string { return store.prefix + name }), nil
+}
+
+func (store *S3ImageStore) writeRecord(ctx context.Context, info *ImageInfo) error {
+	record, err := imageRecordFromInfo(info, func(key string) (string, error) {
+		return strings.TrimPrefix(key, store.prefix), nil
+	})
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot encode image record: %w", err)
+	}
+	if err := store.client.putObject(ctx, store.recordKey(info.ID), data); err != nil {
+		return fmt.Errorf("cannot write image record: %w", err)
+	}
+	return nil
+}
+
+//上传对象的内容，同时计算SHA-256
+func (store *S3ImageStore) upload(ctx context.Context, key string, data io.Reader) (int64, string, error) {
+	hash := sha256.New()
+	size, err := store.client.uploadObject(ctx, key, io.TeeReader(data, hash))
+	if err != nil {
+		return 0, "", fmt.Errorf("cannot upload image: %w", err)
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Save streams the image to the bucket, large images are sent with a multipart upload
+func (store *S3ImageStore) Save(laptopID string, imageType string, owner string, imageData io.Reader) (string, error) {
+	ctx := context.Background()
+	imageID, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("cannot generate image id: %w", err)
+	}
+
+	key := store.imageKey(imageID.String(), "", imageType)
+	size, checksum, err := store.upload(ctx, key, imageData)
+	if err != nil {
+		return "", err
+	}
+	info := &ImageInfo{
+		ID:         imageID.String(),
+		LaptopID:   laptopID,
+		Owner:      owner,
+		Type:       imageType,
+		Path:       key,
+		Size:       size,
+		Checksum:   checksum,
+		UploadTime: time.Now(),
+	}
+	if err := store.writeRecord(ctx, info); err != nil {
+		store.client.deleteObject(ctx, key)
+		return "", err
+	}
+	for _, index := range []string{store.laptopIndex(laptopID) + info.ID, store.ownerIndexKey(info)} {
+		if err := store.client.putObject(ctx, index, nil); err != nil {
+			store.remove(ctx, info)
+			return "", fmt.Errorf("cannot write image index: %w", err)
+		}
+	}
+	return info.ID, nil
+}
+
+// SaveRendition uploads the rendition next to the image, see ImageStore.SaveRendition
+//多个副本同时给同一张图像保存缩略图时，后写的记录会覆盖先写的记录
+func (store *S3ImageStore) SaveRendition(imageID string, rendition *Rendition) error {
+	if !renditionNamePattern.MatchString(rendition.Name) {
+		return fmt.Errorf("invalid rendition name %q", rendition.Name)
+	}
+	ctx := context.Background()
+	info, err := store.readRecord(ctx, imageID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return ErrNotFound
+	}
+
+	key := store.imageKey(imageID, rendition.Name, rendition.Type)
+	size, checksum, err := store.upload(ctx, key, bytes.NewReader(rendition.Data))
+	if err != nil {
+		return err
+	}
+	renditions := []*RenditionInfo{{
+		Name:     rendition.Name,
+		Type:     rendition.Type,
+		Path:     key,
+		Size:     size,
+		Checksum: checksum,
+		Width:    rendition.Width,
+		Height:   rendition.Height,
+	}}
+	var replaced *RenditionInfo
+	for _, other := range info.Renditions {
+		if other.Name == rendition.Name {
+			replaced = other
+			continue
+		}
+		renditions = append(renditions, other)
+	}
+	sort.Slice(renditions, func(i, j int) bool { return renditions[i].Name < renditions[j].Name })
+	info.Renditions = renditions
+
+	if err := store.writeRecord(ctx, info); err != nil {
+		return err
+	}
+	//类型不同时旧的缩略图在另一个key
+	if replaced != nil && replaced.Path != key {
+		return store.client.deleteObject(ctx, replaced.Path)
+	}
+	return nil
+}
+
+// Find returns the information of the image, or nil if there is no such image
+func (store *S3ImageStore) Find(imageID string) (*ImageInfo, error) {
+	if _, err := uuid.Parse(imageID); err != nil { //不是图像id时不用访问bucket，也避免拼出其他对象的key
+		return nil, nil
+	}
+	return store.readRecord(context.Background(), imageID)
+}
+
+// Open downloads the image or rendition starting at offset
+func (store *S3ImageStore) Open(imageID string, rendition string, offset int64) (io.ReadCloser, error) {
+	info, err := store.Find(imageID)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, ErrNotFound
+	}
+	key, size := info.Path, info.Size
+	if rendition != "" {
+		saved := info.Rendition(rendition)
+		if saved == nil {
+			return nil, ErrNotFound
+		}
+		key, size = saved.Path, saved.Size
+	}
+	if offset < 0 || offset > size {
+		return nil, fmt.Errorf("offset %d is out of range [0, %d]", offset, size)
+	}
+	if offset == size { //S3不接受从对象末尾开始的Range
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	body, err := store.client.openObject(context.Background(), key, offset)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image: %w", err)
+	}
+	return body, nil
+}
+
+//读取索引下的所有图像，按图像id排序
+func (store *S3ImageStore) listIndex(ctx context.Context, index string) ([]*ImageInfo, error) {
+	objects, err := store.client.listObjects(ctx, index)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list images: %w", err)
+	}
+	var images []*ImageInfo
+	for _, object := range objects {
+		info, err := store.readRecord(ctx, strings.TrimPrefix(object.Key, index))
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			images = append(images, info)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images, nil
+}
+
+// List returns the images of the laptop ordered by image id
+func (store *S3ImageStore) List(laptopID string) ([]*ImageInfo, error) {
+	return store.listIndex(context.Background(), store.laptopIndex(laptopID))
+}
+
+//只列出电脑的索引，不读取记录，删除中途失败留下的索引在被回收之前也会计算在内
+func (store *S3ImageStore) countImages(laptopID string) (int, error) {
+	objects, err := store.client.listObjects(context.Background(), store.laptopIndex(laptopID))
+	if err != nil {
+		return 0, fmt.Errorf("cannot list images: %w", err)
+	}
+	return len(objects), nil
+}
+
+// Delete removes the record of the image, then its index entries and objects
+func (store *S3ImageStore) Delete(imageID string) error {
+	ctx := context.Background()
+	info, err := store.Find(imageID)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return ErrNotFound
+	}
+	return store.remove(ctx, info)
+}
+
+//先删除记录，之后的步骤失败时只会留下没有记录的对象
+func (store *S3ImageStore) remove(ctx context.Context, info *ImageInfo) error {
+	keys := []string{
+		store.recordKey(info.ID),
+		store.laptopIndex(info.LaptopID) + info.ID,
+		store.ownerIndexKey(info),
+		info.Path,
+	}
+	for _, rendition := range info.Renditions {
+		keys = append(keys, rendition.Path)
+	}
+	for _, key := range keys {
+		if err := store.client.deleteObject(ctx, key); err != nil {
+			return fmt.Errorf("cannot delete image: %w", err)
+		}
+	}
+	return nil
+}
+
+// Usage returns the number and the total size of the images uploaded by owner
+//图像大小从索引的key中取出，不读取记录；删除中途失败留下的索引在被回收之前也会计算在内
+func (store *S3ImageStore) Usage(owner string) (*ImageUsage, error) {
+	index := store.ownerIndex(owner)
+	objects, err := store.client.listObjects(context.Background(), index)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list images: %w", err)
+	}
+	usage := &ImageUsage{}
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, index)
+		size, err := strconv.ParseInt(name[strings.LastIndex(name, ".")+1:], 10, 64)
+		if err != nil { //不是store写的索引，垃圾回收会删除它
+			continue
+		}
+		usage.Images++
+		usage.Bytes += size
+	}
+	return usage, nil
+}
+
+//返回所有图像，按图像id排序
+func (store *S3ImageStore) all() ([]*ImageInfo, error) {
+	return store.listIndex(context.Background(), store.prefix+s3RecordFolder)
+}
+
+//返回没有被记录引用的图像对象，以及指向不存在的记录的索引对象
+//Save先上传内容再写记录，所以刚上传的对象也没有被引用，宽限期内不会被删除
+func (store *S3ImageStore) orphanFiles() ([]*ImageGarbage, error) {
+	ctx := context.Background()
+	images, err := store.all()
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool) //key是对象的key
+	for _, info := range images {
+		referenced[info.Path] = true
+		for _, rendition := range info.Renditions {
+			referenced[rendition.Path] = true
+		}
+		referenced[store.laptopIndex(info.LaptopID)+info.ID] = true
+		referenced[store.ownerIndexKey(info)] = true
+	}
+
+	var garbage []*ImageGarbage
+	for _, folder := range []string{s3ImageFolder, s3LaptopFolder, s3OwnerFolder} {
+		objects, err := store.client.listObjects(ctx, store.prefix+folder)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list images: %w", err)
+		}
+		for _, object := range objects {
+			if !referenced[object.Key] {
+				garbage = append(garbage, &ImageGarbage{
+					Kind:    OrphanFile,
+					Name:    object.Key,
+					Size:    object.Size,
+					ModTime: object.LastModified,
+				})
+			}
+		}
+	}
+	return garbage, nil
+}
+
+//删除对象前重新读取它所属图像的记录，其他副本可能刚刚保存了这张图像
+func (store *S3ImageStore) removeOrphanFile(key string) error {
+	ctx := context.Background()
+	info, err := store.readRecord(ctx, s3ObjectImageID(strings.TrimPrefix(key, store.prefix)))
+	if err != nil {
+		return err
+	}
+	if info != nil {
+		return errFileInUse
+	}
+	return store.client.deleteObject(ctx, key)
+}
+
+//从相对于前缀的key中取出图像id，图像对象和索引对象的名字都以图像id开头
+func s3ObjectImageID(key string) string {
+	name := key[strings.LastIndex(key, "/")+1:]
+	if len(name) > 36 {
+		return name[:36]
+	}
+	return name
+}
@@ -0,0 +1,380 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"grpctest/pb"
+	"grpctest/sample"
+	"grpctest/service"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+//在内存中模拟S3的一个bucket，只实现S3ImageStore用到的API
+type fakeS3 struct {
+	mutex       sync.Mutex
+	bucket      string
+	objects     map[string][]byte
+	modified    map[string]time.Time      //对象最后修改的时间
+	uploads     map[string]map[int][]byte //进行中的分片上传
+	nextUpload  int
+	partUploads int //收到的分片数量
+	gets        int //读取对象内容的请求数量，不包括列出对象
+	pageSize    int //列出对象时每页最多的数量，用来测试分页
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{
+		bucket:   bucket,
+		objects:  make(map[string][]byte),
+		modified: make(map[string]time.Time),
+		uploads:  make(map[string]map[int][]byte),
+		pageSize: 2,
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (fake *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		fake.writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	//检查请求已经签名，并且签名中的内容哈希和请求体一致
+	sum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		fake.writeError(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != fake.bucket {
+		fake.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		fake.list(w, query)
+	case r.Method == http.MethodGet:
+		fake.gets++
+		data, ok := fake.objects[key]
+		if !ok {
+			fake.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if value := r.Header.Get("Range"); value != "" {
+			offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(value, "bytes="), "-"))
+			if err != nil || offset >= len(data) {
+				fake.writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			w.WriteHeader(http.StatusPartialContent)
+			data = data[offset:]
+		}
+		w.Write(data)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts := fake.uploads[query.Get("uploadId")]
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if parts == nil || err != nil {
+			fake.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		parts[number] = body
+		fake.partUploads++
+		w.Header().Set("ETag", fmt.Sprintf("%q", hex.EncodeToString(sum[:])))
+	case r.Method == http.MethodPut:
+		fake.objects[key] = body
+		fake.modified[key] = time.Now()
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		fake.nextUpload++
+		uploadID := strconv.Itoa(fake.nextUpload)
+		fake.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := fake.uploads[query.Get("uploadId")]
+		var complete struct {
+			Parts []struct {
+				PartNumber int    `xml:"PartNumber"`
+				ETag       string `xml:"ETag"`
+			} `xml:"Part"`
+		}
+		if parts == nil || xml.Unmarshal(body, &complete) != nil {
+			fake.writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		for _, part := range complete.Parts {
+			partSum := sha256.Sum256(parts[part.PartNumber])
+			if part.ETag != fmt.Sprintf("%q", hex.EncodeToString(partSum[:])) {
+				fake.writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, parts[part.PartNumber]...)
+		}
+		delete(fake.uploads, query.Get("uploadId"))
+		fake.objects[key] = data
+		fake.modified[key] = time.Now()
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(fake.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(fake.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fake.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+//按key排序列出对象，continuation-token是上一页最后一个key
+func (fake *fakeS3) list(w http.ResponseWriter, query map[string][]string) {
+	get := func(name string) string {
+		if values := query[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	var keys []string
+	for key := range fake.objects {
+		if strings.HasPrefix(key, get("prefix")) && key > get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	truncated := len(keys) > fake.pageSize
+	if truncated {
+		keys = keys[:fake.pageSize]
+	}
+	fmt.Fprint(w, "<ListBucketResult>")
+	for _, key := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+			key, len(fake.objects[key]), fake.modified[key].UTC().Format(time.RFC3339))
+	}
+	if truncated {
+		fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[len(keys)-1])
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+//返回收到的分片数量和进行中的分片上传数量
+func (fake *fakeS3) multipart() (int, int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.partUploads, len(fake.uploads)
+}
+
+func (fake *fakeS3) keys() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	var keys []string
+	for key := range fake.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//读到一半时失败的reader
+type failingReader struct {
+	data []byte
+}
+
+func (reader *failingReader) Read(p []byte) (int, error) {
+	if len(reader.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, reader.data)
+	reader.data = reader.data[n:]
+	return n, nil
+}
+
+func TestS3ImageStoreUsageFromIndex(t *testing.T) {
+	t.Parallel()
+
+	fake, server := newFakeS3(t, "images")
+	store, err := service.NewS3ImageStore(service.S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "images",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	require.NoError(t, err)
+
+	firstID, err := store.Save("laptop1", ".jpg", "alice", strings.NewReader("first image"))
+	require.NoError(t, err)
+	secondID, err := store.Save("laptop1", ".jpg", "alice", strings.NewReader("second"))
+	require.NoError(t, err)
+	expected := &service.ImageUsage{Images: 2, Bytes: int64(len("first image") + len("second"))}
+
+	//配额从索引的key中计算，不读取图像记录
+	fake.mutex.Lock()
+	gets := fake.gets
+	fake.mutex.Unlock()
+	usage, err := store.Usage("alice")
+	require.NoError(t, err)
+	require.Equal(t, expected, usage)
+	fake.mutex.Lock()
+	require.Equal(t, gets, fake.gets)
+	require.Contains(t, fake.objects, "owners/alice/"+firstID+"."+strconv.Itoa(len("first image")))
+	fake.mutex.Unlock()
+
+	//删除图像时同时删除带有大小的索引
+	for _, imageID := range []string{firstID, secondID} {
+		require.NoError(t, store.Delete(imageID))
+	}
+	require.Empty(t, fake.keys())
+}
+
+func TestS3ImageStore(t *testing.T) {
+	t.Parallel()
+
+	fake, server := newFakeS3(t, "images")
+	config := service.S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "images",
+		Prefix:    "replicas/",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PartSize:  64, //测试中使用很小的分片
+	}
+	store, err := service.NewS3ImageStore(config)
+	require.NoError(t, err)
+
+	//比一个分片大的图像使用分片上传
+	large := bytes.Repeat([]byte("0123456789"), 20)
+	largeID, err := store.Save("laptop1", ".jpg", "alice", bytes.NewReader(large))
+	require.NoError(t, err)
+	parts, pending := fake.multipart()
+	require.Equal(t, 4, parts)
+	require.Zero(t, pending)
+	smallID, err := store.Save("laptop1", ".png", "alice", strings.NewReader("small image"))
+	require.NoError(t, err)
+	otherID, err := store.Save("laptop2", ".png", "bob", strings.NewReader("other image"))
+	require.NoError(t, err)
+	parts, _ = fake.multipart()
+	require.Equal(t, 4, parts) //小图像直接上传
+
+	//另一个副本使用同一个bucket，马上可以看到保存的图像
+	replica, err := service.NewS3ImageStore(config)
+	require.NoError(t, err)
+
+	info, err := replica.Find(largeID)
+	require.NoError(t, err)
+	require.Equal(t, "laptop1", info.LaptopID)
+	require.Equal(t, "alice", info.Owner)
+	require.Equal(t, int64(len(large)), info.Size)
+	sum := sha256.Sum256(large)
+	require.Equal(t, hex.EncodeToString(sum[:]), info.Checksum)
+
+	images, err := replica.List("laptop1")
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	usage, err := replica.Usage("alice")
+	require.NoError(t, err)
+	require.Equal(t, &service.ImageUsage{Images: 2, Bytes: int64(len(large) + len("small image"))}, usage)
+
+	reader, err := replica.Open(largeID, "", 195)
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, "56789", string(data))
+
+	reader, err = replica.Open(largeID, "", int64(len(large)))
+	require.NoError(t, err)
+	data, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Empty(t, data)
+	_, err = replica.Open(largeID, "", int64(len(large))+1)
+	require.Error(t, err)
+
+	//缩略图保存在原图旁边，同名的缩略图被替换
+	require.NoError(t, store.SaveRendition(largeID, &service.Rendition{Name: "small", Type: ".png", Width: 2, Height: 1, Data: []byte("png rendition")}))
+	require.NoError(t, store.SaveRendition(largeID, &service.Rendition{Name: "small", Type: ".jpg", Width: 2, Height: 1, Data: []byte("jpg rendition")}))
+	require.ErrorIs(t, store.SaveRendition("missing", &service.Rendition{Name: "small", Type: ".jpg"}), service.ErrNotFound)
+	reader, err = replica.Open(largeID, "small", 4)
+	require.NoError(t, err)
+	data, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, "rendition", string(data))
+
+	//上传失败时取消分片上传，不会留下对象
+	keys := fake.keys()
+	_, err = store.Save("laptop1", ".jpg", "alice", &failingReader{data: large})
+	require.Error(t, err)
+	_, pending = fake.multipart()
+	require.Zero(t, pending)
+	require.Equal(t, keys, fake.keys())
+
+	//删除所有图像后bucket中不再有任何对象
+	for _, imageID := range []string{largeID, smallID, otherID} {
+		require.NoError(t, replica.Delete(imageID))
+		require.ErrorIs(t, store.Delete(imageID), service.ErrNotFound)
+	}
+	require.Empty(t, fake.keys())
+	info, err = store.Find(largeID)
+	require.NoError(t, err)
+	require.Nil(t, info)
+	images, err = store.List("laptop1")
+	require.NoError(t, err)
+	require.Empty(t, images)
+
+	//垃圾回收删除没有记录引用的对象和索引
+	laptopStore := service.NewInMemoryLaptopStore()
+	laptop := sample.NewLaptop()
+	require.NoError(t, laptopStore.Save(laptop))
+	keptID, err := store.Save(laptop.Id, ".jpg", "alice", bytes.NewReader(large))
+	require.NoError(t, err)
+	lostKey := "replicas/images/" + keptID[:35] + "0.jpg"
+	lostIndex := "replicas/laptops/" + laptop.Id + "/" + strings.Repeat("0", 36)
+	for _, key := range []string{lostKey, lostIndex} {
+		fake.mutex.Lock()
+		fake.objects[key] = []byte("lost")
+		fake.modified[key] = time.Now().Add(-time.Minute)
+		fake.mutex.Unlock()
+	}
+
+	laptopServer := service.NewLaptopServer(laptopStore, store, service.NewInMemoryRatingStore())
+	laptopServer.SetImageGCOptions(service.ImageGCOptions{Interval: time.Hour, GracePeriod: time.Second})
+	res, err := laptopServer.CollectImageGarbage(context.Background(), &pb.CollectImageGarbageRequest{})
+	require.NoError(t, err)
+	var removed []string
+	for _, garbage := range res.GetRemoved() {
+		require.Equal(t, pb.ImageGarbage_ORPHAN_FILE, garbage.GetKind())
+		removed = append(removed, garbage.GetName())
+	}
+	require.ElementsMatch(t, []string{lostKey, lostIndex}, removed)
+	require.NotContains(t, fake.keys(), lostKey)
+	info, err = store.Find(keptID)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+}
@@ -0,0 +1,362 @@
+//保存在SQLite数据库中的LaptopStore
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"grpctest/pb"
+	"grpctest/units"
+	"strings"
+	"sync"
+	"unicode"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+//SQLLaptopStore把电脑序列化后保存在data列中，另外把过滤时常用的字段单独存成列
+//检索时能用列表示的条件转换成WHERE子句，其余的条件仍然用isQualified检查
+type SQLLaptopStore struct {
+	db *sql.DB
+	//写操作一个接一个执行，保证发布事件的顺序和提交的顺序一致
+	writeMutex sync.Mutex
+	feed       *changeFeed
+}
+
+// NewSQLLaptopStore returns a laptop store backed by a database opened with OpenSQLiteDB
+func NewSQLLaptopStore(db *sql.DB) *SQLLaptopStore {
+	return &SQLLaptopStore{
+		db:   db,
+		feed: newChangeFeed(),
+	}
+}
+
+//除了data之外的列，顺序和laptopColumnValues一致
+const laptopColumns = "id, brand, name, price_usd, cpu_cores, cpu_min_ghz, ram_bits, release_year, weight_kg, version"
+
+func laptopColumnValues(laptop *pb.Laptop) []interface{} {
+	weightKg, _ := units.LaptopWeightKg(laptop) //没有重量时保存0
+	return []interface{}{
+		laptop.GetId(),
+		laptop.GetBrand(),
+		laptop.GetName(),
+		laptop.GetPriceUsd(),
+		laptop.GetCpu().GetNumberCores(),
+		laptop.GetCpu().GetMinGhz(),
+		float64(toBit(laptop.GetRam())),
+		laptop.GetReleaseYear(),
+		weightKg,
+		int64(laptop.GetVersion()),
+	}
+}
+
+func unmarshalLaptop(data []byte) (*pb.Laptop, error) {
+	laptop := &pb.Laptop{}
+	if err := proto.Unmarshal(data, laptop); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal laptop: %w", err)
+	}
+	return laptop, nil
+}
+
+// Save saves the laptop to the database
+func (store *SQLLaptopStore) Save(laptop *pb.Laptop) error {
+	data, err := proto.Marshal(laptop)
+	if err != nil {
+		return fmt.Errorf("cannot marshal laptop: %w", err)
+	}
+
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	res, err := store.db.Exec(
+		`INSERT INTO laptops (`+laptopColumns+`, data) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`,
+		append(laptopColumnValues(laptop), data)...,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot insert laptop: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAlreadyExists
+	}
+
+	store.feed.publish(pb.LaptopEvent_CREATED, laptop, nil)
+	return nil
+}
+
+// Find returns the laptop with the given id, or nil if there is no such laptop
+func (store *SQLLaptopStore) Find(id string) (*pb.Laptop, error) {
+	return findSQLLaptop(store.db, id)
+}
+
+//db可以是*sql.DB或者*sql.Tx
+func findSQLLaptop(db interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, id string) (*pb.Laptop, error) {
+	var data []byte
+	err := db.QueryRow(`SELECT data FROM laptops WHERE id = ?`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot find laptop: %w", err)
+	}
+	return unmarshalLaptop(data)
+}
+
+// Update replaces the laptop in the database, see LaptopStore.Update
+func (store *SQLLaptopStore) Update(laptop *pb.Laptop, mask *fieldmaskpb.FieldMask, version *uint64) error {
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	var current, other *pb.Laptop
+	err := inTransaction(store.db, func(tx *sql.Tx) error {
+		var err error
+		current, err = findSQLLaptop(tx, laptop.GetId())
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return ErrNotFound
+		}
+
+		other, err = updatedLaptop(current, laptop, mask, version)
+		if err != nil {
+			return err
+		}
+		data, err := proto.Marshal(other)
+		if err != nil {
+			return fmt.Errorf("cannot marshal laptop: %w", err)
+		}
+
+		values := laptopColumnValues(other)
+		_, err = tx.Exec(
+			`UPDATE laptops SET brand = ?, name = ?, price_usd = ?, cpu_cores = ?, cpu_min_ghz = ?,
+			ram_bits = ?, release_year = ?, weight_kg = ?, version = ?, data = ? WHERE id = ?`,
+			append(values[1:], data, other.GetId())...,
+		)
+		if err != nil {
+			return fmt.Errorf("cannot update laptop: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	//提交成功之后调用方拿到的laptop也能看到新的版本号和合并后的字段
+	proto.Reset(laptop)
+	proto.Merge(laptop, other)
+	store.feed.publish(pb.LaptopEvent_UPDATED, other, current)
+	return nil
+}
+
+// Delete deletes the laptop from the database, see LaptopStore.Delete
+func (store *SQLLaptopStore) Delete(id string, version *uint64) error {
+	store.writeMutex.Lock()
+	defer store.writeMutex.Unlock()
+
+	var current *pb.Laptop
+	err := inTransaction(store.db, func(tx *sql.Tx) error {
+		var err error
+		current, err = findSQLLaptop(tx, id)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return ErrNotFound
+		}
+		if version != nil && current.GetVersion() != *version {
+			return fmt.Errorf("%w: expected version %d, current version %d", ErrVersionConflict, *version, current.GetVersion())
+		}
+
+		if _, err := tx.Exec(`DELETE FROM laptops WHERE id = ?`, id); err != nil {
+			return fmt.Errorf("cannot delete laptop: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	store.feed.publish(pb.LaptopEvent_DELETED, current, nil)
+	return nil
+}
+
+// List returns at most limit laptops whose id is greater than afterID, ordered by id
+func (store *SQLLaptopStore) List(ctx context.Context, afterID string, limit int) ([]*pb.Laptop, error) {
+	rows, err := store.db.QueryContext(ctx, `SELECT data FROM laptops WHERE id > ? ORDER BY id LIMIT ?`, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list laptops: %w", err)
+	}
+	defer rows.Close()
+
+	var laptops []*pb.Laptop
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		laptop, err := unmarshalLaptop(data)
+		if err != nil {
+			return nil, err
+		}
+		laptops = append(laptops, laptop)
+	}
+	return laptops, rows.Err()
+}
+
+// Search finds the laptops matching the filter, see LaptopStore.Search
+func (store *SQLLaptopStore) Search(
+	ctx context.Context,
+	filter *pb.Filter,
+	options *SearchOptions,
+	found func(laptop *pb.Laptop) error,
+) error {
+	results := newSearchResults(options, found)
+	err := store.forEachQualified(ctx, filter, func(laptop *pb.Laptop) error {
+		if !options.match(laptop) {
+			return nil
+		}
+		return results.add(laptop)
+	})
+	if err != nil {
+		return err
+	}
+	return results.flush()
+}
+
+// Aggregate counts the laptops matching the filter, see LaptopStore.Aggregate
+func (store *SQLLaptopStore) Aggregate(
+	ctx context.Context,
+	filter *pb.Filter,
+	facets []*pb.Facet,
+) (*pb.AggregateLaptopsResponse, error) {
+	aggregator, err := newLaptopAggregator(facets)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.forEachQualified(ctx, filter, func(laptop *pb.Laptop) error {
+		aggregator.add(laptop)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return aggregator.result(), nil
+}
+
+// Watch sends the changes made through this store to found, see LaptopStore.Watch
+func (store *SQLLaptopStore) Watch(
+	ctx context.Context,
+	filter *pb.Filter,
+	resumeAfter *uint64,
+	found func(event *pb.LaptopEvent) error,
+) error {
+	return store.feed.watch(ctx, filter, resumeAfter, found)
+}
+
+//用WHERE子句选出候选电脑，再用isQualified检查其余的条件
+func (store *SQLLaptopStore) forEachQualified(ctx context.Context, filter *pb.Filter, fn func(laptop *pb.Laptop) error) error {
+	where, args := sqlLaptopFilter(filter)
+	rows, err := store.db.QueryContext(ctx, `SELECT data FROM laptops`+where, args...)
+	if err != nil {
+		return fmt.Errorf("cannot search laptops: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		laptop, err := unmarshalLaptop(data)
+		if err != nil {
+			return err
+		}
+		if !isQualified(filter, laptop) {
+			continue
+		}
+		if err := fn(laptop); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//把过滤器中能用列表示的条件转换成WHERE子句，没有这样的条件时返回空字符串
+//这些条件只会比isQualified更宽松，不会漏掉符合条件的电脑
+func sqlLaptopFilter(filter *pb.Filter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, values ...interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, values...)
+	}
+
+	if filter.GetMinPriceUsd() > 0 {
+		add("price_usd >= ?", filter.GetMinPriceUsd())
+	}
+	if filter.GetMaxPriceUsd() > 0 {
+		add("price_usd <= ?", filter.GetMaxPriceUsd())
+	}
+	if filter.GetMinCpuCores() > 0 {
+		add("cpu_cores >= ?", filter.GetMinCpuCores())
+	}
+	if filter.GetMinCpuGhz() > 0 {
+		add("cpu_min_ghz >= ?", filter.GetMinCpuGhz())
+	}
+	if minRam := toBit(filter.GetMinRam()); minRam > 0 {
+		add("ram_bits >= ?", float64(minRam))
+	}
+	if filter.GetMinReleaseYear() > 0 {
+		add("release_year >= ?", filter.GetMinReleaseYear())
+	}
+	if filter.GetMaxReleaseYear() > 0 {
+		add("release_year <= ?", filter.GetMaxReleaseYear())
+	}
+	if maxWeight := units.FilterMaxWeightKg(filter); maxWeight > 0 {
+		add("weight_kg > 0 AND weight_kg <= ?", maxWeight)
+	}
+	if condition, values := sqlStringIn("brand", filter.GetBrands()); condition != "" {
+		add(condition, values...)
+	}
+	if condition, values := sqlStringIn("name", filter.GetNames()); condition != "" {
+		add(condition, values...)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+//column不区分大小写地等于values中的一个
+//NOCASE只忽略ASCII字母的大小写，有其他字符时交给isQualified检查
+func sqlStringIn(column string, values []string) (string, []interface{}) {
+	if len(values) == 0 {
+		return "", nil
+	}
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		if !isASCII(value) {
+			return "", nil
+		}
+		args[i] = value
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	return column + " COLLATE NOCASE IN (" + placeholders + ")", args
+}
+
+func isASCII(value string) bool {
+	for _, r := range value {
+		if r > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
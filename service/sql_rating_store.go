@@ -0,0 +1,176 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SQLRatingStore stores laptop ratings in a database opened with OpenSQLiteDB
+type SQLRatingStore struct {
+	db *sql.DB
+}
+
+// NewSQLRatingStore returns a new SQLRatingStore
+func NewSQLRatingStore(db *sql.DB) *SQLRatingStore {
+	return &SQLRatingStore{db}
+}
+
+// Rate records the score of the user for a laptop and returns the rating of the laptop
+func (store *SQLRatingStore) Rate(laptopID string, username string, score float64) (*Rating, error) {
+	if err := checkScore(score); err != nil {
+		return nil, err
+	}
+
+	//评分和汇总在同一个事务中更新，并发评分时汇总不会和评分不一致
+	var rating *Rating
+	err := inTransaction(store.db, func(tx *sql.Tx) error {
+		var previous float64
+		err := tx.QueryRow(
+			`SELECT score FROM user_ratings WHERE laptop_id = ? AND username = ?`,
+			laptopID, username,
+		).Scan(&previous)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		replaced := err == nil
+
+		_, err = tx.Exec(
+			`INSERT INTO user_ratings (laptop_id, username, score) VALUES (?, ?, ?)
+			ON CONFLICT (laptop_id, username) DO UPDATE SET score = excluded.score`,
+			laptopID, username, score,
+		)
+		if err != nil {
+			return err
+		}
+
+		if replaced {
+			_, err = tx.Exec(
+				`UPDATE ratings SET sum = sum - ? + ?, sum_squares = sum_squares - ? + ? WHERE laptop_id = ?`,
+				previous, score, previous*previous, score*score, laptopID,
+			)
+			if err == nil {
+				err = updateRatingHistogram(tx, laptopID, previous, -1)
+			}
+		} else {
+			_, err = tx.Exec(
+				`INSERT INTO ratings (laptop_id, count, sum, sum_squares) VALUES (?, 1, ?, ?)
+				ON CONFLICT (laptop_id) DO UPDATE SET
+					count = count + 1, sum = sum + excluded.sum, sum_squares = sum_squares + excluded.sum_squares`,
+				laptopID, score, score*score,
+			)
+		}
+		if err == nil {
+			err = updateRatingHistogram(tx, laptopID, score, 1)
+		}
+		if err != nil {
+			return err
+		}
+
+		rating, err = findSQLRating(tx, laptopID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot rate laptop: %w", err)
+	}
+	return rating, nil
+}
+
+// Withdraw removes the score of the user for a laptop and returns the rating of the laptop
+func (store *SQLRatingStore) Withdraw(laptopID string, username string) (*Rating, error) {
+	var rating *Rating
+	err := inTransaction(store.db, func(tx *sql.Tx) error {
+		var score float64
+		err := tx.QueryRow(
+			`DELETE FROM user_ratings WHERE laptop_id = ? AND username = ? RETURNING score`,
+			laptopID, username,
+		).Scan(&score)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var count uint32
+		err = tx.QueryRow(
+			`UPDATE ratings SET count = count - 1, sum = sum - ?, sum_squares = sum_squares - ?
+			WHERE laptop_id = ? RETURNING count`,
+			score, score*score, laptopID,
+		).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 { //最后一个评分被撤回，和没有评分一样
+			rating = &Rating{}
+			if _, err := tx.Exec(`DELETE FROM ratings WHERE laptop_id = ?`, laptopID); err != nil {
+				return err
+			}
+			_, err = tx.Exec(`DELETE FROM rating_histogram WHERE laptop_id = ?`, laptopID)
+			return err
+		}
+
+		if err := updateRatingHistogram(tx, laptopID, score, -1); err != nil {
+			return err
+		}
+		rating, err = findSQLRating(tx, laptopID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot withdraw rating: %w", err)
+	}
+	return rating, nil
+}
+
+// Find returns the rating of a laptop, or nil if it has not been rated
+func (store *SQLRatingStore) Find(laptopID string) (*Rating, error) {
+	rating, err := findSQLRating(store.db, laptopID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find rating: %w", err)
+	}
+	return rating, nil
+}
+
+//把评分在直方图中的数量加上delta
+func updateRatingHistogram(tx *sql.Tx, laptopID string, score float64, delta int) error {
+	_, err := tx.Exec(
+		`INSERT INTO rating_histogram (laptop_id, score, count) VALUES (?, ?, ?)
+		ON CONFLICT (laptop_id, score) DO UPDATE SET count = count + excluded.count`,
+		laptopID, MinLaptopScore+scoreBucket(score), delta,
+	)
+	return err
+}
+
+//读取汇总和直方图，没有评分时返回nil
+//db可以是*sql.DB或者*sql.Tx
+func findSQLRating(db interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, laptopID string) (*Rating, error) {
+	rating := &Rating{}
+	err := db.QueryRow(
+		`SELECT count, sum, sum_squares FROM ratings WHERE laptop_id = ?`, laptopID,
+	).Scan(&rating.Count, &rating.Sum, &rating.SumSquares)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT score, count FROM rating_histogram WHERE laptop_id = ?`, laptopID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var score int
+		var count uint32
+		if err := rows.Scan(&score, &count); err != nil {
+			return nil, err
+		}
+		if bucket := score - MinLaptopScore; bucket >= 0 && bucket < len(rating.Histogram) {
+			rating.Histogram[bucket] = count
+		}
+	}
+	return rating, rows.Err()
+}
@@ -0,0 +1,206 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"grpctest/pb"
+	"grpctest/sample"
+	"grpctest/service"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestSQLLaptopStore(t *testing.T) {
+	t.Parallel()
+
+	dbPath := filepath.Join(t.TempDir(), "laptop.db")
+	db, err := service.OpenSQLiteDB(dbPath)
+	require.NoError(t, err)
+	store := service.NewSQLLaptopStore(db)
+	memory := service.NewInMemoryLaptopStore()
+
+	for i := 0; i < 300; i++ {
+		laptop := sample.NewLaptop()
+		require.NoError(t, store.Save(laptop))
+		require.NoError(t, memory.Save(laptop))
+
+		switch i % 10 {
+		case 0:
+			laptop.PriceUsd = 1000
+			require.NoError(t, store.Update(laptop, nil, nil))
+			laptop.Version = 0
+			require.NoError(t, memory.Update(laptop, nil, nil))
+		case 1:
+			laptop.Brand = "Dell"
+			mask := &fieldmaskpb.FieldMask{Paths: []string{"brand"}}
+			require.NoError(t, store.Update(laptop, mask, nil))
+			require.NoError(t, memory.Update(laptop, mask, nil))
+		case 2:
+			require.NoError(t, store.Delete(laptop.Id, nil))
+			require.NoError(t, memory.Delete(laptop.Id, nil))
+		}
+	}
+
+	laptop := sample.NewLaptop()
+	require.NoError(t, store.Save(laptop))
+	require.ErrorIs(t, store.Save(laptop), service.ErrAlreadyExists)
+	require.NoError(t, store.Update(laptop, nil, nil))
+	require.NoError(t, store.Update(laptop, nil, nil))
+	laptop.Version = 0
+	require.ErrorIs(t, store.Update(laptop, nil, nil), service.ErrVersionConflict)
+	version := uint64(1)
+	require.ErrorIs(t, store.Delete(laptop.Id, &version), service.ErrVersionConflict)
+	version = 2
+	require.NoError(t, store.Delete(laptop.Id, &version))
+	require.ErrorIs(t, store.Delete(laptop.Id, nil), service.ErrNotFound)
+
+	filters := []*pb.Filter{
+		nil,
+		{MaxPriceUsd: 2000, MinCpuCores: 4},
+		{MinCpuGhz: 3, MinRam: &pb.Memory{Value: 32, Uint: pb.Memory_GIGABYTE}},
+		{Brands: []string{"dell", "LENOVO"}, MinReleaseYear: 2018},
+		{MaxWeight: &pb.Filter_MaxWeightLb{MaxWeightLb: 4}},
+		{GpuBrands: []string{"nvidia"}, KeyboardBacklit: wrapperspb.Bool(true)}, //只能用isQualified检查的条件
+	}
+
+	searchIDs := func(store service.LaptopStore, filter *pb.Filter) []string {
+		var ids []string
+		err := store.Search(context.Background(), filter, nil, func(laptop *pb.Laptop) error {
+			ids = append(ids, laptop.GetId())
+			return nil
+		})
+		require.NoError(t, err)
+		sort.Strings(ids)
+		return ids
+	}
+
+	for _, filter := range filters {
+		require.Equal(t, searchIDs(memory, filter), searchIDs(store, filter), filter.String())
+	}
+
+	//排序和数量限制与InMemoryLaptopStore一致
+	options := &service.SearchOptions{SortBy: []*pb.SortKey{{Field: pb.SortKey_PRICE}}, MaxResults: 10}
+	var expected, actual []string
+	require.NoError(t, memory.Search(context.Background(), nil, options, func(laptop *pb.Laptop) error {
+		expected = append(expected, laptop.GetId())
+		return nil
+	}))
+	require.NoError(t, store.Search(context.Background(), nil, options, func(laptop *pb.Laptop) error {
+		actual = append(actual, laptop.GetId())
+		return nil
+	}))
+	require.Equal(t, expected, actual)
+
+	//重新打开数据库后数据仍然存在，已经执行过的迁移不会再执行
+	laptops := listAllLaptops(t, store)
+	require.NoError(t, db.Close())
+	db, err = service.OpenSQLiteDB(dbPath)
+	require.NoError(t, err)
+	defer db.Close()
+	requireSameLaptops(t, laptops, listAllLaptops(t, service.NewSQLLaptopStore(db)))
+}
+
+func TestSQLRatingStore(t *testing.T) {
+	t.Parallel()
+
+	db, err := service.OpenSQLiteDB(filepath.Join(t.TempDir(), "laptop.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	store := service.NewSQLRatingStore(db)
+	memory := service.NewInMemoryRatingStore()
+
+	rating, err := store.Find("unknown")
+	require.NoError(t, err)
+	require.Nil(t, rating)
+
+	//汇总和直方图与InMemoryRatingStore一致
+	requireSameRating := func(rating *service.Rating) {
+		expected, err := memory.Find("laptop")
+		require.NoError(t, err)
+		require.Equal(t, expected.Count, rating.Count)
+		require.Equal(t, expected.Histogram, rating.Histogram)
+		require.InDelta(t, expected.SumSquares, rating.SumSquares, 1e-9)
+	}
+
+	//并发评分时每个用户的评分都会被记录
+	//require不能在其他goroutine中调用，错误发回测试goroutine检查
+	n := 20
+	errs := make(chan error, 2*n)
+	for i := 1; i <= n; i++ {
+		go func(i int) {
+			username := fmt.Sprintf("user%d", i)
+			_, err := store.Rate("laptop", username, float64(i%10+1))
+			errs <- err
+			_, err = memory.Rate("laptop", username, float64(i%10+1))
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 2*n; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	rating, err = store.Find("laptop")
+	require.NoError(t, err)
+	require.Equal(t, uint32(n), rating.Count)
+	require.Equal(t, 110.0, rating.Sum)
+	requireSameRating(rating)
+
+	//再次评分替换之前的评分，撤回后不再计算
+	rating, err = store.Rate("laptop", "user1", 10)
+	require.NoError(t, err)
+	require.Equal(t, uint32(n), rating.Count)
+	require.Equal(t, 118.0, rating.Sum)
+	_, err = memory.Rate("laptop", "user1", 10)
+	require.NoError(t, err)
+	requireSameRating(rating)
+	rating, err = store.Withdraw("laptop", "user2")
+	require.NoError(t, err)
+	require.Equal(t, uint32(n-1), rating.Count)
+	require.Equal(t, 115.0, rating.Sum)
+	_, err = memory.Withdraw("laptop", "user2")
+	require.NoError(t, err)
+	requireSameRating(rating)
+	_, err = store.Withdraw("laptop", "user2")
+	require.ErrorIs(t, err, service.ErrNotFound)
+
+	_, err = store.Rate("laptop", "user1", 11)
+	require.ErrorIs(t, err, service.ErrInvalidScore)
+
+	//最后一个评分被撤回后和没有评分一样
+	_, err = store.Rate("other", "user1", 5)
+	require.NoError(t, err)
+	rating, err = store.Withdraw("other", "user1")
+	require.NoError(t, err)
+	require.Equal(t, &service.Rating{}, rating)
+	rating, err = store.Find("other")
+	require.NoError(t, err)
+	require.Nil(t, rating)
+}
+
+func TestSQLUserStore(t *testing.T) {
+	t.Parallel()
+
+	db, err := service.OpenSQLiteDB(filepath.Join(t.TempDir(), "laptop.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	store := service.NewSQLUserStore(db)
+
+	user, err := service.NewUser("admin1", "secret", "admin")
+	require.NoError(t, err)
+	require.NoError(t, store.Save(user))
+	require.ErrorIs(t, store.Save(user), service.ErrAlreadyExists)
+
+	other, err := store.Find("admin1")
+	require.NoError(t, err)
+	require.Equal(t, user, other)
+	require.True(t, other.IsCorrectPassword("secret"))
+
+	other, err = store.Find("unknown")
+	require.NoError(t, err)
+	require.Nil(t, other)
+}
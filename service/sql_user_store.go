@@ -0,0 +1,48 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SQLUserStore stores users in a database opened with OpenSQLiteDB
+type SQLUserStore struct {
+	db *sql.DB
+}
+
+// NewSQLUserStore returns a new SQLUserStore
+func NewSQLUserStore(db *sql.DB) *SQLUserStore {
+	return &SQLUserStore{db}
+}
+
+// Save saves a user to the store
+func (store *SQLUserStore) Save(user *User) error {
+	res, err := store.db.Exec(
+		`INSERT INTO users (username, hashed_password, role) VALUES (?, ?, ?) ON CONFLICT (username) DO NOTHING`,
+		user.Username, user.HashedPassword, user.Role,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot insert user: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 { //已经存储与用户名相同的用户
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+// Find finds a user by username
+func (store *SQLUserStore) Find(username string) (*User, error) {
+	user := &User{}
+	err := store.db.QueryRow(
+		`SELECT username, hashed_password, role FROM users WHERE username = ?`, username,
+	).Scan(&user.Username, &user.HashedPassword, &user.Role)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot find user: %w", err)
+	}
+	return user, nil
+}
@@ -0,0 +1,136 @@
+//嵌入式的SQLite数据库，不需要单独运行数据库服务器
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	_ "modernc.org/sqlite" //纯Go实现的SQLite驱动，注册为"sqlite"
+)
+
+//数据库结构的迁移，按顺序执行，已经执行过的不会再执行
+//只能在末尾追加新的迁移，不能修改已经发布的迁移
+var sqliteMigrations = []string{
+	//1: 电脑、评分和用户
+	`CREATE TABLE laptops (
+		id           TEXT PRIMARY KEY,
+		brand        TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		price_usd    REAL NOT NULL,
+		cpu_cores    INTEGER NOT NULL,
+		cpu_min_ghz  REAL NOT NULL,
+		ram_bits     REAL NOT NULL,
+		release_year INTEGER NOT NULL,
+		weight_kg    REAL NOT NULL,
+		version      INTEGER NOT NULL,
+		data         BLOB NOT NULL
+	);
+	CREATE INDEX laptops_price ON laptops (price_usd);
+	CREATE INDEX laptops_brand ON laptops (brand COLLATE NOCASE);
+	CREATE INDEX laptops_ram ON laptops (ram_bits);
+	CREATE TABLE ratings (
+		laptop_id TEXT PRIMARY KEY,
+		count     INTEGER NOT NULL,
+		sum       REAL NOT NULL
+	);
+	CREATE TABLE users (
+		username        TEXT PRIMARY KEY,
+		hashed_password TEXT NOT NULL,
+		role            TEXT NOT NULL
+	);`,
+	//2: 每个用户对每台电脑的评分，ratings变成随它一起更新的汇总
+	//之前的评分没有记录用户，仍然计算在汇总中，但是不能被替换或者撤回
+	`CREATE TABLE user_ratings (
+		laptop_id TEXT NOT NULL,
+		username  TEXT NOT NULL,
+		score     REAL NOT NULL,
+		PRIMARY KEY (laptop_id, username)
+	);`,
+	//3: 评分的平方和与直方图，用来计算标准差和中位数
+	//没有记录用户的旧评分只知道总和，按照它们的平均分计算
+	`ALTER TABLE ratings ADD COLUMN sum_squares REAL NOT NULL DEFAULT 0;
+	CREATE TABLE rating_histogram (
+		laptop_id TEXT NOT NULL,
+		score     INTEGER NOT NULL,
+		count     INTEGER NOT NULL,
+		PRIMARY KEY (laptop_id, score)
+	);
+	CREATE TEMP TABLE legacy_ratings AS
+		SELECT r.laptop_id AS laptop_id, r.count - COUNT(u.score) AS count, r.sum - COALESCE(SUM(u.score), 0) AS sum
+		FROM ratings r LEFT JOIN user_ratings u ON u.laptop_id = r.laptop_id
+		GROUP BY r.laptop_id;
+	UPDATE ratings SET sum_squares =
+		COALESCE((SELECT SUM(u.score * u.score) FROM user_ratings u WHERE u.laptop_id = ratings.laptop_id), 0) +
+		COALESCE((SELECT l.sum * l.sum / l.count FROM legacy_ratings l WHERE l.laptop_id = ratings.laptop_id AND l.count > 0), 0);
+	INSERT INTO rating_histogram (laptop_id, score, count)
+		SELECT laptop_id, MIN(MAX(CAST(ROUND(score) AS INTEGER), 1), 10) AS bucket, SUM(n) FROM (
+			SELECT laptop_id, score, 1 AS n FROM user_ratings
+			UNION ALL
+			SELECT laptop_id, sum / count, count FROM legacy_ratings WHERE count > 0
+		) GROUP BY laptop_id, bucket;
+	DROP TABLE legacy_ratings;`,
+}
+
+// OpenSQLiteDB opens the database file at path and migrates it to the latest schema
+func OpenSQLiteDB(path string) (*sql.DB, error) {
+	//写事务一开始就加锁，避免两个事务都读完之后才发现不能写；遇到锁时最多等待5秒
+	query := url.Values{}
+	query.Add("_pragma", "busy_timeout(5000)")
+	query.Add("_pragma", "journal_mode(WAL)")
+	query.Add("_pragma", "synchronous(NORMAL)")
+	query.Set("_txlock", "immediate")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+	if err := migrateSQLiteDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func migrateSQLiteDB(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return fmt.Errorf("cannot create migration table: %w", err)
+	}
+
+	var version int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("cannot read schema version: %w", err)
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than this server (%d)", version, len(sqliteMigrations))
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("cannot migrate database to version %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+//在事务中执行fn，fn返回错误时回滚
+func inTransaction(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
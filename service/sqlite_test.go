@@ -0,0 +1,49 @@
+package service
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteRatingHistogramMigration(t *testing.T) {
+	t.Parallel()
+
+	//创建只执行了前两个迁移的数据库，laptop-a有两个没有记录用户的旧评分
+	dbPath := filepath.Join(t.TempDir(), "laptop.db")
+	db, err := sql.Open("sqlite", dbPath)
+	require.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY)`)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = db.Exec(sqliteMigrations[i])
+		require.NoError(t, err)
+		_, err = db.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1)
+		require.NoError(t, err)
+	}
+	_, err = db.Exec(`INSERT INTO ratings (laptop_id, count, sum) VALUES ('laptop-a', 3, 17), ('laptop-b', 2, 12);
+	INSERT INTO user_ratings (laptop_id, username, score) VALUES
+		('laptop-a', 'user1', 9), ('laptop-b', 'user1', 2), ('laptop-b', 'user2', 10);`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db, err = OpenSQLiteDB(dbPath)
+	require.NoError(t, err)
+	defer db.Close()
+	store := NewSQLRatingStore(db)
+
+	//旧评分按照它们的平均分4计算
+	rating, err := store.Find("laptop-a")
+	require.NoError(t, err)
+	require.Equal(t, &Rating{Count: 3, Sum: 17, SumSquares: 81 + 2*16, Histogram: [10]uint32{3: 2, 8: 1}}, rating)
+	rating, err = store.Find("laptop-b")
+	require.NoError(t, err)
+	require.Equal(t, &Rating{Count: 2, Sum: 12, SumSquares: 104, Histogram: [10]uint32{1: 1, 9: 1}}, rating)
+
+	rating, err = store.Withdraw("laptop-a", "user1")
+	require.NoError(t, err)
+	require.Equal(t, &Rating{Count: 2, Sum: 8, SumSquares: 32, Histogram: [10]uint32{3: 2}}, rating)
+	require.Equal(t, 4.0, rating.Median())
+}
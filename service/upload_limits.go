@@ -0,0 +1,113 @@
+//上传图像的大小、数量和用户配额限制
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrImageTooLarge is returned when an image is larger than the maximum image size
+var ErrImageTooLarge = errors.New("image is too large")
+
+// ErrTooManyImages is returned when a laptop already has the maximum number of images
+var ErrTooManyImages = errors.New("too many images")
+
+// ErrQuotaExceeded is returned when an upload would exceed the storage quota of the user
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// UploadLimits bounds the images uploaded to the server
+type UploadLimits struct {
+	MaxImageSize       int64 //单张图像的最大字节数
+	MaxImagesPerLaptop int   //每台电脑最多的图像数量，0表示不限制
+	UserQuota          int64 //每个用户上传的图像最多的总字节数，0表示不限制
+}
+
+// DefaultUploadLimits are the limits used when the server is not configured otherwise
+var DefaultUploadLimits = UploadLimits{MaxImageSize: 1 << 20}
+
+//已经通过检查但是还没有保存完的图像，检查限制时和已经保存的图像一起计算
+type imageReservations struct {
+	images map[string]int   //key是电脑id，value是正在保存的图像数量
+	bytes  map[string]int64 //key是用户名，value是正在保存的图像的总字节数
+}
+
+func (reserved *imageReservations) add(owner string, laptopID string, size int64) {
+	if reserved.images == nil {
+		reserved.images = make(map[string]int)
+		reserved.bytes = make(map[string]int64)
+	}
+	reserved.images[laptopID]++
+	reserved.bytes[owner] += size
+}
+
+func (reserved *imageReservations) release(owner string, laptopID string, size int64) {
+	if reserved.images[laptopID]--; reserved.images[laptopID] <= 0 {
+		delete(reserved.images, laptopID)
+	}
+	if reserved.bytes[owner] -= size; reserved.bytes[owner] <= 0 {
+		delete(reserved.bytes, owner)
+	}
+}
+
+//返回owner给电脑再上传一张图像时最多可以使用的字节数，reserved中正在保存的图像也计算在内，可以为nil
+//电脑的图像数量已经达到上限，或者用户的配额已经用完时返回错误
+//没有设置的限制不会读取imageStore
+func (limits UploadLimits) allowance(imageStore ImageStore, reserved *imageReservations, owner string, laptopID string) (int64, error) {
+	if reserved == nil {
+		reserved = &imageReservations{}
+	}
+	if limits.MaxImagesPerLaptop > 0 {
+		count, err := countImages(imageStore, laptopID)
+		if err != nil {
+			return 0, err
+		}
+		count += reserved.images[laptopID]
+		if count >= limits.MaxImagesPerLaptop {
+			return 0, fmt.Errorf("%w: laptop %s already has %d images", ErrTooManyImages, laptopID, count)
+		}
+	}
+
+	allowance := limits.MaxImageSize
+	if limits.UserQuota > 0 {
+		usage, err := imageStore.Usage(owner)
+		if err != nil {
+			return 0, err
+		}
+		used := usage.Bytes + reserved.bytes[owner]
+		remaining := limits.UserQuota - used
+		if remaining <= 0 {
+			return 0, fmt.Errorf("%w: %d of %d bytes used", ErrQuotaExceeded, used, limits.UserQuota)
+		}
+		if remaining < allowance {
+			allowance = remaining
+		}
+	}
+	return allowance, nil
+}
+
+//不读取图像信息就能数出电脑图像数量的ImageStore，检查图像数量限制时不需要调用List
+type imageCounter interface {
+	countImages(laptopID string) (int, error)
+}
+
+func countImages(imageStore ImageStore, laptopID string) (int, error) {
+	if counter, ok := imageStore.(imageCounter); ok {
+		return counter.countImages(laptopID)
+	}
+	images, err := imageStore.List(laptopID)
+	if err != nil {
+		return 0, err
+	}
+	return len(images), nil
+}
+
+//检查已经收到的字节数是否超过了allowance，并区分是单张图像太大还是超过了配额
+func (limits UploadLimits) checkSize(size int64, allowance int64) error {
+	if size <= allowance {
+		return nil
+	}
+	if size > limits.MaxImageSize {
+		return fmt.Errorf("%w: %d > %d", ErrImageTooLarge, size, limits.MaxImageSize)
+	}
+	return fmt.Errorf("%w: the image needs %d bytes but only %d bytes are left", ErrQuotaExceeded, size, allowance)
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+//Save先通知saving，然后等待release，用来模拟保存很慢的图像
+type blockingImageStore struct {
+	ImageStore
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (store *blockingImageStore) Save(laptopID string, imageType string, owner string, imageData io.Reader) (string, error) {
+	store.saving <- struct{}{}
+	<-store.release
+	return store.ImageStore.Save(laptopID, imageType, owner, imageData)
+}
+
+func TestSaveImageReservesLimitsOutsideLock(t *testing.T) {
+	t.Parallel()
+
+	diskStore, err := NewDiskImageStore(t.TempDir())
+	require.NoError(t, err)
+	imageStore := &blockingImageStore{
+		ImageStore: diskStore,
+		saving:     make(chan struct{}, 3),
+		release:    make(chan struct{}),
+	}
+	server := NewLaptopServer(NewInMemoryLaptopStore(), imageStore, nil)
+	server.SetUploadLimits(UploadLimits{MaxImageSize: 100, MaxImagesPerLaptop: 2, UserQuota: 150})
+
+	saved := make(chan error, 1)
+	go func() {
+		_, err := server.saveImage("user1", "laptop1", ".jpg", strings.NewReader(strings.Repeat("x", 100)), 100)
+		saved <- err
+	}()
+	<-imageStore.saving
+
+	//第一张图像还在保存，它预留的配额已经计算在内，检查不需要等它保存完
+	checked := make(chan error, 1)
+	go func() {
+		_, err := server.saveImage("user1", "laptop2", ".jpg", strings.NewReader(strings.Repeat("x", 100)), 100)
+		checked <- err
+	}()
+	select {
+	case err := <-checked:
+		require.True(t, errors.Is(err, ErrQuotaExceeded), "unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("limits are checked while another image is being saved")
+	}
+
+	close(imageStore.release)
+	require.NoError(t, <-saved)
+
+	//保存结束后释放预留，配额从imageStore中计算
+	require.Empty(t, server.reserved.images)
+	require.Empty(t, server.reserved.bytes)
+	_, err = server.saveImage("user1", "laptop1", ".jpg", strings.NewReader("small"), 5)
+	require.NoError(t, err)
+	_, err = server.saveImage("user1", "laptop1", ".jpg", strings.NewReader("small"), 5)
+	require.ErrorIs(t, err, ErrTooManyImages)
+}
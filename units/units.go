@@ -0,0 +1,54 @@
+//Package units 换算电脑的容量和重量，service和query包使用同一套换算，结果不会不一致
+package units
+
+import "grpctest/pb"
+
+// KgPerLb is the number of kilograms in a pound
+const KgPerLb = 0.45359237
+
+// UnitBits returns the number of bits in one memory unit
+func UnitBits(unit pb.Memory_Unit) uint64 {
+	switch unit {
+	case pb.Memory_BYTE: //一字节是8位，8=2^3，用位移代替乘法
+		return 1 << 3
+	case pb.Memory_KYLOBYTE: //1kilobyte = 1024 byte
+		return 1 << 13
+	case pb.Memory_MEGABYTE:
+		return 1 << 23
+	case pb.Memory_GIGABYTE:
+		return 1 << 33
+	case pb.Memory_TERABYTE:
+		return 1 << 43
+	default: //BIT和UNKNOWN都按位处理
+		return 1
+	}
+}
+
+// MemoryBits converts a memory to bits, a nil memory is 0 bits
+func MemoryBits(memory *pb.Memory) uint64 {
+	return memory.GetValue() * UnitBits(memory.GetUint())
+}
+
+// LaptopWeightKg returns the weight of a laptop in kilograms, ok is false if the laptop has no weight
+func LaptopWeightKg(laptop *pb.Laptop) (kg float64, ok bool) {
+	switch weight := laptop.GetWeight().(type) {
+	case *pb.Laptop_WeightKg:
+		return weight.WeightKg, true
+	case *pb.Laptop_WeightLb:
+		return weight.WeightLb * KgPerLb, true
+	default:
+		return 0, false
+	}
+}
+
+// FilterMaxWeightKg returns the maximum weight of a filter in kilograms, or 0 if the filter has none
+func FilterMaxWeightKg(filter *pb.Filter) float64 {
+	switch weight := filter.GetMaxWeight().(type) {
+	case *pb.Filter_MaxWeightKg:
+		return weight.MaxWeightKg
+	case *pb.Filter_MaxWeightLb:
+		return weight.MaxWeightLb * KgPerLb
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,42 @@
+package units_test
+
+import (
+	"grpctest/pb"
+	"grpctest/units"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBits(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		memory *pb.Memory
+		bits   uint64
+	}{
+		{nil, 0},
+		{&pb.Memory{Value: 3, Uint: pb.Memory_BIT}, 3},
+		{&pb.Memory{Value: 2, Uint: pb.Memory_BYTE}, 16},
+		{&pb.Memory{Value: 1, Uint: pb.Memory_KYLOBYTE}, 8 * 1024},
+		{&pb.Memory{Value: 16384, Uint: pb.Memory_MEGABYTE}, 16 << 33},
+		{&pb.Memory{Value: 16, Uint: pb.Memory_GIGABYTE}, 16 << 33},
+		{&pb.Memory{Value: 1, Uint: pb.Memory_TERABYTE}, 1 << 43},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.bits, units.MemoryBits(tc.memory), tc.memory.String())
+	}
+}
+
+func TestWeightKg(t *testing.T) {
+	t.Parallel()
+
+	weight, ok := units.LaptopWeightKg(&pb.Laptop{Weight: &pb.Laptop_WeightLb{WeightLb: 10}})
+	require.True(t, ok)
+	require.InDelta(t, 4.5359237, weight, 1e-9)
+	_, ok = units.LaptopWeightKg(&pb.Laptop{})
+	require.False(t, ok)
+
+	require.Equal(t, 2.0, units.FilterMaxWeightKg(&pb.Filter{MaxWeight: &pb.Filter_MaxWeightKg{MaxWeightKg: 2}}))
+	require.Zero(t, units.FilterMaxWeightKg(nil))
+}